@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"os"
 
 	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/audit"
+	"github.com/mxcd/gitops-cli/internal/config"
 	"github.com/mxcd/gitops-cli/internal/finalizer"
+	"github.com/mxcd/gitops-cli/internal/history"
 	"github.com/mxcd/gitops-cli/internal/k8s"
 	"github.com/mxcd/gitops-cli/internal/kubernetes"
 	"github.com/mxcd/gitops-cli/internal/patch"
@@ -70,6 +74,27 @@ func main() {
 				Usage:   "display unchanged secrets in the plan overview",
 				EnvVars: []string{"GITOPS_SHOW_UNCHANGED"},
 			},
+			&cli.BoolFlag{
+				Name:    "allow-missing-keys",
+				Usage:   "render missing template keys as <no value> instead of failing (for legacy secret files)",
+				EnvVars: []string{"GITOPS_ALLOW_MISSING_KEYS"},
+			},
+			&cli.StringFlag{
+				Name:    "env",
+				Usage:   "environment overlay values files to merge on top of the directory values (e.g. prod for values.prod.gitops.secret.enc.yaml)",
+				EnvVars: []string{"GITOPS_ENV"},
+			},
+			&cli.StringFlag{
+				Name:    "state-backend",
+				Value:   ".gitops-state.yaml",
+				Usage:   "where the state is stored: a file relative to the root dir, kubernetes://[cluster]/<namespace>/<configmap|secret>/<name> or s3://<bucket>/<key>",
+				EnvVars: []string{"GITOPS_STATE_BACKEND"},
+			},
+			&cli.StringFlag{
+				Name:    "history",
+				Usage:   "where the apply history is stored, same format as --state-backend (default: next to the state)",
+				EnvVars: []string{"GITOPS_HISTORY"},
+			},
 		},
 		Commands: []*cli.Command{
 			{
@@ -100,9 +125,28 @@ func main() {
 										Name:  "auto-approve",
 										Usage: "apply the changes without prompting for approval",
 									},
+									&cli.BoolFlag{
+										Name:    "prune",
+										Usage:   "delete cluster secrets whose secret files were removed and that have no deletionPolicy",
+										EnvVars: []string{"GITOPS_PRUNE"},
+									},
+									&cli.IntFlag{
+										Name:    "max-deletes",
+										Value:   5,
+										Usage:   "refuse to delete more than this number of secrets without --force (-1 disables the limit)",
+										EnvVars: []string{"GITOPS_MAX_DELETES"},
+									},
+									&cli.BoolFlag{
+										Name:  "force",
+										Usage: "delete secrets even if their number exceeds --max-deletes",
+									},
 								},
 								Action: func(c *cli.Context) error {
-									initApplication(c)
+									unlock, err := initLockedApplication(c)
+									defer unlock()
+									if err != nil {
+										return err
+									}
 									return kubernetes.ApplyKubernetes(c)
 								},
 							},
@@ -125,20 +169,101 @@ func main() {
 								Name:    "kubernetes",
 								Aliases: []string{"k8s"},
 								Usage:   "Plan the application of secrets into a Kubernetes cluster",
-
+								Flags: []cli.Flag{
+									&cli.BoolFlag{
+										Name:    "prune",
+										Usage:   "delete cluster secrets whose secret files were removed and that have no deletionPolicy",
+										EnvVars: []string{"GITOPS_PRUNE"},
+									},
+									&cli.IntFlag{
+										Name:    "max-deletes",
+										Value:   5,
+										Usage:   "warn if the plan deletes more than this number of secrets (-1 disables the limit)",
+										EnvVars: []string{"GITOPS_MAX_DELETES"},
+									},
+									&cli.StringFlag{
+										Name:  "ref",
+										Usage: "plan the secret files of a git revision (commit, tag, branch, origin/main, ...) instead of the working tree",
+									},
+								},
 								Action: func(c *cli.Context) error {
-									initApplication(c)
+									unlock, err := initLockedApplication(c)
+									defer unlock()
+									if err != nil {
+										return err
+									}
 									return kubernetes.PlanKubernetes(c)
 								},
 							},
 						},
 					},
 					{
-						Name:  "template",
-						Usage: "Test the templating of secrets",
+						Name:  "diff",
+						Usage: "Show the secret changes between two git revisions without contacting any cluster",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "from",
+								Usage:    "git revision to compare from, e.g. the base of a pull request",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "to",
+								Usage: "git revision to compare to (default: the working tree)",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							initContext(c)
+							// secrets are rendered for the environments of their clusters, the state is not changed
+							state.LoadClusterEnvironments(c)
+							return secret.DiffCommand(c)
+						},
+					},
+					{
+						Name:      "rollback",
+						Usage:     "Apply the content a secret file had at an earlier git revision without changing the working tree",
+						ArgsUsage: "<path>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "to",
+								Usage:    "git revision (commit, tag, branch, HEAD~1, ...) to roll the secret file back to",
+								Required: true,
+							},
+							&cli.BoolFlag{
+								Name:  "auto-approve",
+								Usage: "apply the changes without prompting for approval",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							unlock, err := initLockedApplication(c)
+							defer unlock()
+							if err != nil {
+								return err
+							}
+							return kubernetes.RollbackCommand(c)
+						},
+					},
+					{
+						Name:      "template",
+						Usage:     "Render secrets with their resolved values",
+						ArgsUsage: "[path]",
 						Action: func(c *cli.Context) error {
 							initApplication(c)
-							return templating.TestTemplating(c)
+							return secret.TemplateCommand(c)
+						},
+					},
+					{
+						Name:  "values",
+						Usage: "Inspect the values used for templating secrets",
+						Subcommands: []*cli.Command{
+							{
+								Name:      "explain",
+								Usage:     "Show the effective values of a secret path and the values file each value came from",
+								ArgsUsage: "<secret-path> [key.path]",
+								Action: func(c *cli.Context) error {
+									initApplication(c)
+									return templating.ValuesExplainCommand(c)
+								},
+							},
 						},
 					},
 					{
@@ -150,6 +275,172 @@ func main() {
 							return secret.CompareCommand(c)
 						},
 					},
+					{
+						Name:  "expiring",
+						Usage: "List secrets that expire or are due for rotation",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "within",
+								Value: "30d",
+								Usage: "list secrets that expire or are due for rotation within this duration (e.g. 30d, 2w, 12h)",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							initApplication(c)
+							return secret.ExpiringCommand(c)
+						},
+					},
+					{
+						Name:  "audit",
+						Usage: "Detect unencrypted secret files and plaintext secret leaks",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:    "min-length",
+								Value:   8,
+								Usage:   "minimum length of a decrypted value to be considered for leak detection",
+								EnvVars: []string{"GITOPS_AUDIT_MIN_LENGTH"},
+							},
+						},
+						Action: func(c *cli.Context) error {
+							initApplication(c)
+							return audit.AuditCommand(c)
+						},
+					},
+				},
+			},
+			{
+				Name:  "history",
+				Usage: "List past applies, newest first",
+				Flags: historyFilterFlags(),
+				Action: func(c *cli.Context) error {
+					initApplication(c)
+					return history.ListCommand(c)
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:      "show",
+						Usage:     "Show the items and redacted changes of a past apply",
+						ArgsUsage: "<id>",
+						Flags:     historyFilterFlags(),
+						Action: func(c *cli.Context) error {
+							initApplication(c)
+							return history.ShowCommand(c)
+						},
+					},
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Inspect the configuration of the GitOps CLI",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "Show the effective configuration and where each value came from",
+						Action: func(c *cli.Context) error {
+							initApplication(c)
+							return config.ShowCommand(c)
+						},
+					},
+				},
+			},
+			{
+				Name:  "state",
+				Usage: "Manage the GitOps state",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "force-unlock",
+						Usage:     "Remove the state lock of another run, e.g. one that was aborted",
+						ArgsUsage: "<lock-id>",
+						Action: func(c *cli.Context) error {
+							initContext(c)
+							return state.ForceUnlockCommand(c)
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "List the secrets managed by the state",
+						Action: func(c *cli.Context) error {
+							initApplication(c)
+							return state.ListCommand(c)
+						},
+					},
+					{
+						Name:      "show",
+						Usage:     "Show the state of the secrets of a secret file, a state key or a secret id",
+						ArgsUsage: "<path|id>",
+						Action: func(c *cli.Context) error {
+							initApplication(c)
+							return state.ShowCommand(c)
+						},
+					},
+					{
+						Name:      "rm",
+						Usage:     "Stop managing the secrets of a secret file without deleting them from their target",
+						ArgsUsage: "<path>",
+						Action: func(c *cli.Context) error {
+							unlock, err := initLockedApplication(c)
+							defer unlock()
+							if err != nil {
+								return err
+							}
+							return state.RemoveCommand(c)
+						},
+					},
+					{
+						Name:      "mv",
+						Usage:     "Move the state of a renamed secret file to its new path",
+						ArgsUsage: "<old-path> <new-path>",
+						Action: func(c *cli.Context) error {
+							unlock, err := initLockedApplication(c)
+							defer unlock()
+							if err != nil {
+								return err
+							}
+							return state.MoveCommand(c)
+						},
+					},
+					{
+						Name:      "import",
+						Usage:     "Adopt existing objects of a cluster into the state of a secret file",
+						ArgsUsage: "<path>",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "from-cluster",
+								Usage: "adopt the objects of the secret file that already exist in their target cluster",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							unlock, err := initLockedApplication(c)
+							defer unlock()
+							if err != nil {
+								return err
+							}
+							return kubernetes.ImportCommand(c)
+						},
+					},
+					{
+						Name:  "migrate",
+						Usage: "Copy the state to another state backend",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "to",
+								Usage:    "state backend to copy the state to",
+								Required: true,
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "overwrite an existing state in the target backend",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							unlock, err := initLockedApplication(c)
+							defer unlock()
+							if err != nil {
+								return err
+							}
+							return state.MigrateCommand(c)
+						},
+					},
 				},
 			},
 			{
@@ -167,28 +458,42 @@ func main() {
 								return nil
 							}
 							for _, cluster := range clusters {
-								println(color.InBlue(cluster.Name), " => ", cluster.ConfigFile)
+								if cluster.Environment != "" {
+									println(color.InBlue(cluster.Name), " => ", cluster.ConfigFile, " (environment: "+cluster.Environment+")")
+								} else {
+									println(color.InBlue(cluster.Name), " => ", cluster.ConfigFile)
+								}
 							}
-							return finalizer.ExitApplication(c, true)
+							return finalizer.ExitApplication(c, false)
 						},
 					},
 					{
 						Name:  "add",
 						Usage: "Add a target cluster. <name> <configFile>",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "env",
+								Usage: "environment overlay values files to use for secrets of this cluster",
+							},
+						},
 						Action: func(c *cli.Context) error {
-							initApplication(c)
-							kubeconfig := ""
+							if c.Args().Len() != 1 && c.Args().Len() != 2 {
+								return errors.New("expected a name and an optional kubeconfig file: gitops clusters add <name> [configFile]")
+							}
+							kubeconfig := c.Args().Get(1)
 							if c.Args().Len() == 1 {
 								println("Please enter location of kubeconfig file for new ", color.InBlue(c.Args().Get(0)), " cluster: ")
 								kubeconfig = util.StringPrompt("kubeconfig file: ")
-							} else if c.Args().Len() == 2 {
-								kubeconfig = c.Args().Get(1)
-							} else {
-								log.Fatal("Usage: gitops clusters add <name> <configFile>")
 							}
-							err := state.GetState().AddCluster(&state.ClusterState{
-								Name:       c.Args().Get(0),
-								ConfigFile: kubeconfig,
+							unlock, err := initLockedApplication(c)
+							defer unlock()
+							if err != nil {
+								return err
+							}
+							err = state.GetState().AddCluster(&state.ClusterState{
+								Name:        c.Args().Get(0),
+								ConfigFile:  kubeconfig,
+								Environment: c.String("env"),
 							})
 							if err != nil {
 								return err
@@ -200,11 +505,15 @@ func main() {
 						Name:  "remove",
 						Usage: "Remove a target cluster",
 						Action: func(c *cli.Context) error {
-							initApplication(c)
 							if c.Args().Len() != 1 {
-								log.Fatal("Usage: gitops clusters remove <name>")
+								return errors.New("expected a name: gitops clusters remove <name>")
+							}
+							unlock, err := initLockedApplication(c)
+							defer unlock()
+							if err != nil {
+								return err
 							}
-							err := state.GetState().RemoveCluster(c.Args().Get(0))
+							err = state.GetState().RemoveCluster(c.Args().Get(0))
 							if err != nil {
 								return err
 							}
@@ -284,6 +593,12 @@ func main() {
 						Usage:   "Username of the actor to be used for the commit",
 						EnvVars: []string{"GITOPS_ACTOR"},
 					},
+					&cli.StringFlag{
+						Name:    "git-backend",
+						Value:   "cli",
+						Usage:   "git implementation used for the patch: cli (git binary) or go-git (pure Go, in-memory authentication)",
+						EnvVars: []string{"GITOPS_GIT_BACKEND"},
+					},
 				},
 				Action: func(c *cli.Context) error {
 					initApplication(c)
@@ -299,11 +614,65 @@ func main() {
 	}
 }
 
+func historyFilterFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "secret",
+			Usage: "only applies of the given secret file, state key or namespace/name",
+		},
+		&cli.StringFlag{
+			Name:  "cluster",
+			Usage: "only applies to the given cluster",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "only applies at or after the given date (YYYY-MM-DD or RFC3339)",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "only applies before the given date (YYYY-MM-DD or RFC3339)",
+		},
+	}
+}
+
 func initApplication(c *cli.Context) error {
-	util.PrintLogo(c)
+	initContext(c)
+	err := state.LoadState(c)
+	if err != nil {
+		log.Fatal("Failed to load state: ", err)
+	}
+	return nil
+}
+
+/*
+Initializes the application like initApplication, but takes the state lock before loading the state
+The returned function releases the lock and must be called once the command is done
+*/
+func initLockedApplication(c *cli.Context) (func(), error) {
+	initContext(c)
+	lock, err := state.AcquireLock(c.Command.FullName())
+	if err != nil {
+		return func() {}, err
+	}
+	unlock := func() {
+		err := lock.Release()
+		if err != nil {
+			log.Error("Failed to release state lock: ", err)
+		}
+	}
+	err = state.LoadState(c)
+	return unlock, err
+}
+
+func initContext(c *cli.Context) {
 	util.SetLogLevel(c)
 	util.SetCliContext(c)
 	util.GetRootDir()
-	err := state.LoadState(c)
-	return err
+	err := util.ApplyRepoConfigDefaults(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the log level may be set by the repository config
+	util.SetLogLevel(c)
+	util.PrintLogo(c)
 }
@@ -102,10 +102,16 @@ func getGitConnectionOptions() *git.ConnectionOptions {
 		}
 	}
 
+	backend, err := git.ParseBackend(config.Get().String("GITOPS_REPOSITORY_GIT_BACKEND"))
+	if err != nil {
+		log.Panic().Err(err).Msg("error getting git backend")
+	}
+
 	return &git.ConnectionOptions{
 		Branch:           config.Get().String("GITOPS_REPOSITORY_BRANCH"),
 		Repository:       config.Get().String("GITOPS_REPOSITORY"),
 		Authentication:   authentication,
 		IgnoreSshHostKey: config.Get().Bool("GITOPS_REPOSITORY_IGNORE_SSL_HOSTKEY"),
+		Backend:          backend,
 	}
 }
@@ -0,0 +1,366 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"gopkg.in/yaml.v2"
+)
+
+type FindingType string
+
+var FindingTypeMissingSopsMetadata FindingType = "missing-sops-metadata"
+var FindingTypeMacMismatch FindingType = "mac-mismatch"
+var FindingTypeUndecryptable FindingType = "undecryptable"
+var FindingTypePlaintextSecret FindingType = "plaintext-secret"
+var FindingTypeLeakedValue FindingType = "leaked-value"
+
+type Finding struct {
+	// Type of the finding
+	Type FindingType
+	// Path of the concerned file relative to the root dir
+	Path string
+	// Human readable description of the finding
+	Message string
+	// Warnings are reported but do not fail the audit
+	Warning bool
+}
+
+type Report struct {
+	// List of all findings of the audit
+	Findings []Finding
+}
+
+type AuditOptions struct {
+	// directory to limit the audit to
+	DirectoryLimit string
+	// minimum length of a decrypted value to be considered for leak detection
+	MinValueLength int
+}
+
+var errMissingSopsMetadata = errors.New("no sops metadata found")
+var errMacMismatch = errors.New("MAC does not verify")
+
+var encryptedFileRegex = regexp.MustCompile(`\.enc\.(ya?ml|json|env)$`)
+var plaintextSecretFileRegex = regexp.MustCompile(`\.secret\.(ya?ml|json|env)$`)
+
+func AuditCommand(c *cli.Context) error {
+	report, err := Audit(&AuditOptions{
+		DirectoryLimit: c.String("dir"),
+		MinValueLength: c.Int("min-length"),
+	})
+	if err != nil {
+		return err
+	}
+
+	report.Print()
+
+	if report.Failed() {
+		return fmt.Errorf("secret audit failed with %d finding(s)", report.FailureCount())
+	}
+	println(color.InGreen("No secret leaks found."))
+	return nil
+}
+
+func Audit(options *AuditOptions) (*Report, error) {
+	report := &Report{
+		Findings: []Finding{},
+	}
+
+	encryptedFiles, err := util.FindFiles(encryptedFileRegex)
+	if err != nil {
+		return nil, err
+	}
+	encryptedFiles = filterByDirectory(encryptedFiles, options.DirectoryLimit)
+
+	plaintextFiles, err := util.FindFiles(plaintextSecretFileRegex)
+	if err != nil {
+		return nil, err
+	}
+	plaintextFiles = filterByDirectory(plaintextFiles, options.DirectoryLimit)
+
+	for _, plaintextFile := range plaintextFiles {
+		if !isPlaintextSecretFile(plaintextFile) {
+			continue
+		}
+		if util.IsGitIgnored(plaintextFile) {
+			log.Trace("Plaintext secret file is ignored by git: ", plaintextFile)
+			continue
+		}
+		report.add(Finding{
+			Type:    FindingTypePlaintextSecret,
+			Path:    plaintextFile,
+			Message: "plaintext secret file is not covered by .gitignore",
+		})
+	}
+
+	// decrypted leaf values mapped to the file and key they originate from
+	sensitiveValues := map[string]string{}
+
+	for _, encryptedFile := range encryptedFiles {
+		log.Trace("Auditing encrypted file: ", encryptedFile)
+		decrypted, err := decryptAndVerify(path.Join(util.GetRootDir(), encryptedFile))
+		if err != nil {
+			if errors.Is(err, errMissingSopsMetadata) {
+				report.add(Finding{
+					Type:    FindingTypeMissingSopsMetadata,
+					Path:    encryptedFile,
+					Message: "file is named as encrypted but has no valid SOPS metadata",
+				})
+			} else if errors.Is(err, errMacMismatch) {
+				report.add(Finding{
+					Type:    FindingTypeMacMismatch,
+					Path:    encryptedFile,
+					Message: "SOPS MAC does not verify, the file was modified outside of SOPS",
+				})
+			} else {
+				report.add(Finding{
+					Type:    FindingTypeUndecryptable,
+					Path:    encryptedFile,
+					Message: fmt.Sprintf("unable to decrypt file, skipping leak detection: %s", err),
+					Warning: true,
+				})
+			}
+			continue
+		}
+
+		for key, value := range collectSensitiveValues(encryptedFile, decrypted) {
+			if len(value) < options.MinValueLength {
+				continue
+			}
+			sensitiveValues[value] = fmt.Sprintf("%s#%s", encryptedFile, key)
+		}
+	}
+
+	if len(sensitiveValues) > 0 {
+		err = detectLeakedValues(report, sensitiveValues, options.DirectoryLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		return report.Findings[i].Path < report.Findings[j].Path
+	})
+	return report, nil
+}
+
+func detectLeakedValues(report *Report, sensitiveValues map[string]string, directoryLimit string) error {
+	trackedFiles, err := util.GetTrackedFiles()
+	if err != nil {
+		log.Warn("Unable to list tracked files, skipping leak detection: ", err)
+		report.add(Finding{
+			Type:    FindingTypeUndecryptable,
+			Path:    ".",
+			Message: "unable to list tracked files, skipping leak detection",
+			Warning: true,
+		})
+		return nil
+	}
+	trackedFiles = filterByDirectory(trackedFiles, directoryLimit)
+
+	// sort the values to get a stable output
+	values := make([]string, 0, len(sensitiveValues))
+	for value := range sensitiveValues {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, trackedFile := range trackedFiles {
+		if encryptedFileRegex.MatchString(trackedFile) {
+			continue
+		}
+		content, err := os.ReadFile(path.Join(util.GetRootDir(), trackedFile))
+		if err != nil {
+			// tracked files might be deleted in the working tree
+			log.Trace("Unable to read tracked file ", trackedFile, ": ", err)
+			continue
+		}
+		for _, value := range values {
+			if bytes.Contains(content, []byte(value)) {
+				report.add(Finding{
+					Type:    FindingTypeLeakedValue,
+					Path:    trackedFile,
+					Message: fmt.Sprintf("contains the decrypted value of %s in plaintext", sensitiveValues[value]),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Decrypts the given SOPS file and verifies its MAC
+Returns errMissingSopsMetadata or errMacMismatch for the respective integrity problems
+*/
+func decryptAndVerify(filePath string) ([]byte, error) {
+	encryptedData, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	store := common.StoreForFormat(formats.FormatForPath(filePath))
+	tree, err := store.LoadEncryptedFile(encryptedData)
+	if err != nil {
+		if errors.Is(err, sops.MetadataNotFound) {
+			return nil, errMissingSopsMetadata
+		}
+		return nil, err
+	}
+
+	key, err := tree.Metadata.GetDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(key, cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	originalMac, err := cipher.Decrypt(
+		tree.Metadata.MessageAuthenticationCode,
+		key,
+		tree.Metadata.LastModified.Format(time.RFC3339),
+	)
+	if err != nil || originalMac != mac {
+		return nil, errMacMismatch
+	}
+
+	return store.EmitPlainFile(tree.Branches)
+}
+
+/*
+Collects all sensitive leaf values of a decrypted file
+For secret files only the data section is considered, values files are considered entirely
+Template expressions are skipped since they are no actual values
+*/
+func collectSensitiveValues(filePath string, decrypted []byte) map[string]string {
+	values := map[string]string{}
+	format := util.GetSecretFileFormat(filePath)
+
+	if format == util.FileFormatDotenv {
+		data, err := util.ParseDotenv(decrypted)
+		if err != nil {
+			log.Trace("Unable to parse decrypted file ", filePath, " for leak detection: ", err)
+			return values
+		}
+		for key, value := range data {
+			collectLeafValues(value, key, values)
+		}
+		return values
+	}
+
+	// json is parsed as yaml, dotenv and json secret files only hold data
+	isSecretFile := format == util.FileFormatYaml && strings.Contains(filePath, ".gitops.secret.enc.") && !util.IsValuesFile(filePath)
+	decoder := yaml.NewDecoder(bytes.NewReader(decrypted))
+	for document := 0; ; document++ {
+		var content map[interface{}]interface{}
+		err := decoder.Decode(&content)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Trace("Unable to parse decrypted file ", filePath, " for leak detection: ", err)
+			return values
+		}
+
+		prefix := ""
+		if document > 0 {
+			prefix = fmt.Sprintf("[%d]", document)
+		}
+		if isSecretFile {
+			data, ok := content["data"].(map[interface{}]interface{})
+			if ok {
+				collectLeafValues(data, prefix+"data", values)
+			}
+			continue
+		}
+		collectLeafValues(content, prefix, values)
+	}
+	return values
+}
+
+func collectLeafValues(node interface{}, prefix string, values map[string]string) {
+	switch typedNode := node.(type) {
+	case map[interface{}]interface{}:
+		for key, value := range typedNode {
+			childPrefix := fmt.Sprintf("%v", key)
+			if prefix != "" {
+				childPrefix = fmt.Sprintf("%s.%v", prefix, key)
+			}
+			collectLeafValues(value, childPrefix, values)
+		}
+	case []interface{}:
+		for index, value := range typedNode {
+			collectLeafValues(value, fmt.Sprintf("%s[%d]", prefix, index), values)
+		}
+	case string:
+		if strings.Contains(typedNode, "{{") {
+			return
+		}
+		values[prefix] = typedNode
+	}
+}
+
+func isPlaintextSecretFile(filePath string) bool {
+	return plaintextSecretFileRegex.MatchString(filePath) && !encryptedFileRegex.MatchString(filePath)
+}
+
+func filterByDirectory(files []string, directoryLimit string) []string {
+	if directoryLimit == "" {
+		return files
+	}
+	filtered := []string{}
+	for _, file := range files {
+		if strings.HasPrefix(file, directoryLimit) {
+			filtered = append(filtered, file)
+		}
+	}
+	return filtered
+}
+
+func (r *Report) add(finding Finding) {
+	r.Findings = append(r.Findings, finding)
+}
+
+func (r *Report) FailureCount() int {
+	count := 0
+	for _, finding := range r.Findings {
+		if !finding.Warning {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Report) Failed() bool {
+	return r.FailureCount() > 0
+}
+
+func (r *Report) Print() {
+	for _, finding := range r.Findings {
+		if finding.Warning {
+			println(color.InYellow(fmt.Sprintf("[%s] %s: %s", finding.Type, finding.Path, finding.Message)))
+		} else {
+			println(color.InRed(fmt.Sprintf("[%s] %s: %s", finding.Type, finding.Path, finding.Message)))
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mxcd/gitops-cli/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecryptAndVerify(t *testing.T) {
+	rootDir, _ := util.GetGitRepoRoot()
+	decrypted, err := decryptAndVerify(filepath.Join(rootDir, "test_assets", "test.gitops.secret.enc.yml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(decrypted), "my-explicitly-named-secret")
+}
+
+func TestDecryptAndVerifyMissingMetadata(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "plain.gitops.secret.enc.yml")
+	err := os.WriteFile(filePath, []byte("targetType: k8s\ndata:\n  foo: bar\n"), 0644)
+	assert.NoError(t, err)
+
+	_, err = decryptAndVerify(filePath)
+	assert.ErrorIs(t, err, errMissingSopsMetadata)
+}
+
+func TestDecryptAndVerifyMacMismatch(t *testing.T) {
+	rootDir, _ := util.GetGitRepoRoot()
+	content, err := os.ReadFile(filepath.Join(rootDir, "test_assets", "test.gitops.secret.enc.yml"))
+	assert.NoError(t, err)
+
+	tampered := strings.Replace(string(content), `lastmodified: "2023-04-27T13:13:49Z"`, `lastmodified: "2023-04-27T13:13:50Z"`, 1)
+	assert.NotEqual(t, string(content), tampered)
+
+	filePath := path.Join(t.TempDir(), "tampered.gitops.secret.enc.yml")
+	err = os.WriteFile(filePath, []byte(tampered), 0644)
+	assert.NoError(t, err)
+
+	_, err = decryptAndVerify(filePath)
+	assert.ErrorIs(t, err, errMacMismatch)
+}
+
+func TestCollectSensitiveValues(t *testing.T) {
+	secretFile := []byte(`targetType: k8s
+name: my-secret
+data:
+  password: my-very-strong-password
+  templated: '{{ .Values.password }}'
+`)
+	values := collectSensitiveValues("foo/my-secret.gitops.secret.enc.yml", secretFile)
+	assert.Equal(t, map[string]string{"data.password": "my-very-strong-password"}, values)
+
+	valuesFile := []byte(`namespace: gitops-dev
+database:
+  password: my-very-strong-password
+`)
+	values = collectSensitiveValues("foo/values.gitops.secret.enc.yml", valuesFile)
+	assert.Equal(t, map[string]string{
+		"namespace":         "gitops-dev",
+		"database.password": "my-very-strong-password",
+	}, values)
+}
+
+func TestIsPlaintextSecretFile(t *testing.T) {
+	assert.True(t, isPlaintextSecretFile("foo/bar.secret.yaml"))
+	assert.True(t, isPlaintextSecretFile("foo/bar.secret.yml"))
+	assert.True(t, isPlaintextSecretFile("foo/bar.secret.env"))
+	assert.False(t, isPlaintextSecretFile("foo/bar.gitops.secret.enc.yaml"))
+	assert.False(t, isPlaintextSecretFile("foo/bar.yaml"))
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/state"
+	"github.com/mxcd/gitops-cli/internal/util"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	SourceFlag    = "flag"
+	SourceDefault = "default"
+	SourceState   = "state"
+)
+
+// flags whose values are redacted unless --cleartext is set
+var sensitiveFlagRegex = regexp.MustCompile(`(api-key|basicauth|passphrase|password|token|ssh-key)$`)
+
+type ConfigValue struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+/*
+Prints the effective configuration and where each value came from:
+a command line flag, an environment variable, the repository config, the state or the default
+Usage: gitops config show
+*/
+func ShowCommand(c *cli.Context) error {
+	repoConfig, err := util.GetRepoConfig()
+	if err != nil {
+		return err
+	}
+	configFile := repoConfig.File
+	if configFile == "" {
+		configFile = "none"
+	}
+	cleartext := c.Bool("cleartext")
+
+	println(color.InBold("# repository config: " + configFile))
+	println("")
+	println(color.InBold("flags:"))
+	for _, value := range GetFlagValues(c, repoConfig) {
+		renderedValue := value.Value
+		if !cleartext && renderedValue != "" && sensitiveFlagRegex.MatchString(value.Name) {
+			renderedValue = util.ToRedactedString(renderedValue)
+		}
+		println(fmt.Sprintf("  %-34s %-30s", value.Name, renderedValue), color.InGray("# "+value.Source))
+	}
+
+	println("")
+	defaultTarget := util.GetDefaultTarget()
+	defaultTargetSource := SourceDefault
+	if repoConfig.DefaultTarget != "" {
+		defaultTargetSource = repoConfig.File
+	}
+	println(color.InBold("defaultTarget:"), defaultTarget, color.InGray("# "+defaultTargetSource))
+
+	println("")
+	println(color.InBold("clusters:"))
+	clusters := state.GetState().GetClusters()
+	names := make([]string, 0, len(clusters))
+	for name := range clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		println(color.InGray("  none"))
+	}
+	for _, name := range names {
+		cluster := clusters[name]
+		source := repoConfig.File
+		if state.GetState().Clusters[name] != nil {
+			source = SourceState
+		}
+		line := fmt.Sprintf("  %s => %s", color.InBlue(name), cluster.ConfigFile)
+		if cluster.Environment != "" {
+			line += " (environment: " + cluster.Environment + ")"
+		}
+		println(line, color.InGray("# "+source))
+	}
+
+	println("")
+	println(color.InBold("secret discovery:"))
+	include := "all secret files"
+	if len(repoConfig.Secrets.Include) > 0 {
+		include = strings.Join(repoConfig.Secrets.Include, ", ")
+	}
+	exclude := "none"
+	if len(repoConfig.Secrets.Exclude) > 0 {
+		exclude = strings.Join(repoConfig.Secrets.Exclude, ", ")
+	}
+	println("  include:", include)
+	println("  exclude:", exclude)
+	return nil
+}
+
+/*
+Returns the effective values of all flags of the application sorted by name
+Flags take precedence over environment variables, which take precedence over the repository config
+*/
+func GetFlagValues(c *cli.Context, repoConfig *util.RepoConfig) []ConfigValue {
+	flags := util.GetAllFlags(c.App)
+	names := []string{}
+	for name, flag := range flags {
+		// aliases are listed with their flag, help and version are not configurable
+		if flag.Names()[0] == name && name != "help" && name != "version" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	values := []ConfigValue{}
+	for _, name := range names {
+		values = append(values, getFlagValue(c, name, flags[name], repoConfig))
+	}
+	return values
+}
+
+func getFlagValue(c *cli.Context, name string, flag cli.Flag, repoConfig *util.RepoConfig) ConfigValue {
+	value := ConfigValue{Name: name}
+	envName, envValue := lookupEnv(flag)
+	configValue, hasConfigValue := repoConfig.Defaults[name]
+	// flags of the current command hold their effective value
+	current := c.Value(name)
+
+	switch {
+	case util.IsRepoConfigDefault(name):
+		value.Source = repoConfig.File
+	case current != nil && c.IsSet(name) && (envName == "" || differsFromEnv(current, envValue)):
+		value.Source = SourceFlag
+	case envName != "":
+		value.Value = envValue
+		value.Source = "env " + envName
+	case hasConfigValue:
+		value.Value = util.FormatRepoConfigValue(configValue)
+		value.Source = repoConfig.File
+	default:
+		value.Value = defaultValue(flag)
+		value.Source = SourceDefault
+	}
+	if current != nil {
+		value.Value = fmt.Sprintf("%v", current)
+	}
+	return value
+}
+
+/*
+Checks whether the effective value of a flag differs from the value of its environment variable
+IsSet is also true for flags set by their environment variable, so a flag given on the
+command line is told apart by its value. If both values are equal, the source does not matter.
+*/
+func differsFromEnv(current interface{}, envValue string) bool {
+	if b, ok := current.(bool); ok {
+		envBool, err := strconv.ParseBool(envValue)
+		return err != nil || envBool != b
+	}
+	return fmt.Sprintf("%v", current) != envValue
+}
+
+func lookupEnv(flag cli.Flag) (string, string) {
+	docFlag, ok := flag.(cli.DocGenerationFlag)
+	if !ok {
+		return "", ""
+	}
+	for _, envName := range docFlag.GetEnvVars() {
+		if envValue, ok := os.LookupEnv(envName); ok {
+			return envName, envValue
+		}
+	}
+	return "", ""
+}
+
+func defaultValue(flag cli.Flag) string {
+	switch f := flag.(type) {
+	case *cli.StringFlag:
+		return f.Value
+	case *cli.BoolFlag:
+		return fmt.Sprintf("%v", f.Value)
+	case *cli.IntFlag:
+		return fmt.Sprintf("%d", f.Value)
+	}
+	return ""
+}
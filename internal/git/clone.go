@@ -21,6 +21,27 @@ const (
 )
 
 func (c *Connection) Clone() error {
+	err := c.prepareCloneDirectory()
+	if err != nil {
+		return err
+	}
+
+	if c.Options.Backend == BackendGoGit {
+		return c.cloneGoGit()
+	}
+
+	cloneProtocol := c.cloneProtocol()
+	if cloneProtocol == CloneProtocolHttp || cloneProtocol == CloneProtocolHttps {
+		return c.CloneHttps(cloneProtocol)
+	} else if cloneProtocol == CloneProtocolSsh {
+		return c.CloneSsh(cloneProtocol)
+	} else {
+		return fmt.Errorf("unsupported clone protocol: %s", cloneProtocol)
+	}
+
+}
+
+func (c *Connection) prepareCloneDirectory() error {
 	if c.Options.Directory == "" {
 		directoryName, err := os.MkdirTemp(os.TempDir(), "gitops-repo-")
 		if err != nil {
@@ -35,7 +56,10 @@ func (c *Connection) Clone() error {
 			return err
 		}
 	}
+	return nil
+}
 
+func (c *Connection) cloneProtocol() CloneProtocol {
 	repositoryUrl := c.Options.Repository
 	cloneProtocol := CloneProtocolHttps
 
@@ -50,20 +74,13 @@ func (c *Connection) Clone() error {
 	if strings.HasPrefix(repositoryUrl, "https://") {
 		cloneProtocol = CloneProtocolHttps
 	}
-
-	if cloneProtocol == CloneProtocolHttp || cloneProtocol == CloneProtocolHttps {
-		return c.CloneHttps(cloneProtocol)
-	} else if cloneProtocol == CloneProtocolSsh {
-		return c.CloneSsh(cloneProtocol)
-	} else {
-		return fmt.Errorf("unsupported clone protocol: %s", cloneProtocol)
-	}
-
+	return cloneProtocol
 }
 
-func (c *Connection) CloneSsh(cloneProtocol CloneProtocol) error {
-	startTime := time.Now()
-
+/*
+Returns the repository as ssh:// URL including the SSH username
+*/
+func (c *Connection) sshRepositoryUrl() string {
 	repositoryUrl := c.Options.Repository
 	repositoryBaseUrl := strings.TrimPrefix(repositoryUrl, "ssh://")
 	repositoryBaseUrl = strings.TrimSuffix(repositoryBaseUrl, ".git")
@@ -82,10 +99,15 @@ func (c *Connection) CloneSsh(cloneProtocol CloneProtocol) error {
 	}
 
 	if len(repositoryUrlSplit) == 1 {
-		repositoryUrl = fmt.Sprintf("ssh://%s@%s.git", sshUsername, repositoryUrlSplit[0])
-	} else {
-		repositoryUrl = fmt.Sprintf("ssh://%s@%s.git", repositoryUrlSplit[0], repositoryUrlSplit[1])
+		return fmt.Sprintf("ssh://%s@%s.git", sshUsername, repositoryUrlSplit[0])
 	}
+	return fmt.Sprintf("ssh://%s@%s.git", repositoryUrlSplit[0], repositoryUrlSplit[1])
+}
+
+func (c *Connection) CloneSsh(cloneProtocol CloneProtocol) error {
+	startTime := time.Now()
+
+	repositoryUrl := c.sshRepositoryUrl()
 
 	lock.Lock()
 	defer lock.Unlock()
@@ -18,6 +18,10 @@ func (c *Connection) Commit(files []string, message string) (string, error) {
 		return "", fmt.Errorf("directory is not specified")
 	}
 
+	if c.Options.Backend == BackendGoGit {
+		return c.commitGoGit(files, message)
+	}
+
 	msg, err := git.Add(runGitIn(directory), add.PathSpec(files...))
 	if err != nil {
 		log.Error().Err(err).Str("output", msg).Msg("Failed to add files")
@@ -57,6 +61,10 @@ func (c *Connection) HasChanges() (bool, error) {
 		return false, fmt.Errorf("directory is not specified")
 	}
 
+	if c.Options.Backend == BackendGoGit {
+		return c.hasChangesGoGit()
+	}
+
 	git.Raw("update-index", runGitIn(directory), func(g *types.Cmd) {
 		g.AddOptions("--refresh")
 	})
@@ -23,6 +23,27 @@ type ConnectionOptions struct {
 	IgnoreSshHostKey bool
 	SkipSslVerify    bool
 	Signature        *Signature
+	// implementation of the git operations, BackendCli by default
+	Backend Backend
+}
+
+type Backend string
+
+const (
+	// shells out to the git binary, authentication is passed through process-global env vars
+	BackendCli Backend = "cli"
+	// pure Go implementation with in-memory authentication
+	BackendGoGit Backend = "go-git"
+)
+
+func ParseBackend(backend string) (Backend, error) {
+	switch Backend(backend) {
+	case "", BackendCli:
+		return BackendCli, nil
+	case BackendGoGit:
+		return BackendGoGit, nil
+	}
+	return "", fmt.Errorf("unsupported git backend: %s", backend)
 }
 
 type Authentication struct {
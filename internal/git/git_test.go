@@ -2,40 +2,66 @@ package git
 
 import (
 	"log"
+	"net"
 	"os"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/mxcd/gitops-cli/internal/util"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+const testGitServer = "localhost:23231"
+
+// the tests need the soft-serve server of hack/soft-serve
+func requireGitServer(t *testing.T) {
+	connection, err := net.DialTimeout("tcp", testGitServer, time.Second)
+	if err != nil {
+		t.Skipf("git server %s is not reachable: %v", testGitServer, err)
+	}
+	connection.Close()
+}
+
 func getSshKeyData(t *testing.T) []byte {
+	requireGitServer(t)
 	baseDir, err := util.GetGitRepoRoot()
-	assert.NoError(t, err)
-	assert.NotEmpty(t, baseDir)
+	require.NoError(t, err)
+	require.NotEmpty(t, baseDir)
 
 	sshKeyPath := path.Join(baseDir, "hack", "soft-serve", "ssh-key")
-	assert.FileExists(t, sshKeyPath)
+	require.FileExists(t, sshKeyPath)
 
 	sshKey, err := os.ReadFile(sshKeyPath)
-	assert.NoError(t, err)
-	assert.NotEmpty(t, sshKey)
+	require.NoError(t, err)
+	require.NotEmpty(t, sshKey)
 
 	return sshKey
 }
 
+// both implementations have to pass the same tests
+var backends = []Backend{BackendCli, BackendGoGit}
+
 func TestNewGitConnection(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			testNewGitConnection(t, backend)
+		})
+	}
+}
+
+func testNewGitConnection(t *testing.T, backend Backend) {
 
 	sshKey := getSshKeyData(t)
 
 	baseDir, err := util.GetGitRepoRoot()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	authentication, err := GetAuthFromSshKey(sshKey, nil)
-	assert.NoError(t, err)
-	assert.NotNil(t, authentication)
+	require.NoError(t, err)
+	require.NotNil(t, authentication)
 
 	uuid := uuid.New().String()
 
@@ -45,27 +71,30 @@ func TestNewGitConnection(t *testing.T) {
 		Branch:           "main",
 		Authentication:   authentication,
 		IgnoreSshHostKey: true,
+		Backend:          backend,
 	}
 	gitConnection, err := NewGitConnection(options)
-	assert.NoError(t, err)
-	assert.NotNil(t, gitConnection)
+	require.NoError(t, err)
+	require.NotNil(t, gitConnection)
+	t.Cleanup(func() { os.RemoveAll(options.Directory) })
 
+	// a failed clone must stop the test, otherwise commits would end up in the enclosing repository
 	err = gitConnection.Clone()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 }
 
-func cloneTempRepository(t *testing.T) *Connection {
+func cloneTempRepository(t *testing.T, backend Backend) *Connection {
 	sshKey := getSshKeyData(t)
 
 	baseDir, err := util.GetGitRepoRoot()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	uuid := uuid.New().String()
 	directoryName := path.Join(baseDir, "sandbox", "gitops-test-"+uuid)
 
 	authentication, err := GetAuthFromSshKey(sshKey, nil)
-	assert.NoError(t, err)
-	assert.NotNil(t, authentication)
+	require.NoError(t, err)
+	require.NotNil(t, authentication)
 
 	options := &ConnectionOptions{
 		Directory:        directoryName,
@@ -73,24 +102,35 @@ func cloneTempRepository(t *testing.T) *Connection {
 		Branch:           "main",
 		Authentication:   authentication,
 		IgnoreSshHostKey: true,
+		Backend:          backend,
 	}
 	gitConnection, err := NewGitConnection(options)
-	assert.NoError(t, err)
-	assert.NotNil(t, gitConnection)
+	require.NoError(t, err)
+	require.NotNil(t, gitConnection)
+	t.Cleanup(func() { os.RemoveAll(options.Directory) })
 
+	// a failed clone must stop the test, otherwise commits would end up in the enclosing repository
 	err = gitConnection.Clone()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	return gitConnection
 }
 
 func TestGitPullFastForward(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			testGitPullFastForward(t, backend)
+		})
+	}
+}
 
-	tempConnectionA := cloneTempRepository(t)
+func testGitPullFastForward(t *testing.T, backend Backend) {
+
+	tempConnectionA := cloneTempRepository(t, backend)
 	assert.NotNil(t, tempConnectionA)
 	log.Println("tempConnectionA cloned")
 
-	tempConnectionB := cloneTempRepository(t)
+	tempConnectionB := cloneTempRepository(t, backend)
 	assert.NotNil(t, tempConnectionB)
 	log.Println("tempConnectionB cloned")
 
@@ -98,19 +138,19 @@ func TestGitPullFastForward(t *testing.T) {
 	testFileName := "test-file-" + uuid
 	testFilePath := path.Join(tempConnectionA.Options.Directory, testFileName)
 	err := os.WriteFile(testFilePath, []byte("test"), 0644)
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	log.Printf("file written to %s", testFilePath)
 
 	hash, err := tempConnectionA.Commit([]string{testFileName}, "Test commit")
-	assert.NoError(t, err)
-	assert.NotEmpty(t, hash)
+	require.NoError(t, err)
+	require.NotEmpty(t, hash)
 
 	err = tempConnectionA.Push()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	err = tempConnectionB.Pull()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	testFilePath = path.Join(tempConnectionB.Options.Directory, testFileName)
 	_, err = os.Stat(testFilePath)
@@ -121,14 +161,22 @@ func TestGitPullFastForward(t *testing.T) {
 }
 
 func TestGitPullRebase(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			testGitPullRebase(t, backend)
+		})
+	}
+}
+
+func testGitPullRebase(t *testing.T, backend Backend) {
 
 	// Clone repository A
-	tempConnectionA := cloneTempRepository(t)
+	tempConnectionA := cloneTempRepository(t, backend)
 	assert.NotNil(t, tempConnectionA)
 	log.Println("tempConnectionA cloned")
 
 	// Clone repository B
-	tempConnectionB := cloneTempRepository(t)
+	tempConnectionB := cloneTempRepository(t, backend)
 	assert.NotNil(t, tempConnectionB)
 	log.Println("tempConnectionB cloned")
 
@@ -137,29 +185,29 @@ func TestGitPullRebase(t *testing.T) {
 	testFileNameA := "test-file-" + uuidA
 	testFilePathA := path.Join(tempConnectionA.Options.Directory, testFileNameA)
 	err := os.WriteFile(testFilePathA, []byte("test A"), 0644)
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	log.Printf("file written to %s", testFilePathA)
 
 	hashA, err := tempConnectionA.Commit([]string{testFileNameA}, "Test commit A")
-	assert.NoError(t, err)
-	assert.NotEmpty(t, hashA)
+	require.NoError(t, err)
+	require.NotEmpty(t, hashA)
 
 	err = tempConnectionA.Push()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	// Create a new file in repository B, commit and push it
 	uuidB := uuid.New().String()
 	testFileNameB := "test-file-" + uuidB
 	testFilePathB := path.Join(tempConnectionB.Options.Directory, testFileNameB)
 	err = os.WriteFile(testFilePathB, []byte("test B"), 0644)
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	log.Printf("file written to %s", testFilePathB)
 
 	hashB, err := tempConnectionB.Commit([]string{testFileNameB}, "Test commit B")
-	assert.NoError(t, err)
-	assert.NotEmpty(t, hashB)
+	require.NoError(t, err)
+	require.NotEmpty(t, hashB)
 
 	// Push is expected to fail because of changes from repository A in remote
 	err = tempConnectionB.Push()
@@ -167,7 +215,7 @@ func TestGitPullRebase(t *testing.T) {
 
 	// Pull is expected to rebase the changes from repository A
 	err = tempConnectionB.Pull()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	// check if test file A is added to repo B
 	testFilePath := path.Join(tempConnectionB.Options.Directory, testFileNameA)
@@ -179,11 +227,11 @@ func TestGitPullRebase(t *testing.T) {
 
 	// Push is expected to succeed after rebase
 	err = tempConnectionB.Push()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	// Pull is expected to pull the changes from repository B
 	err = tempConnectionA.Pull()
-	assert.NoError(t, err)
+	require.NoError(t, err)
 
 	// check if test file B is added to repo A
 	testFilePath = path.Join(tempConnectionA.Options.Directory, testFileNameB)
@@ -192,4 +240,42 @@ func TestGitPullRebase(t *testing.T) {
 	data, err = os.ReadFile(testFilePath)
 	assert.NoError(t, err)
 	assert.Equal(t, "test B", string(data))
+
+	// Create a shared file in repository A, push it and pull it into repository B
+	sharedFileName := "test-values-" + uuid.New().String() + ".yaml"
+	sharedFilePathA := path.Join(tempConnectionA.Options.Directory, sharedFileName)
+	sharedFilePathB := path.Join(tempConnectionB.Options.Directory, sharedFileName)
+	err = os.WriteFile(sharedFilePathA, []byte("a: 1\nb: 2\nc: 3\nd: 4\ne: 5\n"), 0644)
+	require.NoError(t, err)
+	_, err = tempConnectionA.Commit([]string{sharedFileName}, "Test commit shared file")
+	require.NoError(t, err)
+	require.NoError(t, tempConnectionA.Push())
+	require.NoError(t, tempConnectionB.Pull())
+
+	// Change different lines of the shared file in both repositories
+	err = os.WriteFile(sharedFilePathA, []byte("a: 10\nb: 2\nc: 3\nd: 4\ne: 5\n"), 0644)
+	require.NoError(t, err)
+	_, err = tempConnectionA.Commit([]string{sharedFileName}, "Test commit shared file A")
+	require.NoError(t, err)
+	require.NoError(t, tempConnectionA.Push())
+
+	err = os.WriteFile(sharedFilePathB, []byte("a: 1\nb: 2\nc: 3\nd: 4\ne: 50\n"), 0644)
+	require.NoError(t, err)
+	_, err = tempConnectionB.Commit([]string{sharedFileName}, "Test commit shared file B")
+	require.NoError(t, err)
+
+	// Pull is expected to merge the changes to different lines of the same file
+	err = tempConnectionB.Pull()
+	require.NoError(t, err)
+	data, err = os.ReadFile(sharedFilePathB)
+	assert.NoError(t, err)
+	assert.Equal(t, "a: 10\nb: 2\nc: 3\nd: 4\ne: 50\n", string(data))
+
+	err = tempConnectionB.Push()
+	require.NoError(t, err)
+	err = tempConnectionA.Pull()
+	require.NoError(t, err)
+	data, err = os.ReadFile(sharedFilePathA)
+	assert.NoError(t, err)
+	assert.Equal(t, "a: 10\nb: 2\nc: 3\nd: 4\ne: 50\n", string(data))
 }
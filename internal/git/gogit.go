@@ -0,0 +1,466 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+Returns the authentication of the connection for go-git
+Credentials stay in memory, neither files nor env vars are written
+*/
+func (c *Connection) goGitAuth() (transport.AuthMethod, error) {
+	authentication := c.Options.Authentication
+	if authentication == nil {
+		return nil, nil
+	}
+
+	if c.cloneProtocol() == CloneProtocolSsh {
+		if authentication.SshKey == nil {
+			return nil, nil
+		}
+		signer := authentication.SshKey.Signer
+		if signer == nil {
+			parsed, err := GetAuthFromSshKey(authentication.SshKey.PrivateKey, authentication.SshKey.Passphrase)
+			if err != nil {
+				return nil, err
+			}
+			signer = parsed.SshKey.Signer
+		}
+		endpoint, err := transport.NewEndpoint(c.sshRepositoryUrl())
+		if err != nil {
+			return nil, err
+		}
+		auth := &gitssh.PublicKeys{User: endpoint.User, Signer: *signer}
+		if c.Options.IgnoreSshHostKey {
+			auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		} else {
+			auth.HostKeyCallback, err = gitssh.NewKnownHostsCallback()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return auth, nil
+	}
+
+	if authentication.BasicAuth != nil {
+		return &githttp.BasicAuth{
+			Username: authentication.BasicAuth.Username,
+			Password: authentication.BasicAuth.Password,
+		}, nil
+	}
+	return nil, nil
+}
+
+func (c *Connection) goGitRepositoryUrl() string {
+	switch c.cloneProtocol() {
+	case CloneProtocolSsh:
+		return c.sshRepositoryUrl()
+	case CloneProtocolHttps:
+		if !strings.Contains(c.Options.Repository, "://") {
+			return "https://" + c.Options.Repository
+		}
+	}
+	return c.Options.Repository
+}
+
+func (c *Connection) cloneGoGit() error {
+	startTime := time.Now()
+
+	auth, err := c.goGitAuth()
+	if err != nil {
+		return err
+	}
+
+	repositoryUrl := c.goGitRepositoryUrl()
+	log.Debug().Msgf("Using URL: %s", repositoryUrl)
+
+	options := &gogit.CloneOptions{
+		URL:             repositoryUrl,
+		Auth:            auth,
+		InsecureSkipTLS: c.Options.SkipSslVerify,
+	}
+	if c.Options.Branch != "" {
+		options.ReferenceName = plumbing.NewBranchReferenceName(c.Options.Branch)
+	}
+	_, err = gogit.PlainClone(c.Options.Directory, false, options)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to clone repository")
+		return err
+	}
+
+	log.Debug().Msgf("Cloned repository %s on branch %s in %d ms", c.Options.Repository, c.Options.Branch, time.Since(startTime).Milliseconds())
+	return nil
+}
+
+func (c *Connection) openGoGit() (*gogit.Repository, *gogit.Worktree, error) {
+	repository, err := gogit.PlainOpen(c.Options.Directory)
+	if err != nil {
+		return nil, nil, err
+	}
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return nil, nil, err
+	}
+	return repository, worktree, nil
+}
+
+func (c *Connection) goGitBranch(repository *gogit.Repository) (string, error) {
+	if c.Options.Branch != "" {
+		return c.Options.Branch, nil
+	}
+	head, err := repository.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Name().Short(), nil
+}
+
+/*
+Fetches the branch from origin and rebases the local commits onto it, like git pull --rebase
+Files changed both locally and on the remote are merged line by line, changes to the same lines are a conflict
+*/
+func (c *Connection) pullGoGit() error {
+	startTime := time.Now()
+
+	repository, worktree, err := c.openGoGit()
+	if err != nil {
+		return err
+	}
+	branch, err := c.goGitBranch(repository)
+	if err != nil {
+		return err
+	}
+	auth, err := c.goGitAuth()
+	if err != nil {
+		return err
+	}
+
+	remoteReferenceName := plumbing.NewRemoteReferenceName("origin", branch)
+	err = repository.Fetch(&gogit.FetchOptions{
+		RemoteName:      "origin",
+		RefSpecs:        []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(branch), remoteReferenceName))},
+		Auth:            auth,
+		InsecureSkipTLS: c.Options.SkipSslVerify,
+	})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		log.Error().Err(err).Msg("Failed to pull repository")
+		return err
+	}
+
+	head, err := repository.Head()
+	if err != nil {
+		return err
+	}
+	headCommit, err := repository.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	remoteReference, err := repository.Reference(remoteReferenceName, true)
+	if err != nil {
+		return err
+	}
+	remoteCommit, err := repository.CommitObject(remoteReference.Hash())
+	if err != nil {
+		return err
+	}
+
+	upToDate, err := remoteCommit.IsAncestor(headCommit)
+	if err != nil {
+		return err
+	}
+	if upToDate || remoteCommit.Hash == headCommit.Hash {
+		log.Debug().Msgf("Pulled from origin/%s in %d ms", branch, time.Since(startTime).Milliseconds())
+		return nil
+	}
+
+	status, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+	if hasTrackedChanges(status, false) {
+		return errors.New("cannot pull with rebase: the working tree has uncommitted changes")
+	}
+
+	localCommits, err := localCommitsSince(headCommit, remoteCommit)
+	if err != nil {
+		return err
+	}
+	err = worktree.Reset(&gogit.ResetOptions{Commit: remoteCommit.Hash, Mode: gogit.HardReset})
+	if err != nil {
+		return err
+	}
+	for _, localCommit := range localCommits {
+		err = c.replayCommit(worktree, localCommit)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to rebase commit %s", localCommit.Hash)
+			// restore the branch as it was before the pull
+			resetErr := worktree.Reset(&gogit.ResetOptions{Commit: headCommit.Hash, Mode: gogit.HardReset})
+			if resetErr != nil {
+				log.Error().Err(resetErr).Msg("Failed to restore branch")
+			}
+			return err
+		}
+	}
+
+	log.Debug().Msgf("Pulled from origin/%s in %d ms", branch, time.Since(startTime).Milliseconds())
+	return nil
+}
+
+/*
+Returns the commits of head that are not part of upstream, oldest first
+*/
+func localCommitsSince(head *object.Commit, upstream *object.Commit) ([]*object.Commit, error) {
+	bases, err := head.MergeBase(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) == 0 {
+		return nil, errors.New("cannot pull with rebase: the local and remote branch have no common history")
+	}
+	base := bases[0].Hash
+
+	commits := []*object.Commit{}
+	for commit := head; commit.Hash != base; {
+		if commit.NumParents() != 1 {
+			return nil, fmt.Errorf("cannot pull with rebase: commit %s is a merge or root commit", commit.Hash)
+		}
+		commits = append([]*object.Commit{commit}, commits...)
+		commit, err = commit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return commits, nil
+}
+
+/*
+Applies the changes of the commit to the worktree and commits them with the original author and message
+Files that were changed on the remote as well are merged line by line
+*/
+func (c *Connection) replayCommit(worktree *gogit.Worktree, commit *object.Commit) error {
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return err
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		baseContent := ""
+		if change.From.Name != "" {
+			baseFile, err := parentTree.File(change.From.Name)
+			if err != nil {
+				return err
+			}
+			baseContent, err = baseFile.Contents()
+			if err != nil {
+				return err
+			}
+		}
+		if change.From.Name != "" && change.From.Name != change.To.Name {
+			// the file is removed or renamed, the remote must not have changed it
+			currentContent, exists, err := c.readWorktreeFile(change.From.Name)
+			if err != nil {
+				return err
+			}
+			if exists && currentContent != baseContent {
+				return rebaseConflictError(change.From.Name)
+			}
+			if exists {
+				_, err = worktree.Remove(change.From.Name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if change.To.Name == "" {
+			continue
+		}
+		file, err := tree.File(change.To.Name)
+		if err != nil {
+			return err
+		}
+		content, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		currentContent, exists, err := c.readWorktreeFile(change.To.Name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case change.From.Name == change.To.Name && !exists:
+			// the file was removed on the remote
+			return rebaseConflictError(change.To.Name)
+		case change.From.Name == change.To.Name && currentContent != baseContent:
+			merged, ok := mergeLines(baseContent, currentContent, content)
+			if !ok {
+				return rebaseConflictError(change.To.Name)
+			}
+			content = merged
+		case change.From.Name != change.To.Name && exists && currentContent != content:
+			// the file was added on the remote as well
+			return rebaseConflictError(change.To.Name)
+		}
+		mode, err := file.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+		filePath := filepath.Join(c.Options.Directory, filepath.FromSlash(change.To.Name))
+		err = os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filePath, []byte(content), mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = worktree.Add(change.To.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = worktree.Commit(commit.Message, &gogit.CommitOptions{
+		Author:    &commit.Author,
+		Committer: c.goGitSignature(),
+	})
+	return err
+}
+
+// returns the content of a file of the worktree and whether it exists
+func (c *Connection) readWorktreeFile(name string) (string, bool, error) {
+	content, err := os.ReadFile(filepath.Join(c.Options.Directory, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(content), true, nil
+}
+
+func rebaseConflictError(name string) error {
+	return fmt.Errorf("cannot pull with rebase: %s was changed locally and on the remote", name)
+}
+
+func (c *Connection) goGitSignature() *object.Signature {
+	return &object.Signature{
+		Name:  c.Options.Signature.Name,
+		Email: c.Options.Signature.Email,
+		When:  time.Now(),
+	}
+}
+
+func (c *Connection) commitGoGit(files []string, message string) (string, error) {
+	_, worktree, err := c.openGoGit()
+	if err != nil {
+		return "", err
+	}
+
+	for _, file := range files {
+		_, err = worktree.Add(file)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to add files")
+			return "", err
+		}
+	}
+
+	signature := c.goGitSignature()
+	hash, err := worktree.Commit(message, &gogit.CommitOptions{
+		Author:    signature,
+		Committer: signature,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to commit")
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+func (c *Connection) pushGoGit() error {
+	startTime := time.Now()
+
+	repository, _, err := c.openGoGit()
+	if err != nil {
+		return err
+	}
+	branch, err := c.goGitBranch(repository)
+	if err != nil {
+		return err
+	}
+	auth, err := c.goGitAuth()
+	if err != nil {
+		return err
+	}
+
+	branchReferenceName := plumbing.NewBranchReferenceName(branch)
+	err = repository.Push(&gogit.PushOptions{
+		RemoteName:      "origin",
+		RefSpecs:        []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", branchReferenceName, branchReferenceName))},
+		Auth:            auth,
+		InsecureSkipTLS: c.Options.SkipSslVerify,
+	})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		log.Error().Err(err).Msg("Failed to push to remote")
+		return err
+	}
+
+	log.Debug().Msgf("Pushed to origin %s in %d ms", branch, time.Since(startTime).Milliseconds())
+	return nil
+}
+
+/*
+Reports unstaged changes of tracked files like git diff-files, untracked files are no change
+*/
+func (c *Connection) hasChangesGoGit() (bool, error) {
+	_, worktree, err := c.openGoGit()
+	if err != nil {
+		return false, err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return false, err
+	}
+	return hasTrackedChanges(status, true), nil
+}
+
+func hasTrackedChanges(status gogit.Status, unstagedOnly bool) bool {
+	for _, fileStatus := range status {
+		if fileStatus.Worktree == gogit.Untracked {
+			continue
+		}
+		if fileStatus.Worktree != gogit.Unmodified {
+			return true
+		}
+		if !unstagedOnly && fileStatus.Staging != gogit.Unmodified {
+			return true
+		}
+	}
+	return false
+}
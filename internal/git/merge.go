@@ -0,0 +1,134 @@
+package git
+
+import (
+	"strings"
+
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+/*
+Replacement of the base lines [start, end) by the given lines
+*/
+type lineChange struct {
+	start int
+	end   int
+	lines []string
+}
+
+/*
+Merges the changes of ours and theirs to the common base line by line, like git does when rebasing
+Changes to the same or adjacent lines are a conflict unless both sides changed them in the same way
+Returns false if the changes conflict
+*/
+func mergeLines(base string, ours string, theirs string) (string, bool) {
+	baseLines := splitLines(base)
+	ourChanges := lineChanges(base, ours)
+	theirChanges := lineChanges(base, theirs)
+
+	merged := []string{}
+	position := 0
+	for len(ourChanges) > 0 || len(theirChanges) > 0 {
+		// collect the overlapping changes of both sides into one block of the base
+		start, end := nextChangeRange(ourChanges, theirChanges)
+		ourBlock, theirBlock := []lineChange{}, []lineChange{}
+		for {
+			var ourOverlapping, theirOverlapping []lineChange
+			ourOverlapping, ourChanges = takeOverlapping(ourChanges, start, &end)
+			theirOverlapping, theirChanges = takeOverlapping(theirChanges, start, &end)
+			if len(ourOverlapping) == 0 && len(theirOverlapping) == 0 {
+				break
+			}
+			ourBlock = append(ourBlock, ourOverlapping...)
+			theirBlock = append(theirBlock, theirOverlapping...)
+		}
+
+		merged = append(merged, baseLines[position:start]...)
+		ourLines := applyLineChanges(baseLines, start, end, ourBlock)
+		theirLines := applyLineChanges(baseLines, start, end, theirBlock)
+		switch {
+		case len(theirBlock) == 0:
+			merged = append(merged, ourLines...)
+		case len(ourBlock) == 0:
+			merged = append(merged, theirLines...)
+		case strings.Join(ourLines, "") == strings.Join(theirLines, ""):
+			merged = append(merged, ourLines...)
+		default:
+			return "", false
+		}
+		position = end
+	}
+	merged = append(merged, baseLines[position:]...)
+	return strings.Join(merged, ""), true
+}
+
+func nextChangeRange(ourChanges []lineChange, theirChanges []lineChange) (int, int) {
+	if len(theirChanges) == 0 || (len(ourChanges) > 0 && ourChanges[0].start <= theirChanges[0].start) {
+		return ourChanges[0].start, ourChanges[0].end
+	}
+	return theirChanges[0].start, theirChanges[0].end
+}
+
+// removes the changes touching the block [start, end) from the sorted changes and extends the block by them
+func takeOverlapping(changes []lineChange, start int, end *int) ([]lineChange, []lineChange) {
+	taken := 0
+	for taken < len(changes) && changes[taken].start <= *end && changes[taken].end >= start {
+		if changes[taken].end > *end {
+			*end = changes[taken].end
+		}
+		taken++
+	}
+	return changes[:taken], changes[taken:]
+}
+
+// returns the base lines [start, end) with the given changes applied
+func applyLineChanges(baseLines []string, start int, end int, changes []lineChange) []string {
+	lines := []string{}
+	position := start
+	for _, change := range changes {
+		lines = append(lines, baseLines[position:change.start]...)
+		lines = append(lines, change.lines...)
+		position = change.end
+	}
+	return append(lines, baseLines[position:end]...)
+}
+
+// returns the changes turning base into changed, ordered by their position in base
+func lineChanges(base string, changed string) []lineChange {
+	changes := []lineChange{}
+	position := 0
+	var current *lineChange
+	for _, d := range diff.Do(base, changed) {
+		lines := splitLines(d.Text)
+		if d.Type == diffmatchpatch.DiffEqual {
+			if current != nil {
+				changes = append(changes, *current)
+				current = nil
+			}
+			position += len(lines)
+			continue
+		}
+		if current == nil {
+			current = &lineChange{start: position, end: position}
+		}
+		if d.Type == diffmatchpatch.DiffDelete {
+			position += len(lines)
+			current.end = position
+		} else {
+			current.lines = append(current.lines, lines...)
+		}
+	}
+	if current != nil {
+		changes = append(changes, *current)
+	}
+	return changes
+}
+
+// splits the text into lines, each line keeps its line break
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
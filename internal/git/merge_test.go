@@ -0,0 +1,40 @@
+package git
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeLines(t *testing.T) {
+	base := "a: 1\nb: 2\nc: 3\nd: 4\ne: 5\n"
+
+	// changes to different lines are merged
+	merged, ok := mergeLines(base, "a: 10\nb: 2\nc: 3\nd: 4\ne: 5\n", "a: 1\nb: 2\nc: 3\nd: 4\ne: 50\nf: 6\n")
+	assert.True(t, ok)
+	assert.Equal(t, "a: 10\nb: 2\nc: 3\nd: 4\ne: 50\nf: 6\n", merged)
+
+	// lines added and removed on both sides
+	merged, ok = mergeLines(base, "a: 1\nb: 2\nb2: 2\nc: 3\nd: 4\ne: 5\n", "a: 1\nb: 2\nc: 3\ne: 5\n")
+	assert.True(t, ok)
+	assert.Equal(t, "a: 1\nb: 2\nb2: 2\nc: 3\ne: 5\n", merged)
+
+	// the same change on both sides
+	merged, ok = mergeLines(base, "a: 1\nb: 20\nc: 3\nd: 4\ne: 5\n", "a: 1\nb: 20\nc: 3\nd: 4\ne: 50\n")
+	assert.True(t, ok)
+	assert.Equal(t, "a: 1\nb: 20\nc: 3\nd: 4\ne: 50\n", merged)
+
+	// different changes to the same or adjacent lines conflict
+	_, ok = mergeLines(base, "a: 1\nb: 20\nc: 3\nd: 4\ne: 5\n", "a: 1\nb: 21\nc: 3\nd: 4\ne: 5\n")
+	assert.False(t, ok)
+	_, ok = mergeLines(base, "a: 1\nb: 20\nc: 3\nd: 4\ne: 5\n", "a: 1\nb: 2\nc: 30\nd: 4\ne: 5\n")
+	assert.False(t, ok)
+
+	// unchanged sides
+	merged, ok = mergeLines(base, base, "a: 1\n")
+	assert.True(t, ok)
+	assert.Equal(t, "a: 1\n", merged)
+	merged, ok = mergeLines("", "a: 1\n", "")
+	assert.True(t, ok)
+	assert.Equal(t, "a: 1\n", merged)
+}
@@ -15,6 +15,10 @@ func (c *Connection) Pull() error {
 		return fmt.Errorf("directory is not specified")
 	}
 
+	if c.Options.Backend == BackendGoGit {
+		return c.pullGoGit()
+	}
+
 	startTime := time.Now()
 
 	lock.Lock()
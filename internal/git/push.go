@@ -15,6 +15,10 @@ func (c *Connection) Push() error {
 		return fmt.Errorf("directory is not specified")
 	}
 
+	if c.Options.Backend == BackendGoGit {
+		return c.pushGoGit()
+	}
+
 	startTime := time.Now()
 
 	lock.Lock()
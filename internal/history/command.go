@@ -0,0 +1,224 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/plan"
+	"github.com/mxcd/gitops-cli/internal/util"
+	"github.com/urfave/cli/v2"
+)
+
+/*
+Selects history entries and their items
+*/
+type Filter struct {
+	// path, state key or namespace/name of a secret
+	Secret  string
+	Cluster string
+	// entries at or after Since, zero for no limit
+	Since time.Time
+	// entries before Until, zero for no limit
+	Until time.Time
+}
+
+func (f *Filter) matchesItem(item Item) bool {
+	if f.Cluster != "" && item.Cluster != f.Cluster {
+		return false
+	}
+	if f.Secret != "" && item.Secret != f.Secret && item.Name != f.Secret && !strings.HasPrefix(item.Secret, f.Secret+"#") {
+		return false
+	}
+	return true
+}
+
+/*
+Returns the entries of the given list that match the filter, limited to their matching items
+*/
+func (f *Filter) Apply(entries []*Entry) []*Entry {
+	filtered := []*Entry{}
+	for _, entry := range entries {
+		if !f.Since.IsZero() && entry.Timestamp.Before(f.Since) {
+			continue
+		}
+		if !f.Until.IsZero() && !entry.Timestamp.Before(f.Until) {
+			continue
+		}
+		if f.Secret == "" && f.Cluster == "" {
+			filtered = append(filtered, entry)
+			continue
+		}
+		items := []Item{}
+		for _, item := range entry.Items {
+			if f.matchesItem(item) {
+				items = append(items, item)
+			}
+		}
+		if len(items) > 0 {
+			matched := *entry
+			matched.Items = items
+			filtered = append(filtered, &matched)
+		}
+	}
+	return filtered
+}
+
+func getFilter(c *cli.Context) (*Filter, error) {
+	filter := &Filter{
+		Secret:  c.String("secret"),
+		Cluster: c.String("cluster"),
+	}
+	var err error
+	if since := c.String("since"); since != "" {
+		filter.Since, err = util.ParseDate(since)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+	if until := c.String("until"); until != "" {
+		filter.Until, err = util.ParseDate(until)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --until: %w", err)
+		}
+	}
+	return filter, nil
+}
+
+/*
+Lists the past applies, newest first
+Usage: gitops history [--secret <path>] [--cluster <name>] [--since <date>] [--until <date>]
+*/
+func ListCommand(c *cli.Context) error {
+	filter, err := getFilter(c)
+	if err != nil {
+		return err
+	}
+	backend, err := GetBackend(c)
+	if err != nil {
+		return err
+	}
+	entries, err := Load(backend)
+	if err != nil {
+		return err
+	}
+	entries = filter.Apply(entries)
+	if len(entries) == 0 {
+		println("No applies recorded in", backend.String())
+		return nil
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		printSummary(entries[i])
+	}
+	return nil
+}
+
+func printSummary(entry *Entry) {
+	outcomes := map[string]int{}
+	for _, item := range entry.Items {
+		outcomes[item.Outcome]++
+	}
+	summary := fmt.Sprintf("%d applied", outcomes[plan.OutcomeApplied])
+	if outcomes[plan.OutcomeFailed] > 0 {
+		summary += color.InRed(fmt.Sprintf(", %d failed", outcomes[plan.OutcomeFailed]))
+	}
+	if outcomes[OutcomeNotExecuted] > 0 {
+		summary += color.InYellow(fmt.Sprintf(", %d not executed", outcomes[OutcomeNotExecuted]))
+	}
+	if outcomes[plan.OutcomeRetained] > 0 {
+		summary += fmt.Sprintf(", %d retained", outcomes[plan.OutcomeRetained])
+	}
+	println(fmt.Sprintf("%s  %s  %-20s %-8s %s  %s",
+		color.InBold(entry.ID[:8]),
+		entry.Timestamp.Local().Format("2006-01-02 15:04:05"),
+		entry.Actor,
+		shortCommit(entry.Commit),
+		color.InBlue(strings.Join(entry.Clusters, ",")),
+		summary))
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 8 {
+		return commit[:8]
+	}
+	return commit
+}
+
+/*
+Shows the items and redacted changes of a past apply, the id can be abbreviated
+Usage: gitops history show <id>
+*/
+func ShowCommand(c *cli.Context) error {
+	id := c.Args().First()
+	if id == "" {
+		return errors.New("id is required: gitops history show <id>")
+	}
+	filter, err := getFilter(c)
+	if err != nil {
+		return err
+	}
+	backend, err := GetBackend(c)
+	if err != nil {
+		return err
+	}
+	entries, err := Load(backend)
+	if err != nil {
+		return err
+	}
+
+	matches := []*Entry{}
+	for _, entry := range filter.Apply(entries) {
+		if strings.HasPrefix(entry.ID, id) {
+			matches = append(matches, entry)
+		}
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no apply with id '%s' in %s", id, backend)
+	}
+	if len(matches) > 1 {
+		return fmt.Errorf("id '%s' matches %d applies, use a longer id", id, len(matches))
+	}
+	printEntry(matches[0])
+	return nil
+}
+
+func printEntry(entry *Entry) {
+	println(color.InBold("apply " + entry.ID))
+	println("  timestamp: " + entry.Timestamp.Local().Format(time.RFC3339))
+	println("  actor: " + entry.Actor)
+	println("  commit: " + entry.Commit)
+	println("  command: " + entry.Command)
+	println("  clusters: " + strings.Join(entry.Clusters, ", "))
+	if entry.Error != "" {
+		println("  error: " + color.InRed(entry.Error))
+	}
+	for _, item := range entry.Items {
+		println("---")
+		outcome := item.Outcome
+		switch outcome {
+		case plan.OutcomeApplied:
+			outcome = color.InGreen(outcome)
+		case plan.OutcomeFailed:
+			outcome = color.InRed(outcome)
+		case OutcomeNotExecuted:
+			outcome = color.InYellow(outcome)
+		}
+		println(color.InBlue(item.Cluster), item.Name+":", color.InBold(item.Action), outcome)
+		if item.Secret != "" {
+			println(color.InGray("  " + item.Secret))
+		}
+		if item.Error != "" {
+			println("  error: " + color.InRed(item.Error))
+		}
+		for _, change := range item.Changes {
+			switch {
+			case change.Old == "" && change.New == "":
+				println(fmt.Sprintf("  %s %s", change.Type, change.Key), color.InGray("(redacted)"))
+			default:
+				println(fmt.Sprintf("  %s %s: %s => %s", change.Type, change.Key, change.Old, change.New))
+			}
+		}
+	}
+}
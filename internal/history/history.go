@@ -0,0 +1,247 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mxcd/gitops-cli/internal/plan"
+	"github.com/mxcd/gitops-cli/internal/secret"
+	"github.com/mxcd/gitops-cli/internal/state"
+	"github.com/mxcd/gitops-cli/internal/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+const historyFileName = ".gitops-history.jsonl"
+
+// attempts to append an entry if the history is changed concurrently
+const appendAttempts = 3
+
+/*
+Record of one apply run, stored as one line of JSON in the history
+*/
+type Entry struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	// user that ran the apply
+	Actor string `json:"actor"`
+	// commit the secrets were applied from, HEAD or the revision of a rollback
+	Commit string `json:"commit,omitempty"`
+	// command that was run
+	Command string `json:"command"`
+	// clusters the apply changed
+	Clusters []string `json:"clusters"`
+	Items    []Item   `json:"items"`
+	// error the apply failed with
+	Error string `json:"error,omitempty"`
+}
+
+type Item struct {
+	// state key of the secret, empty for secrets that are only known remotely
+	Secret string `json:"secret,omitempty"`
+	// namespace/name of the secret
+	Name    string `json:"name"`
+	Cluster string `json:"cluster"`
+	// add, change or remove
+	Action string `json:"action"`
+	// outcome of the execution, see plan.Outcome*, not-executed if the apply failed before
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// changes of the secret, values of sensitive entries are not recorded
+	Changes []Change `json:"changes,omitempty"`
+}
+
+type Change struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+const OutcomeNotExecuted = "not-executed"
+
+/*
+Creates the history entry of an executed plan, err is the error the execution failed with
+Unchanged items are not recorded
+*/
+func NewEntry(c *cli.Context, p *plan.Plan, err error) *Entry {
+	entry := &Entry{
+		ID:        uuid.New().String(),
+		Timestamp: time.Now().UTC().Truncate(time.Second),
+		Actor:     util.GetActor(),
+		Commit:    util.GetFileSource().Commit(),
+		Clusters:  []string{},
+		Items:     []Item{},
+	}
+	if c != nil && c.Command != nil {
+		entry.Command = c.Command.FullName()
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	clusters := map[string]bool{}
+	for _, planItem := range p.Items {
+		if planItem.Diff.Equal {
+			continue
+		}
+		item := newItem(planItem)
+		entry.Items = append(entry.Items, item)
+		if item.Outcome == plan.OutcomeApplied {
+			clusters[item.Cluster] = true
+		}
+	}
+	for cluster := range clusters {
+		entry.Clusters = append(entry.Clusters, cluster)
+	}
+	sort.Strings(entry.Clusters)
+	return entry
+}
+
+func newItem(planItem plan.PlanItem) Item {
+	item := Item{
+		Action:  string(planItem.Diff.Type),
+		Outcome: planItem.Outcome,
+		Changes: []Change{},
+	}
+	if item.Outcome == "" {
+		item.Outcome = OutcomeNotExecuted
+	}
+	if planItem.Err != nil {
+		item.Error = planItem.Err.Error()
+	}
+	s := planItem.LocalSecret
+	if s == nil {
+		s = planItem.RemoteSecret
+	}
+	item.Name = s.CombinedName()
+	item.Cluster = s.Target
+	if planItem.LocalSecret != nil {
+		item.Secret = planItem.LocalSecret.StateKey()
+	} else if planItem.StateSecret != nil {
+		item.Secret = planItem.StateSecret.StateKey()
+	}
+
+	for _, diffEntry := range planItem.Diff.Entries {
+		if diffEntry.Type == secret.SecretDiffTypeUnchanged {
+			continue
+		}
+		change := Change{Key: diffEntry.Key, Type: string(diffEntry.Type)}
+		if !diffEntry.Sensitive {
+			change.Old = diffEntry.OldValue
+			change.New = diffEntry.NewValue
+		}
+		item.Changes = append(item.Changes, change)
+	}
+	sort.Slice(item.Changes, func(i, j int) bool {
+		return item.Changes[i].Key < item.Changes[j].Key
+	})
+	return item
+}
+
+/*
+Returns the backend of the history: the backend given by --history
+or a backend next to the state backend
+*/
+func GetBackend(c *cli.Context) (state.StateBackend, error) {
+	if historyUrl := c.String("history"); historyUrl != "" {
+		return state.NewStateBackend(historyUrl)
+	}
+	return backendOf(state.GetBackend())
+}
+
+func backendOf(stateBackend state.StateBackend) (state.StateBackend, error) {
+	switch b := stateBackend.(type) {
+	case nil:
+		return state.NewFileBackend(historyFileName), nil
+	case *state.FileBackend:
+		return state.NewFileBackend(path.Join(path.Dir(b.File), historyFileName)), nil
+	case *state.KubernetesBackend:
+		return &state.KubernetesBackend{Cluster: b.Cluster, Namespace: b.Namespace, Kind: b.Kind, Name: b.Name + "-history"}, nil
+	case *state.S3Backend:
+		return &state.S3Backend{Bucket: b.Bucket, Key: b.Key + ".history.jsonl", Endpoint: b.Endpoint, Region: b.Region, PathStyle: b.PathStyle}, nil
+	}
+	return nil, fmt.Errorf("state backend %s does not support a history, set --history", stateBackend)
+}
+
+/*
+Appends the entry to the history of the given backend
+Entries are never changed or removed once written
+*/
+func Append(backend state.StateBackend, entry *Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < appendAttempts; attempt++ {
+		content, err := backend.Read()
+		if err != nil {
+			return err
+		}
+		if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+			content = append(content, '\n')
+		}
+		content = append(content, line...)
+		content = append(content, '\n')
+
+		err = backend.Write(content)
+		var conflictError *state.StateConflictError
+		if errors.As(err, &conflictError) {
+			log.Debug("History of ", backend, " was changed concurrently, retrying")
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("failed to append to history %s: changed concurrently", backend)
+}
+
+/*
+Reads all entries of the history of the given backend, oldest first
+*/
+func Load(backend state.StateBackend) ([]*Entry, error) {
+	content, err := backend.Read()
+	if err != nil {
+		return nil, err
+	}
+	entries := []*Entry{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		entry := &Entry{}
+		err := json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid history entry in %s line %d: %w", backend, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+/*
+Records the executed plan in the history
+*/
+func Record(c *cli.Context, p *plan.Plan, executeErr error) error {
+	backend, err := GetBackend(c)
+	if err != nil {
+		return err
+	}
+	entry := NewEntry(c, p, executeErr)
+	err = Append(backend, entry)
+	if err != nil {
+		return fmt.Errorf("failed to record apply in history %s: %w", backend, err)
+	}
+	log.Debug("Recorded apply ", entry.ID, " in history ", backend)
+	return nil
+}
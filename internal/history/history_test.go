@@ -0,0 +1,115 @@
+package history
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mxcd/gitops-cli/internal/plan"
+	"github.com/mxcd/gitops-cli/internal/secret"
+	"github.com/mxcd/gitops-cli/internal/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestPlan() *plan.Plan {
+	remote := &secret.Secret{Name: "app", Namespace: "default", Target: "prod", Type: "Opaque", Data: map[string]string{"password": "old"}}
+	local := &secret.Secret{Name: "app", Namespace: "default", Target: "prod", Type: "Opaque", Path: "apps/app.gitops.secret.enc.yaml", Data: map[string]string{"password": "new"}}
+	changed := plan.PlanItem{LocalSecret: local, RemoteSecret: remote, Outcome: plan.OutcomeApplied}
+	changed.ComputeDiff()
+
+	unchanged := plan.PlanItem{LocalSecret: remote, RemoteSecret: remote, Outcome: plan.OutcomeUnchanged}
+	unchanged.ComputeDiff()
+
+	added := &secret.Secret{Name: "db", Namespace: "default", Target: "staging", Type: "Opaque", Path: "apps/db.gitops.secret.enc.yaml", Data: map[string]string{"password": "secret"}}
+	failed := plan.PlanItem{LocalSecret: added, Outcome: plan.OutcomeFailed, Err: errors.New("forbidden")}
+	failed.ComputeDiff()
+
+	removed := &secret.Secret{Name: "legacy", Namespace: "default", Target: "prod", Type: "Opaque", Data: map[string]string{"token": "secret"}}
+	notExecuted := plan.PlanItem{RemoteSecret: removed, StateSecret: &state.SecretState{Path: "apps/legacy.gitops.secret.enc.yaml"}}
+	notExecuted.ComputeDiff()
+
+	return &plan.Plan{Items: []plan.PlanItem{changed, unchanged, failed, notExecuted}}
+}
+
+func TestNewEntry(t *testing.T) {
+	entry := NewEntry(nil, getTestPlan(), errors.New("forbidden"))
+	assert.NotEmpty(t, entry.ID)
+	assert.Equal(t, "forbidden", entry.Error)
+	assert.Equal(t, []string{"prod"}, entry.Clusters)
+
+	assert.Len(t, entry.Items, 3)
+	assert.Equal(t, Item{
+		Secret:  "apps/app.gitops.secret.enc.yaml",
+		Name:    "default/app",
+		Cluster: "prod",
+		Action:  "changed",
+		Outcome: plan.OutcomeApplied,
+		// sensitive values are not recorded
+		Changes: []Change{{Key: "data.password", Type: "changed"}},
+	}, entry.Items[0])
+	assert.Equal(t, plan.OutcomeFailed, entry.Items[1].Outcome)
+	assert.Equal(t, "forbidden", entry.Items[1].Error)
+	assert.Equal(t, "staging", entry.Items[1].Cluster)
+	assert.Equal(t, OutcomeNotExecuted, entry.Items[2].Outcome)
+	assert.Equal(t, "apps/legacy.gitops.secret.enc.yaml", entry.Items[2].Secret)
+	assert.Equal(t, "removed", entry.Items[2].Action)
+}
+
+func TestAppendAndLoad(t *testing.T) {
+	backend := state.NewFileBackend(filepath.Join(t.TempDir(), historyFileName))
+	entries, err := Load(backend)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	first := NewEntry(nil, getTestPlan(), nil)
+	second := NewEntry(nil, getTestPlan(), nil)
+	assert.NoError(t, Append(backend, first))
+	// appending through another backend instance does not conflict
+	assert.NoError(t, Append(state.NewFileBackend(backend.File), second))
+
+	entries, err = Load(backend)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, first.ID, entries[0].ID)
+	assert.Equal(t, second.ID, entries[1].ID)
+	assert.Equal(t, first.Items, entries[0].Items)
+}
+
+func TestFilter(t *testing.T) {
+	entry := NewEntry(nil, getTestPlan(), nil)
+	entry.Timestamp = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	entries := []*Entry{entry}
+
+	assert.Len(t, (&Filter{}).Apply(entries), 1)
+
+	filtered := (&Filter{Secret: "apps/app.gitops.secret.enc.yaml"}).Apply(entries)
+	assert.Len(t, filtered, 1)
+	assert.Len(t, filtered[0].Items, 1)
+	assert.Len(t, entry.Items, 3)
+
+	assert.Len(t, (&Filter{Secret: "default/db"}).Apply(entries), 1)
+	assert.Empty(t, (&Filter{Secret: "apps/unknown.gitops.secret.enc.yaml"}).Apply(entries))
+
+	filtered = (&Filter{Cluster: "prod"}).Apply(entries)
+	assert.Len(t, filtered[0].Items, 2)
+	assert.Empty(t, (&Filter{Cluster: "dev"}).Apply(entries))
+
+	assert.Len(t, (&Filter{Since: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)}).Apply(entries), 1)
+	assert.Empty(t, (&Filter{Since: time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)}).Apply(entries))
+	assert.Empty(t, (&Filter{Until: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)}).Apply(entries))
+}
+
+func TestBackendOf(t *testing.T) {
+	backend, err := backendOf(state.NewFileBackend("states/.gitops-state.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "states/.gitops-history.jsonl", backend.String())
+
+	backend, err = backendOf(&state.KubernetesBackend{Cluster: "prod", Namespace: "gitops", Kind: state.KubernetesBackendConfigMap, Name: "gitops-state"})
+	assert.NoError(t, err)
+	assert.Equal(t, "kubernetes://prod/gitops/configmap/gitops-state-history", backend.String())
+
+	backend, err = backendOf(&state.S3Backend{Bucket: "states", Key: "repo/gitops-state.yaml"})
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://states/repo/gitops-state.yaml.history.jsonl", backend.String())
+}
@@ -3,7 +3,6 @@ package k8s
 import (
 	"fmt"
 	"os"
-	"regexp"
 
 	"github.com/TwiN/go-color"
 	"github.com/mxcd/gitops-cli/internal/state"
@@ -98,27 +97,10 @@ func AddClient(clusterName string, kubeconfigFile string) error {
 		return err
 	}
 
-	secretKubeconfigRegex, err := regexp.Compile(`.*\.kubeconfig\.secret\.enc\.ya?ml$`)
+	kubeconfigFileData, err := util.ReadKubeconfig(kubeconfigFile)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	var kubeconfigFileData []byte = []byte{}
-
-	if secretKubeconfigRegex.MatchString(kubeconfigFile) {
-		log.Trace("KUBECONFIG file is a secret. Decrypting")
-		kubeconfigFileData, err = util.DecryptFile(kubeconfigFile)
-		if err != nil {
-			log.Error("Failed to decrypt KUBECONFIG file: ", err)
-			return err
-		}
-	} else {
-		log.Trace("KUBECONFIG file is not a secret. Reading")
-		kubeconfigFileData, err = os.ReadFile(kubeconfigFile)
-		if err != nil {
-			log.Error("Failed to read KUBECONFIG file: ", err)
-			return err
-		}
+		log.Error("Failed to read KUBECONFIG file: ", err)
+		return err
 	}
 
 	clientConfig, err := clientcmd.NewClientConfigFromBytes(kubeconfigFileData)
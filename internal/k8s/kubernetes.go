@@ -42,6 +42,8 @@ func CreateK8sConfigMap(s *secret.Secret, clusterName string) error {
 	if err != nil {
 		return err
 	}
+	s.ResourceVersion = k8sConfigMap.ResourceVersion
+	s.UID = string(k8sConfigMap.UID)
 	println(s.Namespace, "/", s.Name, color.InGreen(" created"))
 	return err
 }
@@ -70,6 +72,8 @@ func CreateK8sSecret(s *secret.Secret, clusterName string) error {
 	if err != nil {
 		return err
 	}
+	s.ResourceVersion = k8sSecret.ResourceVersion
+	s.UID = string(k8sSecret.UID)
 	println(s.Namespace, "/", s.Name, color.InGreen(" created"))
 	return err
 }
@@ -106,6 +110,8 @@ func UpdateK8sSecret(s *secret.Secret, clusterName string) error {
 	if err != nil {
 		return err
 	}
+	s.ResourceVersion = k8sSecret.ResourceVersion
+	s.UID = string(k8sSecret.UID)
 	println(s.Namespace, "/", s.Name, color.InYellow(" updated"))
 	return err
 }
@@ -133,6 +139,8 @@ func UpdateK8sConfigMap(s *secret.Secret, clusterName string) error {
 	if err != nil {
 		return err
 	}
+	s.ResourceVersion = k8sConfigMap.ResourceVersion
+	s.UID = string(k8sConfigMap.UID)
 	println(s.Namespace, "/", s.Name, color.InYellow(" updated"))
 	return err
 }
@@ -202,6 +210,8 @@ func GetK8sConfigMap(s *secret.Secret, clusterName string) (*secret.Secret, erro
 		Namespace: k8sConfigMap.Namespace,
 		Data: k8sConfigMap.Data,
 		Type: "ConfigMap",
+		ResourceVersion: k8sConfigMap.ResourceVersion,
+		UID: string(k8sConfigMap.UID),
 	}, nil
 }
 
@@ -224,6 +234,8 @@ func GetK8sSecret(s *secret.Secret, clusterName string) (*secret.Secret, error)
 		Namespace: k8sSecret.Namespace,
 		Data: getStringData(k8sSecret),
 		Type: string(k8sSecret.Type),
+		ResourceVersion: k8sSecret.ResourceVersion,
+		UID: string(k8sSecret.UID),
 	}, nil
 }
 
@@ -0,0 +1,78 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/TwiN/go-color"
+	"github.com/google/uuid"
+	"github.com/mxcd/gitops-cli/internal/k8s"
+	"github.com/mxcd/gitops-cli/internal/secret"
+	"github.com/mxcd/gitops-cli/internal/state"
+	"github.com/urfave/cli/v2"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+/*
+Adopts objects that already exist in a cluster into the state, so that they are managed by the given secret file
+The objects are not changed, differences to the secret file are applied by the next apply
+Usage: gitops state import <path> --from-cluster
+*/
+func ImportCommand(c *cli.Context) error {
+	path := filepath.ToSlash(filepath.Clean(c.Args().First()))
+	if c.Args().First() == "" {
+		return errors.New("path is required: gitops state import <path> --from-cluster")
+	}
+	if !c.Bool("from-cluster") {
+		return errors.New("only importing existing cluster objects is supported, use --from-cluster")
+	}
+
+	secrets, err := secret.LoadFromPath(path)
+	if err != nil {
+		return err
+	}
+	importSecrets := []*secret.Secret{}
+	for _, localSecret := range secrets {
+		if localSecret.TargetType != secret.SecretTargetTypeKubernetes {
+			continue
+		}
+		if state.GetState().GetByKey(localSecret.StateKey()) != nil {
+			return fmt.Errorf("secret '%s' is already managed by the state", localSecret.StateKey())
+		}
+		importSecrets = append(importSecrets, localSecret)
+	}
+	if len(importSecrets) == 0 {
+		return fmt.Errorf("secret file '%s' contains no secrets with target type %s", path, secret.SecretTargetTypeKubernetes)
+	}
+
+	err = k8s.InitClusterClients(c)
+	if err != nil {
+		return err
+	}
+
+	// check all objects before changing the state
+	remoteSecrets := []*secret.Secret{}
+	for _, localSecret := range importSecrets {
+		remoteSecret, err := k8s.GetSecret(localSecret, localSecret.Target)
+		if k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("%s %s does not exist in cluster %s, use apply to create it", localSecret.Type, localSecret.CombinedName(), localSecret.Target)
+		}
+		if err != nil {
+			return err
+		}
+		remoteSecrets = append(remoteSecrets, remoteSecret)
+	}
+
+	for i, localSecret := range importSecrets {
+		localSecret.ID = uuid.New().String()
+		state.GetState().Add(localSecret)
+		println(color.InGreen("Imported"), color.InBlue(localSecret.Target), localSecret.CombinedName(), color.InGreen("=>"), localSecret.StateKey())
+
+		localSecret.AdoptRemoteGeneratedData(remoteSecrets[i])
+		if !secret.CompareSecrets(remoteSecrets[i], localSecret).Equal {
+			println(color.InYellow("  the cluster object differs from the secret file, the next apply will update it"))
+		}
+	}
+	return state.GetState().Save(c)
+}
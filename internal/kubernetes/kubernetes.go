@@ -3,10 +3,12 @@ package kubernetes
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/TwiN/go-color"
 	"github.com/google/uuid"
 	"github.com/mxcd/gitops-cli/internal/finalizer"
+	"github.com/mxcd/gitops-cli/internal/history"
 	"github.com/mxcd/gitops-cli/internal/k8s"
 	"github.com/mxcd/gitops-cli/internal/plan"
 	"github.com/mxcd/gitops-cli/internal/secret"
@@ -26,12 +28,21 @@ func ApplyKubernetes(c *cli.Context) error {
 
 	// exit if there is nothing to do
 	if p.NothingToDo() {
+		p.PrintRetained()
 		println(color.InGreen("No changes to apply."))
-		finalizer.ExitApplication(c, true)
-		return nil
+		// nothing is executed, but the state is synced with the unchanged and retained secrets
+		p.CommitState()
+		return finalizer.ExitApplication(c, true)
 	}
 
 	prettyPrintPlan(p, c.Bool("show-unchanged"))
+	printExpiryWarnings(p)
+
+	// refuse before prompting, the limit is enforced again when executing the plan
+	err = p.CheckDeleteLimit()
+	if err != nil {
+		return err
+	}
 
 	if !c.Bool("auto-approve") {
 		println("GitOps CLI will apply these changes to your Kubernetes cluster.")
@@ -48,7 +59,16 @@ func ApplyKubernetes(c *cli.Context) error {
 	println("-------------------------------------------------------")
 	println("")
 	err = p.Execute()
+	historyErr := history.Record(c, p, err)
 	if err != nil {
+		if historyErr != nil {
+			log.Error(historyErr)
+		}
+		// keep the state of the items that were executed before the failure
+		saveErr := finalizer.ExitApplication(c, true)
+		if saveErr != nil {
+			log.Error("Failed to save state: ", saveErr)
+		}
 		return err
 	}
 	println("")
@@ -56,28 +76,56 @@ func ApplyKubernetes(c *cli.Context) error {
 	println("")
 	println(color.InGreen("All changes applied."))
 
-	finalizer.ExitApplication(c, true)
-	return nil
+	err = finalizer.ExitApplication(c, true)
+	if err != nil {
+		return err
+	}
+	return historyErr
 }
 
 func PlanKubernetes(c *cli.Context) error {
 	clusterLimitString := getClusterLimit(c)
 
+	ref := c.String("ref")
+	if ref != "" {
+		// secret files are read from the git object store, the working tree is not used
+		source, err := util.NewGitRevisionSource(ref)
+		if err != nil {
+			return err
+		}
+		util.SetFileSource(source)
+		defer util.SetFileSource(&util.WorkTreeSource{})
+		println("Planning from revision " + color.InBold(ref) + color.InGray(" ("+source.Commit()+")"))
+	}
+
 	p, err := createKubernetesPlan(c)
 	if err != nil {
 		return err
 	}
 
 	if p.NothingToDo() {
+		p.PrintRetained()
 		println(color.InGreen("No changes to apply."))
 	} else {
 		prettyPrintPlan(p, c.Bool("show-unchanged"))
+		printExpiryWarnings(p)
+		if p.CheckDeleteLimit() != nil {
+			println(color.InYellow(fmt.Sprintf("Warning: this plan deletes %d secrets, apply will refuse to delete more than %d without --force", p.Deletes(), p.MaxDeletes)))
+		}
 		dirLimitString := ""
 		if c.String("dir") != "" {
 			dirLimitString = " --dir " + c.String("dir")
 		}
-		applyString := fmt.Sprintf("gitops secrets%s apply kubernetes %s", dirLimitString, clusterLimitString)
-		println(color.InBold("use"), color.InGreen(color.InBold(applyString)), color.InBold("to apply these changes to your cluster"))
+		pruneString := ""
+		if c.Bool("prune") {
+			pruneString = "--prune "
+		}
+		applyString := fmt.Sprintf("gitops secrets%s apply kubernetes %s%s", dirLimitString, pruneString, clusterLimitString)
+		if ref != "" {
+			println(color.InBold("check out"), color.InGreen(color.InBold(ref)), color.InBold("and use"), color.InGreen(color.InBold(applyString)), color.InBold("to apply these changes to your cluster"))
+		} else {
+			println(color.InBold("use"), color.InGreen(color.InBold(applyString)), color.InBold("to apply these changes to your cluster"))
+		}
 	}
 	finalizer.ExitApplication(c, false)
 	return nil
@@ -109,6 +157,7 @@ func createKubernetesPlan(c *cli.Context) (*plan.Plan, error) {
 		log.Error("Failed to init Kubernetes cluster connection")
 		return nil, err
 	}
+	secret.SetRemoteSecretLookup(getRemoteSecret)
 
 	localSecrets, err := secret.LoadLocalSecretsLimited(secret.SecretTargetTypeKubernetes, dirLimit, clusterLimit)
 	if err != nil {
@@ -117,10 +166,18 @@ func createKubernetesPlan(c *cli.Context) (*plan.Plan, error) {
 	}
 	log.Trace("Loaded ", len(localSecrets), " local secrets with target ", secret.SecretTargetTypeKubernetes)
 
+	err = secret.CheckMissingValues(localSecrets)
+	if err != nil {
+		return nil, err
+	}
+
 	p := &plan.Plan{
 		TargetType: secret.SecretTargetTypeKubernetes,
 		Items:      []plan.PlanItem{},
+		MaxDeletes: c.Int("max-deletes"),
+		Force:      c.Bool("force"),
 	}
+	prune := c.Bool("prune")
 
 	bar := progressbar.NewOptions(len(localSecrets),
 		progressbar.OptionEnableColorCodes(true),
@@ -134,54 +191,38 @@ func createKubernetesPlan(c *cli.Context) (*plan.Plan, error) {
 
 	for _, localSecret := range localSecrets {
 		bar.Add(1)
-		// check for local secret in state
-		// update ID in localSecret if secret exists in state
-		// update hash in state if secret exists in state
-		stateSecret := state.GetState().GetByPath(localSecret.Path)
-		if stateSecret == nil {
-			log.Trace("Secret ", localSecret.CombinedName(), " does not exist in state")
-			localSecret.ID = uuid.New().String()
-			stateSecret = state.GetState().Add(localSecret)
-		} else {
-			log.Trace("Secret ", localSecret.CombinedName(), " exists in state. Updating")
-			stateSecret.Update(localSecret)
-		}
-
-		planItem := plan.PlanItem{
-			LocalSecret: localSecret,
-		}
-
-		remoteSecret, err := k8s.GetSecret(localSecret, localSecret.Target)
+		planItem, err := newLocalPlanItem(localSecret)
 		if err != nil {
-			if k8sErrors.IsNotFound(err) {
-				log.Trace("Secret ", localSecret.Name, " does not exist in Kubernetes cluster")
-			} else {
-				log.Error("Failed to get secret ", localSecret.Name, " from Kubernetes cluster")
-				return nil, err
-			}
+			return nil, err
 		}
-
-		planItem.RemoteSecret = remoteSecret
-		planItem.ComputeDiff()
 		p.AddItem(planItem)
 	}
 	bar.Finish()
 	println("")
 	println("")
 
-	updatedStateSecrets := state.GetState().Secrets[:0]
 	for _, stateSecret := range state.GetState().Secrets {
 		stateSecretFound := false
+		stateSecretMoved := false
 		for _, localSecret := range localSecrets {
-			if stateSecret.Path == localSecret.Path {
+			if stateSecret.StateKey() == localSecret.StateKey() {
 				stateSecretFound = true
 				break
 			}
+			if stateSecret.Target == localSecret.Target && stateSecret.CombinedName() == localSecret.CombinedName() {
+				stateSecretMoved = true
+			}
 		}
 
-		// only add secret to updated state, if it still exists locally or if it is not in the scope of the current dir or cluster limits
+		// the secret is still defined locally, but in another file or document
+		if !stateSecretFound && stateSecretMoved {
+			log.Trace("Secret ", stateSecret.CombinedName(), " moved from ", stateSecret.StateKey())
+			p.StaleStateSecrets = append(p.StaleStateSecrets, stateSecret)
+			continue
+		}
+
+		// keep the secret in the state, if it still exists locally or if it is not in the scope of the current dir or cluster limits
 		if stateSecretFound || !strings.HasPrefix(stateSecret.Path, dirLimit) || (stateSecret.Target != clusterLimit && clusterLimit != "") {
-			updatedStateSecrets = append(updatedStateSecrets, stateSecret)
 			continue
 		}
 
@@ -205,25 +246,113 @@ func createKubernetesPlan(c *cli.Context) (*plan.Plan, error) {
 		// now we are checking if the cluster secret actually exists
 		if remoteSecret == nil {
 			log.Trace("State secret ", stateSecret.CombinedName(), " does not exist in Kubernetes cluster")
-			// do not add secret to updated state secrets
+			p.StaleStateSecrets = append(p.StaleStateSecrets, stateSecret)
 			continue
 		}
 
 		// at this state, the local secret does not exist anymore, but the secret is still in the state
-		// also, the cluster still holds the secret which needs to be deleted
+		// also, the cluster still holds the secret which is deleted depending on its deletion policy
 		planItem := plan.PlanItem{
-			LocalSecret:  nil,
-			RemoteSecret: remoteSecret,
+			LocalSecret:     nil,
+			RemoteSecret:    remoteSecret,
+			StateSecret:     stateSecret,
+			RemoveFromState: true,
 		}
 		planItem.ComputeDiff()
+		switch {
+		case stateSecret.DeletionPolicy == secret.DeletionPolicyRetain:
+			// the remote secret is kept, but no longer managed
+			log.Trace("State secret ", stateSecret.CombinedName(), " is retained by its deletion policy")
+			planItem.Retained = true
+			planItem.RetainReason = "deletionPolicy Retain, removed from state"
+		case stateSecret.DeletionPolicy == secret.DeletionPolicyDelete || prune:
+			log.Trace("State secret ", stateSecret.CombinedName(), " will be deleted")
+		default:
+			// keep the secret in the state, so that it can be pruned later on
+			log.Trace("State secret ", stateSecret.CombinedName(), " is protected from deletion without --prune")
+			planItem.Retained = true
+			planItem.RetainReason = "secret file removed, use --prune to delete"
+			planItem.RemoveFromState = false
+		}
 		p.AddItem(planItem)
 	}
 
-	// update state secrets
-	state.GetState().SetSecrets(updatedStateSecrets)
 	return p, nil
 }
 
+/*
+Creates the plan item of a local secret against its remote secret
+The state is only changed once the plan item is executed
+*/
+func newLocalPlanItem(localSecret *secret.Secret) (plan.PlanItem, error) {
+	stateSecret := state.GetState().GetByKey(localSecret.StateKey())
+	var movedStateSecret *state.SecretState
+	if stateSecret == nil {
+		movedStateSecret = state.GetState().GetMoved(localSecret)
+	}
+	switch {
+	case stateSecret != nil:
+		log.Trace("Secret ", localSecret.CombinedName(), " exists in state")
+		localSecret.ID = stateSecret.ID
+	case movedStateSecret != nil:
+		// the stale state entry is replaced by the new one, which keeps the ID and last apply
+		log.Trace("Secret ", localSecret.CombinedName(), " moved in state from ", movedStateSecret.StateKey())
+		localSecret.ID = movedStateSecret.ID
+	default:
+		log.Trace("Secret ", localSecret.CombinedName(), " does not exist in state")
+		localSecret.ID = uuid.New().String()
+	}
+
+	planItem := plan.PlanItem{
+		LocalSecret:      localSecret,
+		StateSecret:      stateSecret,
+		MovedStateSecret: movedStateSecret,
+	}
+
+	remoteSecret, err := k8s.GetSecret(localSecret, localSecret.Target)
+	if err != nil {
+		if k8sErrors.IsNotFound(err) {
+			log.Trace("Secret ", localSecret.Name, " does not exist in Kubernetes cluster")
+		} else {
+			log.Error("Failed to get secret ", localSecret.Name, " from Kubernetes cluster")
+			return planItem, err
+		}
+	}
+
+	planItem.RemoteSecret = remoteSecret
+	if stateSecret != nil {
+		planItem.Drift = stateSecret.Drift(remoteSecret)
+	} else if movedStateSecret != nil {
+		planItem.Drift = movedStateSecret.Drift(remoteSecret)
+	}
+	localSecret.AdoptRemoteGeneratedData(remoteSecret)
+	planItem.ComputeDiff()
+	return planItem, nil
+}
+
+/*
+Returns the remote secret of a local Kubernetes secret, nil if it does not exist
+Secrets of other target types and of clusters without a client have no remote secret
+*/
+func getRemoteSecret(localSecret *secret.Secret) (*secret.Secret, error) {
+	if localSecret.TargetType != secret.SecretTargetTypeKubernetes {
+		return nil, nil
+	}
+	if _, err := k8s.GetClient(localSecret.Target); err != nil {
+		log.Debug("No client for cluster ", localSecret.Target, " of secret ", localSecret.CombinedName())
+		return nil, nil
+	}
+	remoteSecret, err := k8s.GetSecret(localSecret, localSecret.Target)
+	if err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return nil, nil
+		}
+		log.Error("Failed to get secret ", localSecret.Name, " from Kubernetes cluster")
+		return nil, err
+	}
+	return remoteSecret, nil
+}
+
 func getClusterLimit(c *cli.Context) string {
 	clusterLimit := c.Args().Get(0)
 	if clusterLimit != "" {
@@ -254,3 +383,20 @@ func prettyPrintPlan(p *plan.Plan, showUnchanged bool) {
 	println("-------------------------------------------------------")
 	println("")
 }
+
+/*
+Warns about secrets of the plan that are going to be applied with already expired material
+*/
+func printExpiryWarnings(p *plan.Plan) {
+	now := time.Now()
+	for _, item := range p.Items {
+		if item.LocalSecret == nil || item.Retained || item.Diff.Equal {
+			continue
+		}
+		for _, expiry := range item.LocalSecret.GetMaterialExpiries() {
+			if expiry.Expired(now) {
+				println(color.InYellow(fmt.Sprintf("Warning: secret %s (%s) is applied with expired material: %s %s", item.LocalSecret.CombinedName(), item.LocalSecret.Path, expiry.Reason, expiry.Date.Format("2006-01-02"))))
+			}
+		}
+	}
+}
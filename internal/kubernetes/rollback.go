@@ -0,0 +1,134 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/finalizer"
+	"github.com/mxcd/gitops-cli/internal/history"
+	"github.com/mxcd/gitops-cli/internal/k8s"
+	"github.com/mxcd/gitops-cli/internal/plan"
+	"github.com/mxcd/gitops-cli/internal/secret"
+	"github.com/mxcd/gitops-cli/internal/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+/*
+Applies the content a secret file had at an earlier git revision
+The file and its values files are read from the revision, the working tree is not changed
+Usage: gitops secrets rollback <path> --to <git-rev>
+*/
+func RollbackCommand(c *cli.Context) error {
+	if c.Args().First() == "" {
+		return errors.New("path is required: gitops secrets rollback <path> --to <git-rev>")
+	}
+	path := filepath.ToSlash(filepath.Clean(c.Args().First()))
+
+	source, err := util.NewGitRevisionSource(c.String("to"))
+	if err != nil {
+		return err
+	}
+	if !source.Exists(path) {
+		return fmt.Errorf("secret file '%s' does not exist at revision %s", path, source.Revision)
+	}
+	util.SetFileSource(source)
+	defer util.SetFileSource(&util.WorkTreeSource{})
+
+	println("Rolling back " + color.InPurple(path) + " to revision " + color.InBold(source.Revision) + color.InGray(" ("+source.Commit()+")"))
+	println("")
+
+	p, err := createRollbackPlan(c, path)
+	if err != nil {
+		return err
+	}
+
+	if p.NothingToDo() {
+		println(color.InGreen("The cluster already matches revision " + source.Revision + "."))
+		return nil
+	}
+
+	prettyPrintPlan(p, c.Bool("show-unchanged"))
+	printExpiryWarnings(p)
+
+	if !c.Bool("auto-approve") {
+		println("GitOps CLI will apply these changes to your Kubernetes cluster.")
+		println("Only 'yes' will be accepted to approve.")
+		promtAnswer := util.StringPrompt("Roll back to the changes above: ")
+
+		if promtAnswer != "yes" {
+			println("Aborting")
+			return nil
+		}
+	}
+
+	err = p.Execute()
+	historyErr := history.Record(c, p, err)
+	if err != nil {
+		if historyErr != nil {
+			log.Error(historyErr)
+		}
+		saveErr := finalizer.ExitApplication(c, true)
+		if saveErr != nil {
+			log.Error("Failed to save state: ", saveErr)
+		}
+		return err
+	}
+	println("")
+	println(color.InGreen("Rolled back " + path + " to revision " + source.Revision + "."))
+	println(color.InYellow("The secret file in the working tree was not changed, fix it before the next apply or it is applied again."))
+
+	err = finalizer.ExitApplication(c, true)
+	if err != nil {
+		return err
+	}
+	return historyErr
+}
+
+/*
+Creates the plan of the Kubernetes secrets of a single secret file read from the current file source
+Secrets removed from the file since are not part of the plan
+*/
+func createRollbackPlan(c *cli.Context, path string) (*plan.Plan, error) {
+	err := k8s.InitClusterClients(c)
+	if err != nil {
+		log.Error("Failed to init Kubernetes cluster connection")
+		return nil, err
+	}
+	secret.SetRemoteSecretLookup(getRemoteSecret)
+
+	loadedSecrets, err := secret.LoadLocalSecretsLimited(secret.SecretTargetTypeKubernetes, path, "")
+	if err != nil {
+		return nil, err
+	}
+	localSecrets := []*secret.Secret{}
+	for _, localSecret := range loadedSecrets {
+		if localSecret.Path == path {
+			localSecrets = append(localSecrets, localSecret)
+		}
+	}
+	if len(localSecrets) == 0 {
+		return nil, fmt.Errorf("secret file '%s' contains no secrets with target type %s at %s", path, secret.SecretTargetTypeKubernetes, util.GetFileSource())
+	}
+
+	err = secret.CheckMissingValues(localSecrets)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plan.Plan{
+		TargetType: secret.SecretTargetTypeKubernetes,
+		Items:      []plan.PlanItem{},
+		MaxDeletes: -1,
+	}
+	for _, localSecret := range localSecrets {
+		planItem, err := newLocalPlanItem(localSecret)
+		if err != nil {
+			return nil, err
+		}
+		p.AddItem(planItem)
+	}
+	return p, nil
+}
@@ -58,10 +58,16 @@ func GetGitConnectionOptionsFromCli(c *cli.Context) (*git.ConnectionOptions, err
 		authentication = auth
 	}
 
+	backend, err := git.ParseBackend(c.String("git-backend"))
+	if err != nil {
+		return nil, err
+	}
+
 	options := &git.ConnectionOptions{
 		Repository:     c.String("repository"),
 		Branch:         c.String("branch"),
 		Authentication: authentication,
+		Backend:        backend,
 	}
 
 	return options, nil
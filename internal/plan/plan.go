@@ -1,10 +1,15 @@
 package plan
 
 import (
+	"fmt"
+
+	"github.com/TwiN/go-color"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mxcd/gitops-cli/internal/k8s"
 	"github.com/mxcd/gitops-cli/internal/secret"
+	"github.com/mxcd/gitops-cli/internal/state"
+	"github.com/mxcd/gitops-cli/internal/util"
 )
 
 type Plan struct {
@@ -12,8 +17,22 @@ type Plan struct {
 	Items []PlanItem
 	// Target type of the plan
 	TargetType secret.SecretTargetType
+	// Maximum number of secrets the plan may delete, a negative value disables the limit
+	MaxDeletes int
+	// Force deletions beyond MaxDeletes
+	Force bool
+	// State secrets without an item that are removed from the state once the plan is executed,
+	// e.g. secrets moved to another file or whose remote secret no longer exists
+	StaleStateSecrets []*state.SecretState
 }
 
+const (
+	OutcomeApplied   = "applied"
+	OutcomeFailed    = "failed"
+	OutcomeUnchanged = "unchanged"
+	OutcomeRetained  = "retained"
+)
+
 type PlanItem struct {
 	// Pointer to the local secret of this plan item
 	LocalSecret *secret.Secret
@@ -21,6 +40,22 @@ type PlanItem struct {
 	RemoteSecret *secret.Secret
 	// Pointer to the diff between the local and remote secret
 	Diff *secret.SecretDiff
+	// Retained items are removed locally, but the remote secret is protected from deletion
+	Retained bool
+	// Reason why the remote secret of a retained item is not deleted
+	RetainReason string
+	// State of the secret, nil for local secrets that are not in the state yet
+	StateSecret *state.SecretState
+	// Previous state of a local secret whose state key changed, its ID and last apply are carried over to the new state entry
+	MovedStateSecret *state.SecretState
+	// The state secret of an item without local secret is removed from the state once the item is executed
+	RemoveFromState bool
+	// Out-of-band change of the remote secret since the last apply, empty if there is none
+	Drift string
+	// Outcome of the execution of the item, empty if it was not executed
+	Outcome string
+	// Error of a failed execution
+	Err error
 }
 
 func (p *Plan) AddItem(item PlanItem) {
@@ -29,13 +64,37 @@ func (p *Plan) AddItem(item PlanItem) {
 
 func (p *Plan) NothingToDo() bool {
 	for _, item := range p.Items {
-		if !item.Diff.Equal {
+		if !item.Diff.Equal && !item.Retained {
 			return false
 		}
 	}
 	return true
 }
 
+/*
+Returns the number of remote secrets the plan is going to delete
+*/
+func (p *Plan) Deletes() int {
+	deletes := 0
+	for _, item := range p.Items {
+		if !item.Retained && !item.Diff.Equal && item.Diff.Type == secret.SecretDiffTypeRemoved {
+			deletes++
+		}
+	}
+	return deletes
+}
+
+/*
+Returns an error if the plan deletes more secrets than allowed by MaxDeletes and is not forced
+*/
+func (p *Plan) CheckDeleteLimit() error {
+	deletes := p.Deletes()
+	if p.Force || p.MaxDeletes < 0 || deletes <= p.MaxDeletes {
+		return nil
+	}
+	return fmt.Errorf("refusing to delete %d secrets, the limit is %d: use --force or raise --max-deletes", deletes, p.MaxDeletes)
+}
+
 func (i *PlanItem) ComputeDiff() {
 	i.Diff = secret.CompareSecrets(i.RemoteSecret, i.LocalSecret)
 }
@@ -45,13 +104,56 @@ func (p *Plan) Print(showUnchanged bool) {
 		if !showUnchanged && item.Diff.Equal {
 			continue
 		}
-		item.Diff.Print(false)
+		if item.Retained {
+			item.PrintRetained()
+		} else {
+			item.Diff.Print(false)
+		}
+		item.PrintDrift()
 		if i < len(p.Items)-1 {
 			println("---")
 		}
 	}
 }
 
+/*
+Prints the items whose remote secrets are protected from deletion
+*/
+func (p *Plan) PrintRetained() {
+	for _, item := range p.Items {
+		if item.Retained {
+			item.PrintRetained()
+		}
+	}
+}
+
+func (i *PlanItem) PrintRetained() {
+	combinedSecretName := i.RemoteSecret.Namespace + "/" + i.RemoteSecret.Name
+	println(color.InBlue(combinedSecretName), color.InBlue(": "), color.InBold(color.InBlue("retain")), color.InGray("("+i.RetainReason+")"))
+}
+
+/*
+Prints the out-of-band change of the remote secret and whether the secret file was changed as well
+*/
+func (i *PlanItem) PrintDrift() {
+	if i.Drift == "" {
+		return
+	}
+	message := "drift: " + i.Drift
+	stateSecret := i.StateSecret
+	if stateSecret == nil {
+		stateSecret = i.MovedStateSecret
+	}
+	if i.LocalSecret != nil && stateSecret != nil && stateSecret.Applied != nil {
+		if i.LocalSecret.DataHash() == stateSecret.Applied.Hash {
+			message += ", apply reverts the cluster changes"
+		} else {
+			message += ", the secret file was changed as well"
+		}
+	}
+	println(color.InYellow(message))
+}
+
 func (p *Plan) Execute() error {
 	if p.TargetType == secret.SecretTargetTypeKubernetes {
 		return executeKubernetesPlan(p)
@@ -64,9 +166,26 @@ func (p *Plan) Execute() error {
 }
 
 func executeKubernetesPlan(p *Plan) error {
-	for _, item := range p.Items {
+	err := p.CheckDeleteLimit()
+	if err != nil {
+		return err
+	}
+	for i := range p.Items {
+		item := &p.Items[i]
+		if item.Retained {
+			log.Trace("Secret ", item.RemoteSecret.Namespace, "/", item.RemoteSecret.Name, " is retained, skipping...")
+			item.commitState(false)
+			item.Outcome = OutcomeRetained
+			continue
+		}
 		if item.Diff.Equal {
 			log.Trace("Secret ", item.LocalSecret.Namespace, "/", item.LocalSecret.Name, " is equal, skipping...")
+			err := persistGeneratedData(item.LocalSecret)
+			if err != nil {
+				return item.fail(err)
+			}
+			item.commitState(false)
+			item.Outcome = OutcomeUnchanged
 			continue
 		}
 		if item.Diff.Type == secret.SecretDiffTypeAdded {
@@ -74,6 +193,12 @@ func executeKubernetesPlan(p *Plan) error {
 			err := k8s.CreateSecret(item.LocalSecret, item.LocalSecret.Target)
 			if err != nil {
 				log.Error("Failed to create secret ", item.LocalSecret.Namespace, "/", item.LocalSecret.Name, " in cluster")
+				return item.fail(err)
+			}
+			item.commitState(true)
+			item.Outcome = OutcomeApplied
+			err = persistGeneratedData(item.LocalSecret)
+			if err != nil {
 				return err
 			}
 		} else if item.Diff.Type == secret.SecretDiffTypeChanged {
@@ -81,6 +206,12 @@ func executeKubernetesPlan(p *Plan) error {
 			err := k8s.UpdateSecret(item.LocalSecret, item.LocalSecret.Target)
 			if err != nil {
 				log.Error("Failed to update secret ", item.LocalSecret.Namespace, "/", item.LocalSecret.Name, " in cluster")
+				return item.fail(err)
+			}
+			item.commitState(true)
+			item.Outcome = OutcomeApplied
+			err = persistGeneratedData(item.LocalSecret)
+			if err != nil {
 				return err
 			}
 		} else if item.Diff.Type == secret.SecretDiffTypeRemoved {
@@ -88,9 +219,85 @@ func executeKubernetesPlan(p *Plan) error {
 			err := k8s.DeleteSecret(item.RemoteSecret, item.RemoteSecret.Target)
 			if err != nil {
 				log.Error("Failed to delete secret ", item.RemoteSecret.Namespace, "/", item.RemoteSecret.Name, " in cluster")
-				return err
+				return item.fail(err)
 			}
+			item.commitState(false)
+			item.Outcome = OutcomeApplied
+		}
+	}
+	p.commitStaleStateSecrets()
+	return nil
+}
+
+func (i *PlanItem) fail(err error) error {
+	i.Outcome = OutcomeFailed
+	i.Err = err
+	return err
+}
+
+/*
+Commits the state changes of a plan without changes to execute:
+unchanged and retained secrets and state secrets without item
+*/
+func (p *Plan) CommitState() {
+	for i := range p.Items {
+		item := &p.Items[i]
+		if item.Retained || item.Diff.Equal {
+			item.commitState(false)
+		}
+	}
+	p.commitStaleStateSecrets()
+}
+
+func (p *Plan) commitStaleStateSecrets() {
+	for _, stateSecret := range p.StaleStateSecrets {
+		state.GetState().RemoveSecretState(stateSecret)
+	}
+	p.StaleStateSecrets = nil
+}
+
+/*
+Writes the state change of an executed item to the state
+applied is set if the local secret was written to the target
+*/
+func (i *PlanItem) commitState(applied bool) {
+	if i.LocalSecret == nil {
+		if i.RemoveFromState && i.StateSecret != nil {
+			state.GetState().RemoveSecretState(i.StateSecret)
+		}
+		return
+	}
+	if i.StateSecret == nil {
+		i.StateSecret = state.GetState().Add(i.LocalSecret)
+		if i.MovedStateSecret != nil {
+			i.StateSecret.Applied = i.MovedStateSecret.Applied
 		}
+	} else {
+		i.StateSecret.Update(i.LocalSecret)
+	}
+	if applied {
+		i.StateSecret.RecordApplied(i.LocalSecret)
+	}
+}
+
+/*
+Writes generated values back into the secret file once the secret has been applied,
+so that they stay stable for subsequent plans
+*/
+func persistGeneratedData(localSecret *secret.Secret) error {
+	if localSecret == nil || !localSecret.HasPendingGeneratedData() {
+		return nil
+	}
+	// secret files read from a git revision are not written, the working tree stays untouched
+	if _, ok := util.GetFileSource().(*util.WorkTreeSource); !ok {
+		println(color.InYellow("Generated values of " + localSecret.CombinedName() + " are not written to " + localSecret.Path + ", it was read from " + util.GetFileSource().String()))
+		return nil
+	}
+	err := localSecret.PersistGeneratedData()
+	if err != nil {
+		log.Error("Failed to write generated values to secret file ", localSecret.Path)
+		return err
 	}
+	println(color.InGreen("Wrote generated values to " + localSecret.Path))
 	return nil
 }
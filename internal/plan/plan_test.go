@@ -0,0 +1,114 @@
+package plan
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mxcd/gitops-cli/internal/secret"
+	"github.com/mxcd/gitops-cli/internal/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func removedItem(name string, retained bool) PlanItem {
+	item := PlanItem{
+		RemoteSecret: &secret.Secret{
+			Name:      name,
+			Namespace: "default",
+			Data:      map[string]string{"foo": "bar"},
+		},
+		Retained: retained,
+	}
+	item.ComputeDiff()
+	return item
+}
+
+func TestPlanDeletes(t *testing.T) {
+	p := &Plan{}
+	p.AddItem(removedItem("a", false))
+	p.AddItem(removedItem("b", true))
+	p.AddItem(removedItem("c", false))
+
+	assert.Equal(t, 2, p.Deletes())
+	assert.False(t, p.NothingToDo())
+}
+
+func TestPlanOnlyRetainedIsNothingToDo(t *testing.T) {
+	p := &Plan{}
+	p.AddItem(removedItem("a", true))
+
+	assert.Equal(t, 0, p.Deletes())
+	assert.True(t, p.NothingToDo())
+}
+
+func TestPlanDeleteLimit(t *testing.T) {
+	p := &Plan{MaxDeletes: 1}
+	p.AddItem(removedItem("a", false))
+	assert.Nil(t, p.CheckDeleteLimit())
+
+	p.AddItem(removedItem("b", false))
+	assert.NotNil(t, p.CheckDeleteLimit())
+
+	p.Force = true
+	assert.Nil(t, p.CheckDeleteLimit())
+
+	p.Force = false
+	p.MaxDeletes = -1
+	assert.Nil(t, p.CheckDeleteLimit())
+}
+
+func TestPlanCommitState(t *testing.T) {
+	assert.NoError(t, state.LoadStateFrom(state.NewFileBackend(filepath.Join(t.TempDir(), ".gitops-state.yaml"))))
+	s := state.GetState()
+	retained := &state.SecretState{ID: "retained", Path: "retained.gitops.secret.enc.yaml", Name: "retained", Namespace: "default"}
+	pruneLater := &state.SecretState{ID: "prune-later", Path: "prune-later.gitops.secret.enc.yaml", Name: "prune-later", Namespace: "default"}
+	stale := &state.SecretState{ID: "stale", Path: "stale.gitops.secret.enc.yaml", Name: "stale", Namespace: "default"}
+	s.Secrets = []*state.SecretState{retained, pruneLater, stale}
+
+	unchanged := &secret.Secret{ID: "new", Path: "unchanged.gitops.secret.enc.yaml", Name: "unchanged", Namespace: "default", Data: map[string]string{"foo": "bar"}}
+	unchangedItem := PlanItem{LocalSecret: unchanged, RemoteSecret: unchanged}
+	unchangedItem.ComputeDiff()
+	retainedItem := removedItem("retained", true)
+	retainedItem.StateSecret = retained
+	retainedItem.RemoveFromState = true
+	pruneLaterItem := removedItem("prune-later", true)
+	pruneLaterItem.StateSecret = pruneLater
+
+	p := &Plan{StaleStateSecrets: []*state.SecretState{stale}}
+	p.AddItem(unchangedItem)
+	p.AddItem(retainedItem)
+	p.AddItem(pruneLaterItem)
+
+	// planning does not change the state
+	assert.Equal(t, []*state.SecretState{retained, pruneLater, stale}, s.Secrets)
+
+	p.CommitState()
+	assert.Len(t, s.Secrets, 2)
+	assert.Equal(t, pruneLater, s.Secrets[0])
+	assert.Equal(t, "new", s.Secrets[1].ID)
+	assert.Equal(t, "unchanged.gitops.secret.enc.yaml", s.Secrets[1].Path)
+	assert.Nil(t, s.Secrets[1].Applied)
+}
+
+func TestPlanCommitMovedState(t *testing.T) {
+	assert.NoError(t, state.LoadStateFrom(state.NewFileBackend(filepath.Join(t.TempDir(), ".gitops-state.yaml"))))
+	s := state.GetState()
+	applied := &state.AppliedState{ResourceVersion: "42", Hash: "hash"}
+	moved := &state.SecretState{ID: "moved", Path: "multi.gitops.secret.enc.yaml", Name: "a", Namespace: "default", Applied: applied}
+	s.Secrets = []*state.SecretState{moved}
+
+	// the file gained a second document, so the secret is stored under a new state key
+	local := &secret.Secret{Path: "multi.gitops.secret.enc.yaml", Document: "default/a", Name: "a", Namespace: "default", Data: map[string]string{"foo": "bar"}}
+	assert.Equal(t, moved, s.GetMoved(local))
+	local.ID = moved.ID
+	item := PlanItem{LocalSecret: local, RemoteSecret: local, MovedStateSecret: moved}
+	item.ComputeDiff()
+
+	p := &Plan{StaleStateSecrets: []*state.SecretState{moved}}
+	p.AddItem(item)
+	p.CommitState()
+	assert.Len(t, s.Secrets, 1)
+	assert.Equal(t, "multi.gitops.secret.enc.yaml#default/a", s.Secrets[0].StateKey())
+	assert.Equal(t, "moved", s.Secrets[0].ID)
+	assert.Equal(t, applied, s.Secrets[0].Applied)
+	assert.Nil(t, s.GetMoved(local))
+}
@@ -15,6 +15,7 @@ func InitConfig() error {
 		config.String("GITOPS_REPOSITORY_BRANCH").NotEmpty().Default("main"),
 		config.Bool("GITOPS_REPOSITORY_IGNORE_SSL_HOSTKEY").Default(false),
 		config.String("GITOPS_REPOSITORY_HOST_KEY").Default(""),
+		config.String("GITOPS_REPOSITORY_GIT_BACKEND").NotEmpty().Default("cli"),
 
 		config.String("GITOPS_REPOSITORY_BASICAUTH").Sensitive().Default(""),
 		config.String("GITOPS_REPOSITORY_SSH_KEY").Sensitive().Default(""),
@@ -0,0 +1,138 @@
+package secret
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// expiry given by the expires date of the secret file
+	ExpiryReasonExpires = "expires"
+	// rotation due according to the rotateAfter interval of the secret file
+	ExpiryReasonRotateAfter = "rotateAfter"
+	// expiry of the certificate of a kubernetes.io/tls secret
+	ExpiryReasonCertificate = "certificate"
+)
+
+const tlsSecretType = "kubernetes.io/tls"
+const tlsCertificateKey = "tls.crt"
+
+type SecretExpiry struct {
+	// Secret that expires
+	Secret *Secret
+	// Reason of the expiry: expires, rotateAfter or certificate
+	Reason string
+	// Date at which the secret expires or is due for rotation
+	Date time.Time
+}
+
+func (e *SecretExpiry) Expired(now time.Time) bool {
+	return !e.Date.After(now)
+}
+
+/*
+Returns the dates at which the material of the secret expires,
+given by the expires date of the secret file and the certificate of kubernetes.io/tls secrets
+*/
+func (s *Secret) GetMaterialExpiries() []SecretExpiry {
+	expiries := []SecretExpiry{}
+	if !s.Expires.IsZero() {
+		expiries = append(expiries, SecretExpiry{Secret: s, Reason: ExpiryReasonExpires, Date: s.Expires})
+	}
+	if s.Type == tlsSecretType && s.Data[tlsCertificateKey] != "" {
+		notAfter, err := certificateNotAfter(s.Data[tlsCertificateKey])
+		if err != nil {
+			log.Warn("Failed to read certificate of secret ", s.Path, ": ", err)
+		} else {
+			expiries = append(expiries, SecretExpiry{Secret: s, Reason: ExpiryReasonCertificate, Date: notAfter})
+		}
+	}
+	return expiries
+}
+
+/*
+Returns the material expiries of the secret and the date at which it is due for rotation
+lastModified is the date the secret file was last changed
+*/
+func (s *Secret) GetExpiries(lastModified time.Time) []SecretExpiry {
+	expiries := s.GetMaterialExpiries()
+	if s.RotateAfter > 0 {
+		expiries = append(expiries, SecretExpiry{Secret: s, Reason: ExpiryReasonRotateAfter, Date: lastModified.Add(s.RotateAfter)})
+	}
+	return expiries
+}
+
+func certificateNotAfter(certificate string) (time.Time, error) {
+	block, _ := pem.Decode([]byte(certificate))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return time.Time{}, fmt.Errorf("no PEM encoded certificate found")
+	}
+	parsedCertificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parsedCertificate.NotAfter, nil
+}
+
+/*
+Lists the secrets that expire or are due for rotation within the given duration
+The rotation interval starts at the last commit that modified the secret file
+Usage: gitops secrets expiring --within 30d
+*/
+func ExpiringCommand(c *cli.Context) error {
+	within, err := util.ParseDuration(c.String("within"))
+	if err != nil {
+		return err
+	}
+
+	secrets, err := LoadLocalSecretsLimited(SecretTargetTypeAll, c.String("dir"), "")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	expiring := []SecretExpiry{}
+	for _, secret := range secrets {
+		lastModified := time.Time{}
+		if secret.RotateAfter > 0 {
+			lastModified, err = util.GetLastCommitDate(secret.Path)
+			if err != nil {
+				return fmt.Errorf("failed to get last commit of '%s': %w", secret.Path, err)
+			}
+		}
+		for _, expiry := range secret.GetExpiries(lastModified) {
+			if expiry.Date.Before(now.Add(within)) {
+				expiring = append(expiring, expiry)
+			}
+		}
+	}
+
+	if len(expiring) == 0 {
+		println(color.InGreen(fmt.Sprintf("No secrets expire or are due for rotation within %s.", c.String("within"))))
+		return nil
+	}
+
+	sort.SliceStable(expiring, func(i, j int) bool {
+		return expiring[i].Date.Before(expiring[j].Date)
+	})
+	for _, expiry := range expiring {
+		println(expiry.Format(now))
+	}
+	return nil
+}
+
+func (e *SecretExpiry) Format(now time.Time) string {
+	line := fmt.Sprintf("%s  %-11s  %s  %s", e.Date.Format("2006-01-02"), e.Reason, e.Secret.CombinedName(), color.InGray(e.Secret.StateKey()))
+	if e.Expired(now) {
+		return color.InRed(color.InBold("expired")) + "  " + line
+	}
+	return color.InYellow(color.InBold("due    ")) + "  " + line
+}
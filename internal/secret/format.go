@@ -0,0 +1,170 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mxcd/gitops-cli/internal/templating"
+	"github.com/mxcd/gitops-cli/internal/util"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+dotenv and json secret files only hold the data of a secret.
+Their metadata (targetType, target, name, ...) is read from a sidecar file
+next to the secret file, e.g. app.gitops.meta.yaml for app.gitops.secret.enc.env,
+or from header comments of dotenv files:
+
+	# gitops: targetType: k8s
+	# gitops: namespace: my-app
+*/
+
+const metadataHeaderPrefix = "# gitops:"
+
+var metadataSidecarExtensions = []string{".gitops.meta.yaml", ".gitops.meta.yml"}
+
+/*
+Parses the rendered content of a secret file into a SecretFile according to its format
+*/
+func (s *Secret) parseSecretFile(content []byte, data TemplateData) (*SecretFile, error) {
+	var secretFile SecretFile
+	format := util.GetSecretFileFormat(s.Path)
+	if format == util.FileFormatYaml {
+		yaml.UnmarshalStrict(content, &secretFile)
+		return &secretFile, nil
+	}
+
+	metadata, err := s.loadMetadata(content, format, data)
+	if err != nil {
+		return nil, err
+	}
+	secretFile = *metadata
+
+	switch format {
+	case util.FileFormatDotenv:
+		secretFile.Data, err = util.ParseDotenv(content)
+	case util.FileFormatJson:
+		secretFile.Data, err = parseJsonData(content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse secret file '%s': %w", s.Path, err)
+	}
+	return &secretFile, nil
+}
+
+/*
+Returns the path of the metadata sidecar file of the secret file or an empty string if there is none
+*/
+func (s *Secret) metadataSidecarPath() string {
+	basePath := path.Join(path.Dir(s.Path), util.GetSecretBasename(s.Path))
+	for _, extension := range metadataSidecarExtensions {
+		sidecarPath := basePath + extension
+		if util.GetFileSource().Exists(sidecarPath) {
+			return sidecarPath
+		}
+	}
+	return ""
+}
+
+func (s *Secret) loadMetadata(content []byte, format string, data TemplateData) (*SecretFile, error) {
+	var metadata SecretFile
+
+	sidecarPath := s.metadataSidecarPath()
+	if sidecarPath != "" {
+		sidecarContent, err := util.GetFileSource().ReadFile(sidecarPath)
+		if err != nil {
+			return nil, err
+		}
+		renderedSidecar, err := templating.Render(sidecarPath, sidecarContent, data)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.UnmarshalStrict(renderedSidecar, &metadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse metadata file '%s': %w", sidecarPath, err)
+		}
+		return &metadata, nil
+	}
+
+	if format == util.FileFormatDotenv {
+		header := parseMetadataHeader(content)
+		if header != "" {
+			err := yaml.UnmarshalStrict([]byte(header), &metadata)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse metadata header of '%s': %w", s.Path, err)
+			}
+			return &metadata, nil
+		}
+	}
+
+	return nil, fmt.Errorf("secret file '%s' has no metadata: add a %s%s sidecar file or a '%s' header", s.Path, util.GetSecretBasename(s.Path), metadataSidecarExtensions[0], metadataHeaderPrefix)
+}
+
+/*
+Collects the "# gitops:" comment lines at the beginning of a dotenv file as yaml
+*/
+func parseMetadataHeader(content []byte) string {
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if strings.HasPrefix(line, metadataHeaderPrefix) {
+			lines = append(lines, strings.TrimSpace(strings.TrimPrefix(line, metadataHeaderPrefix)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+/*
+Maps the top level keys of a json object to the secret data.
+Non-string values are stored as compact json.
+*/
+func parseJsonData(content []byte) (map[string]string, error) {
+	var object map[string]interface{}
+	err := json.Unmarshal(content, &object)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]string{}
+	for key, value := range object {
+		if stringValue, ok := value.(string); ok {
+			data[key] = stringValue
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		data[key] = string(encoded)
+	}
+	return data, nil
+}
+
+/*
+Returns the data of the secret in the format of its secret file with all values redacted
+*/
+func (s *Secret) redactedData(format string) ([]byte, error) {
+	keys := make([]string, 0, len(s.Data))
+	for key := range s.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if format == util.FileFormatJson {
+		redacted := map[string]string{}
+		for _, key := range keys {
+			redacted[key] = util.ToRedactedString(s.Data[key])
+		}
+		return json.MarshalIndent(redacted, "", "  ")
+	}
+
+	lines := []string{}
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s=%s", key, util.ToRedactedString(s.Data[key])))
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
@@ -0,0 +1,390 @@
+package secret
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxcd/gitops-cli/internal/util"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Specification of a generated data value in the generate section of a secret file
+Usage:
+
+	generate:
+	  password:
+	    type: random
+	    length: 32
+	    charset: alnum
+*/
+type GeneratorSpec struct {
+	// Type of the generated value: random, rsa, ed25519 or tls
+	Type string `yaml:"type"`
+	// Length of a random value
+	Length int `yaml:"length,omitempty"`
+	// Charset of a random value: alnum, alpha, lower, upper, numeric, hex or symbols
+	Charset string `yaml:"charset,omitempty"`
+	// Key size of an rsa key
+	Bits int `yaml:"bits,omitempty"`
+	// Common name of a tls certificate, defaults to the secret name
+	CommonName string `yaml:"commonName,omitempty"`
+	// DNS names of a tls certificate, defaults to the common name
+	DNSNames []string `yaml:"dnsNames,omitempty"`
+	// Validity of a tls certificate in days
+	ValidityDays int `yaml:"validityDays,omitempty"`
+}
+
+const (
+	GeneratorTypeRandom  = "random"
+	GeneratorTypeRSA     = "rsa"
+	GeneratorTypeEd25519 = "ed25519"
+	GeneratorTypeTLS     = "tls"
+)
+
+const defaultRandomLength = 32
+const defaultRSABits = 4096
+const defaultTLSValidityDays = 365
+
+var generatorCharsets = map[string]string{
+	"alnum":   "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+	"alpha":   "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"lower":   "abcdefghijklmnopqrstuvwxyz",
+	"upper":   "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"numeric": "0123456789",
+	"hex":     "0123456789abcdef",
+	"symbols": "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!#$%&()*+,-./:;<=>?@[]^_{|}~",
+}
+
+/*
+Returns the data keys produced by the generator with the given name
+Key pairs produce <name> and <name>.pub, tls certificates produce <name>.crt and <name>.key
+*/
+func (g *GeneratorSpec) Keys(name string) []string {
+	switch g.Type {
+	case GeneratorTypeRSA, GeneratorTypeEd25519:
+		return []string{name, name + ".pub"}
+	case GeneratorTypeTLS:
+		return []string{name + ".crt", name + ".key"}
+	default:
+		return []string{name}
+	}
+}
+
+func (g *GeneratorSpec) Generate(name string, s *Secret) (map[string]string, error) {
+	switch g.Type {
+	case GeneratorTypeRandom:
+		length := g.Length
+		if length == 0 {
+			length = defaultRandomLength
+		}
+		charset := g.Charset
+		if charset == "" {
+			charset = "alnum"
+		}
+		value, err := generateRandomString(length, charset)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{name: value}, nil
+	case GeneratorTypeRSA:
+		bits := g.Bits
+		if bits == 0 {
+			bits = defaultRSABits
+		}
+		if bits < 2048 {
+			return nil, fmt.Errorf("rsa key size must be at least 2048 bits, got %d", bits)
+		}
+		privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, err
+		}
+		return encodeKeyPair(name, privateKey, &privateKey.PublicKey)
+	case GeneratorTypeEd25519:
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return encodeKeyPair(name, privateKey, publicKey)
+	case GeneratorTypeTLS:
+		commonName := g.CommonName
+		if commonName == "" {
+			commonName = s.Name
+		}
+		dnsNames := g.DNSNames
+		if len(dnsNames) == 0 {
+			dnsNames = []string{commonName}
+		}
+		validityDays := g.ValidityDays
+		if validityDays == 0 {
+			validityDays = defaultTLSValidityDays
+		}
+		certificate, key, err := generateSelfSignedCertificate(commonName, dnsNames, time.Duration(validityDays)*24*time.Hour)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{name + ".crt": certificate, name + ".key": key}, nil
+	default:
+		return nil, fmt.Errorf("unknown generator type '%s'", g.Type)
+	}
+}
+
+func generateRandomString(length int, charset string) (string, error) {
+	characters, ok := generatorCharsets[charset]
+	if !ok {
+		return "", fmt.Errorf("unknown charset '%s'", charset)
+	}
+	if length <= 0 {
+		return "", fmt.Errorf("length must be positive, got %d", length)
+	}
+	max := big.NewInt(int64(len(characters)))
+	value := make([]byte, length)
+	for i := range value {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		value[i] = characters[n.Int64()]
+	}
+	return string(value), nil
+}
+
+func encodeKeyPair(name string, privateKey interface{}, publicKey interface{}) (map[string]string, error) {
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		name:          string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})),
+		name + ".pub": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})),
+	}, nil
+}
+
+func generateSelfSignedCertificate(commonName string, dnsNames []string, validity time.Duration) (string, string, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              dnsNames,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	certificateBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return "", "", err
+	}
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", "", err
+	}
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateBytes})
+	key := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})
+	return string(certificate), string(key), nil
+}
+
+/*
+Adds the values of the generate section that are missing in the secret file to the secret data
+Values generated by an earlier rendering of the same secret are reused
+*/
+func (s *Secret) applyGenerators() error {
+	if len(s.generators) == 0 {
+		return nil
+	}
+	if s.Data == nil {
+		s.Data = map[string]string{}
+	}
+	if s.generated == nil {
+		s.generated = map[string]string{}
+	}
+
+	names := make([]string, 0, len(s.generators))
+	for name := range s.generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		generator := s.generators[name]
+		keys := generator.Keys(name)
+		present := 0
+		for _, key := range keys {
+			if _, ok := s.Data[key]; ok {
+				present++
+			}
+		}
+		if present == len(keys) {
+			continue
+		}
+		if present > 0 {
+			return fmt.Errorf("secret '%s': generated keys %v are only partially present in the secret file", s.Path, keys)
+		}
+
+		if _, ok := s.generated[keys[0]]; !ok {
+			log.Debug("Generating ", generator.Type, " value '", name, "' for secret ", s.Path)
+			values, err := generator.Generate(name, s)
+			if err != nil {
+				return fmt.Errorf("secret '%s': failed to generate '%s': %w", s.Path, name, err)
+			}
+			for key, value := range values {
+				s.generated[key] = value
+			}
+		}
+		for _, key := range keys {
+			s.Data[key] = s.generated[key]
+		}
+	}
+	return nil
+}
+
+/*
+Checks whether the secret holds generated values that are not yet written to the secret file
+*/
+func (s *Secret) HasPendingGeneratedData() bool {
+	return len(s.generated) > 0
+}
+
+/*
+Replaces pending generated values with the values of the remote secret if it already holds them,
+so that existing credentials are kept when the secret file has not been updated yet
+*/
+func (s *Secret) AdoptRemoteGeneratedData(remote *Secret) {
+	if remote == nil || len(s.generated) == 0 {
+		return
+	}
+	for name, generator := range s.generators {
+		keys := generator.Keys(name)
+		adopt := true
+		for _, key := range keys {
+			_, pending := s.generated[key]
+			_, remoteExists := remote.Data[key]
+			if !pending || !remoteExists {
+				adopt = false
+				break
+			}
+		}
+		if !adopt {
+			continue
+		}
+		log.Debug("Adopting generated value '", name, "' of secret ", s.Path, " from remote secret")
+		for _, key := range keys {
+			s.generated[key] = remote.Data[key]
+			s.Data[key] = remote.Data[key]
+		}
+	}
+}
+
+/*
+Returns the remote secret of a local secret, nil if it does not exist
+*/
+type RemoteSecretLookup func(s *Secret) (*Secret, error)
+
+var remoteSecretLookup RemoteSecretLookup
+
+/*
+Sets the lookup of remote secrets whose generated values are adopted while loading,
+before references to the generated values are resolved
+*/
+func SetRemoteSecretLookup(lookup RemoteSecretLookup) {
+	remoteSecretLookup = lookup
+}
+
+/*
+Adopts the generated values of the remote secrets of all secrets with pending generated values
+*/
+func adoptRemoteGeneratedData(secrets []*Secret) error {
+	if remoteSecretLookup == nil {
+		return nil
+	}
+	for _, s := range secrets {
+		if !s.HasPendingGeneratedData() {
+			continue
+		}
+		remote, err := remoteSecretLookup(s)
+		if err != nil {
+			return err
+		}
+		s.AdoptRemoteGeneratedData(remote)
+	}
+	return nil
+}
+
+/*
+Writes the pending generated values into the data section of the encrypted secret file
+*/
+func (s *Secret) PersistGeneratedData() error {
+	if len(s.generated) == 0 {
+		return nil
+	}
+	log.Debug("Writing ", len(s.generated), " generated values to ", s.Path)
+	// dotenv and json secret files hold the data at the top level
+	section := "data"
+	if util.GetSecretFileFormat(s.Path) != util.FileFormatYaml {
+		section = ""
+	}
+	err := util.AddEncryptedFileValues(path.Join(util.GetRootDir(), s.Path), s.isSourceDocument, section, s.generated)
+	if err != nil {
+		return err
+	}
+	s.generated = map[string]string{}
+	return nil
+}
+
+/*
+Checks whether a decrypted document of the secret file is the one the secret is rendered from.
+Rendered documents cannot be mapped to the documents of the file by position, since conditionals
+and empty documents shift them. The document must generate the pending values instead,
+and its name and namespace must match the secret unless they are templated.
+*/
+func (s *Secret) isSourceDocument(document map[string]interface{}) bool {
+	if util.GetSecretFileFormat(s.Path) != util.FileFormatYaml {
+		// dotenv and json secret files hold a single document
+		return true
+	}
+	generate, _ := document["generate"].(map[string]interface{})
+	for name, generator := range s.generators {
+		if _, pending := s.generated[generator.Keys(name)[0]]; !pending {
+			continue
+		}
+		if _, ok := generate[name]; !ok {
+			return false
+		}
+	}
+	return matchesSourceValue(document["name"], s.Name, util.GetSecretBasename(s.Path)) &&
+		matchesSourceValue(document["namespace"], s.Namespace, "default")
+}
+
+// a value of the secret file matches the rendered value if it is equal or templated
+func matchesSourceValue(value interface{}, rendered string, defaultValue string) bool {
+	if value == nil {
+		return rendered == defaultValue
+	}
+	text := fmt.Sprint(value)
+	return text == rendered || strings.Contains(text, "{{")
+}
@@ -2,6 +2,7 @@ package secret
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/mxcd/gitops-cli/internal/util"
@@ -32,7 +33,7 @@ func LoadLocalSecretsLimited(targetTypeFilter SecretTargetType, directoryLimit s
 			log.Trace("Skipping file due to directory filter: ", secretFileName)
 			continue
 		}
-		if strings.HasSuffix(secretFileName, "values.gitops.secret.enc.yml") || strings.HasSuffix(secretFileName, "values.gitops.secret.enc.yaml") {
+		if util.IsValuesFile(secretFileName) {
 			log.Trace("Skipping values file: ", secretFileName)
 			continue
 		}
@@ -40,7 +41,6 @@ func LoadLocalSecretsLimited(targetTypeFilter SecretTargetType, directoryLimit s
 	}
 	secretFileNames = filteredFileNames
 
-	secrets := []*Secret{}
 	bar := progressbar.NewOptions(len(secretFileNames),
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowBytes(false),
@@ -50,33 +50,98 @@ func LoadLocalSecretsLimited(targetTypeFilter SecretTargetType, directoryLimit s
 		progressbar.OptionSetPredictTime(false),
 		progressbar.OptionSetDescription("[green][Loading local secrets][reset]"),
 	)
+	loadedSecrets := []*Secret{}
 	for _, secretFileName := range secretFileNames {
 		bar.Add(1)
-		secret, err := FromPath(secretFileName)
+		fileSecrets, err := LoadFromPath(secretFileName)
 		if err != nil {
 			bar.Finish()
 			return nil, err
 		}
+		loadedSecrets = append(loadedSecrets, fileSecrets...)
+	}
+	bar.Finish()
+	println("")
+	println("")
+
+	// references are resolved before filtering since they may point to secrets of other targets
+	referencePool, err := loadReferencePool(loadedSecrets, directoryLimit)
+	if err != nil {
+		return nil, err
+	}
+	// referencing secrets must see the generated values that already exist remotely
+	err = adoptRemoteGeneratedData(referencePool)
+	if err != nil {
+		return nil, err
+	}
+	err = ResolveReferences(loadedSecrets, referencePool)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := []*Secret{}
+	for _, secret := range loadedSecrets {
 		if secret.TargetType != targetTypeFilter && targetTypeFilter != SecretTargetTypeAll {
-			log.Trace("Skipping file due to targetType filter: ", secretFileName)
+			log.Trace("Skipping file due to targetType filter: ", secret.Path)
 			continue
 		}
 		if clusterLimit != "" && secret.Target != clusterLimit {
-			log.Trace("Skipping file due to target filter: ", secretFileName)
+			log.Trace("Skipping file due to target filter: ", secret.Path)
 			continue
 		}
 		for _, s := range secrets {
 			if s.Name == secret.Name && s.Target == secret.Target && s.Namespace == secret.Namespace {
-				bar.Finish()
-				println("")
 				log.Error("Unable to load secret '", secret.Name, "' from '", secret.Path, "' because a secret with the same name and target already exists: '", s.Path, "'")
 				return nil, errors.New("error loading secrets: duplicate secret name and target")
 			}
 		}
 		secrets = append(secrets, secret)
 	}
-	bar.Finish()
-	println("")
-	println("")
 	return secrets, nil
 }
+
+/*
+Returns the secrets referenced secrets are looked up in.
+If the loaded secrets reference secrets outside of the directory limit,
+the remaining secret files are loaded as well.
+*/
+func loadReferencePool(loadedSecrets []*Secret, directoryLimit string) ([]*Secret, error) {
+	if directoryLimit == "" || !hasUnresolvedReferences(loadedSecrets) {
+		return loadedSecrets, nil
+	}
+
+	secretFileNames, err := util.GetSecretFiles()
+	if err != nil {
+		return nil, err
+	}
+	pool := append([]*Secret{}, loadedSecrets...)
+	for _, secretFileName := range secretFileNames {
+		if strings.HasPrefix(secretFileName, directoryLimit) || util.IsValuesFile(secretFileName) {
+			continue
+		}
+		log.Debug("Loading secret outside of directory limit for reference resolution: ", secretFileName)
+		fileSecrets, err := LoadFromPath(secretFileName)
+		if err != nil {
+			return nil, err
+		}
+		pool = append(pool, fileSecrets...)
+	}
+	return pool, nil
+}
+
+/*
+Fails if any of the given secrets rendered "<no value>" into its content
+*/
+func CheckMissingValues(secrets []*Secret) error {
+	count := 0
+	for _, secret := range secrets {
+		for _, line := range secret.MissingValueLines() {
+			log.Error("Secret '", secret.Path, "' renders ", missingValuePlaceholder, " in line ", line)
+			count++
+		}
+	}
+	if count > 0 {
+		return fmt.Errorf("refusing to proceed: %d line(s) of the loaded secrets render %s", count, missingValuePlaceholder)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mxcd/gitops-cli/internal/util"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Reference to a data key of another secret
+Usage: {{ secretRef "namespace/name" "key" }}
+*/
+type SecretReference struct {
+	Namespace string
+	Name      string
+	Key       string
+}
+
+func (r SecretReference) CombinedName() string {
+	return r.Namespace + "/" + r.Name
+}
+
+func parseSecretReference(ref string, key string) (SecretReference, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return SecretReference{}, fmt.Errorf("reference '%s' must have the form 'namespace/name'", ref)
+	}
+	return SecretReference{
+		Namespace: parts[0],
+		Name:      parts[1],
+		Key:       key,
+	}, nil
+}
+
+/*
+secretRef implementation used while loading a secret file.
+It only records the reference and renders a placeholder,
+the actual value is rendered by ResolveReferences.
+*/
+func (s *Secret) collectReference(ref string, key string) (string, error) {
+	reference, err := parseSecretReference(ref, key)
+	if err != nil {
+		return "", err
+	}
+	s.References = append(s.References, reference)
+	return fmt.Sprintf("<secretRef %s %s>", reference.CombinedName(), key), nil
+}
+
+/*
+Renders all secrets that reference other secrets in dependency order.
+Referenced secrets are looked up in the pool, which must contain the given secrets.
+*/
+func ResolveReferences(secrets []*Secret, pool []*Secret) error {
+	resolver := &referenceResolver{
+		pool:  pool,
+		state: map[*Secret]int{},
+	}
+	for _, secret := range secrets {
+		err := resolver.visit(secret)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	referenceStateVisiting = iota + 1
+	referenceStateResolved
+)
+
+type referenceResolver struct {
+	pool  []*Secret
+	state map[*Secret]int
+	// secrets currently being resolved, used to report cycles
+	stack []*Secret
+}
+
+func (r *referenceResolver) visit(secret *Secret) error {
+	switch r.state[secret] {
+	case referenceStateResolved:
+		return nil
+	case referenceStateVisiting:
+		return r.cycleError(secret)
+	}
+
+	r.state[secret] = referenceStateVisiting
+	r.stack = append(r.stack, secret)
+
+	for _, reference := range secret.References {
+		target, err := r.lookup(secret, reference)
+		if err != nil {
+			return err
+		}
+		err = r.visit(target)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(secret.References) > 0 {
+		log.Debug("Rendering secret references of ", secret.Path)
+		err := secret.render(func(ref string, key string) (string, error) {
+			reference, err := parseSecretReference(ref, key)
+			if err != nil {
+				return "", err
+			}
+			target, err := r.lookup(secret, reference)
+			if err != nil {
+				return "", err
+			}
+			value, ok := target.Data[key]
+			if !ok {
+				return "", fmt.Errorf("secret '%s' (%s) has no key '%s'", target.CombinedName(), target.Path, key)
+			}
+			return value, nil
+		})
+		if err != nil {
+			return err
+		}
+		if util.GetCliContext().Bool("print") {
+			secret.PrettyPrint()
+		}
+	}
+
+	r.stack = r.stack[:len(r.stack)-1]
+	r.state[secret] = referenceStateResolved
+	return nil
+}
+
+/*
+Finds the referenced secret. Secrets on the same target as the referencing secret take precedence.
+*/
+func (r *referenceResolver) lookup(secret *Secret, reference SecretReference) (*Secret, error) {
+	candidates := []*Secret{}
+	for _, s := range r.pool {
+		if s.CombinedName() == reference.CombinedName() {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) > 1 {
+		sameTarget := []*Secret{}
+		for _, s := range candidates {
+			if s.Target == secret.Target {
+				sameTarget = append(sameTarget, s)
+			}
+		}
+		candidates = sameTarget
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("secret '%s' references unknown secret '%s'", secret.Path, reference.CombinedName())
+	case 1:
+		return candidates[0], nil
+	default:
+		return nil, fmt.Errorf("secret '%s' references ambiguous secret '%s'", secret.Path, reference.CombinedName())
+	}
+}
+
+func (r *referenceResolver) cycleError(secret *Secret) error {
+	start := 0
+	for i, s := range r.stack {
+		if s == secret {
+			start = i
+			break
+		}
+	}
+	cycle := []string{}
+	for _, s := range append(r.stack[start:], secret) {
+		cycle = append(cycle, fmt.Sprintf("%s (%s)", s.CombinedName(), s.Path))
+	}
+	return errors.New("cyclic secret reference: " + strings.Join(cycle, " -> "))
+}
+
+/*
+Checks whether all references of the given secrets can be found among them
+*/
+func hasUnresolvedReferences(secrets []*Secret) bool {
+	names := map[string]bool{}
+	for _, s := range secrets {
+		names[s.CombinedName()] = true
+	}
+	for _, s := range secrets {
+		for _, reference := range s.References {
+			if !names[reference.CombinedName()] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package secret
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/util"
+	"github.com/urfave/cli/v2"
+)
+
+/*
+Change of a secret between two revisions
+*/
+type RevisionDiff struct {
+	// secret at the old revision, nil if it was added
+	Old *Secret
+	// secret at the new revision, nil if it was removed
+	New  *Secret
+	Diff *SecretDiff
+}
+
+/*
+Returns the secret of the diff at the newest revision it exists in
+*/
+func (d *RevisionDiff) Secret() *Secret {
+	if d.New != nil {
+		return d.New
+	}
+	return d.Old
+}
+
+// secrets are matched by their target object, so that moved secrets are no change
+func revisionKey(s *Secret) string {
+	return fmt.Sprintf("%s/%s/%s", s.TargetType, s.Target, s.CombinedName())
+}
+
+/*
+Compares the secrets of two revisions, sorted by target and name
+*/
+func DiffRevisions(oldSecrets []*Secret, newSecrets []*Secret) []*RevisionDiff {
+	diffs := map[string]*RevisionDiff{}
+	for _, s := range oldSecrets {
+		diffs[revisionKey(s)] = &RevisionDiff{Old: s}
+	}
+	for _, s := range newSecrets {
+		key := revisionKey(s)
+		if diffs[key] == nil {
+			diffs[key] = &RevisionDiff{}
+		}
+		diffs[key].New = s
+	}
+
+	keys := []string{}
+	for key := range diffs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := []*RevisionDiff{}
+	for _, key := range keys {
+		d := diffs[key]
+		if d.Old != nil && d.New != nil {
+			// values generated on apply are not persisted yet at either revision
+			d.New.AdoptRemoteGeneratedData(d.Old)
+		}
+		d.Diff = CompareSecrets(d.Old, d.New)
+		result = append(result, d)
+	}
+	return result
+}
+
+/*
+Loads the secrets of all target types from the given file source
+*/
+func loadRevisionSecrets(source util.FileSource, directoryLimit string) ([]*Secret, error) {
+	previousSource := util.GetFileSource()
+	util.SetFileSource(source)
+	defer util.SetFileSource(previousSource)
+
+	println("Loading secrets from " + color.InBold(source.String()))
+	secrets, err := LoadLocalSecretsLimited(SecretTargetTypeAll, directoryLimit, "")
+	if err != nil {
+		return nil, err
+	}
+	return secrets, CheckMissingValues(secrets)
+}
+
+/*
+Compares the rendered secrets of two git revisions without contacting any cluster
+--to defaults to the working tree
+Usage: gitops secrets diff --from <git-rev> [--to <git-rev>]
+*/
+func DiffCommand(c *cli.Context) error {
+	from, err := util.NewGitRevisionSource(c.String("from"))
+	if err != nil {
+		return err
+	}
+	var to util.FileSource = &util.WorkTreeSource{}
+	if c.String("to") != "" {
+		to, err = util.NewGitRevisionSource(c.String("to"))
+		if err != nil {
+			return err
+		}
+	}
+
+	dirLimit := c.String("dir")
+	if dirLimit != "" {
+		println("Limiting to directory " + color.InPurple(dirLimit))
+	}
+	oldSecrets, err := loadRevisionSecrets(from, dirLimit)
+	if err != nil {
+		return err
+	}
+	newSecrets, err := loadRevisionSecrets(to, dirLimit)
+	if err != nil {
+		return err
+	}
+
+	showUnchanged := c.Bool("show-unchanged")
+	changed := 0
+	printed := 0
+	for _, d := range DiffRevisions(oldSecrets, newSecrets) {
+		if !d.Diff.Equal {
+			changed++
+		} else if !showUnchanged {
+			continue
+		}
+		if printed > 0 {
+			println("---")
+		}
+		printed++
+		s := d.Secret()
+		d.Diff.Print(showUnchanged)
+		println(color.InGray(fmt.Sprintf("  %s %s: %s", s.TargetType, s.Target, s.Path)))
+	}
+
+	println("")
+	if changed == 0 {
+		println(color.InGreen(fmt.Sprintf("No secret changes between %s and %s.", from, to)))
+		return nil
+	}
+	println(color.InBold(fmt.Sprintf("%d changed secrets between %s and %s.", changed, from, to)))
+	return nil
+}
@@ -1,18 +1,20 @@
 package secret
 
 import (
-	"bytes"
 	"encoding/hex"
 	"errors"
-	"path"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"text/template"
+	"time"
 
 	"crypto/sha256"
 
 	"github.com/mxcd/gitops-cli/internal/templating"
 	"github.com/mxcd/gitops-cli/internal/util"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
 )
 
 type Secret struct {
@@ -36,6 +38,13 @@ type Secret struct {
 	// optional namespace of the secret
 	Namespace string
 
+	// Environment selects the overlay values files used for templating
+	Environment string
+
+	// Document identifies the secret within a multi-document secret file (namespace/name)
+	// empty for secret files with a single document
+	Document string
+
 	// Decrypted binary data from the secret file
 	BinaryData []byte
 
@@ -47,6 +56,43 @@ type Secret struct {
 
 	// Labels are custom labels to apply to the k8s resource
 	Labels map[string]string
+
+	// DeletionPolicy decides whether the remote secret is deleted once the secret file is removed (Retain or Delete)
+	// empty if the secret file does not set a policy, in which case deletions require --prune
+	DeletionPolicy string
+
+	// RotateAfter is the interval after which the secret should be rotated, zero if not set
+	RotateAfter time.Duration
+
+	// Expires is the date at which the secret material expires, zero if not set
+	Expires time.Time
+
+	// References are the secrets referenced using secretRef in the secret file
+	References []SecretReference
+
+	// ResourceVersion of the object in the cluster, only set for secrets read from or written to a cluster
+	ResourceVersion string
+
+	// UID of the object in the cluster, only set for secrets read from or written to a cluster
+	UID string
+
+	// decrypted content of the secret file before templating
+	decryptedContent []byte
+
+	// generate section of the secret file
+	generators map[string]*GeneratorSpec
+
+	// generated values that are not yet written to the secret file
+	generated map[string]string
+
+	// index of the document of the secret within the secret file
+	documentIndex int
+
+	// number of documents in the secret file
+	documentCount int
+
+	// line of the secret file the document starts at
+	documentLine int
 }
 
 type SecretTargetType string
@@ -54,6 +100,13 @@ var SecretTargetTypeVault SecretTargetType = "vault"
 var SecretTargetTypeKubernetes SecretTargetType = "k8s"
 var SecretTargetTypeAll SecretTargetType = "all"
 
+const (
+	// the remote secret is kept when the secret file is removed
+	DeletionPolicyRetain = "Retain"
+	// the remote secret is deleted when the secret file is removed
+	DeletionPolicyDelete = "Delete"
+)
+
 type SecretFile struct {
 	TargetType SecretTargetType  `yaml:"targetType"`
 	Target     string            `yaml:"target"`
@@ -63,6 +116,10 @@ type SecretFile struct {
 	Data			 map[string]string `yaml:"data"`
 	ID         string            `yaml:"id,omitempty"`
 	Labels     map[string]string `yaml:"labels,omitempty"`
+	Generate   map[string]*GeneratorSpec `yaml:"generate,omitempty"`
+	DeletionPolicy string            `yaml:"deletionPolicy,omitempty"`
+	RotateAfter    string            `yaml:"rotateAfter,omitempty"`
+	Expires        string            `yaml:"expires,omitempty"`
 }
 
 type TemplateData struct {
@@ -74,44 +131,92 @@ func (s *Secret) Load() error {
 		return errors.New("secret path is empty")
 	}
 
-	absoluteSecretPath := path.Join(util.GetRootDir(), s.Path)
-	decryptedFileContent, err := util.DecryptFile(absoluteSecretPath)
+	decryptedFileContent, err := util.DecryptSourceFile(s.Path)
 	if err != nil {
 		return err
 	}
+	s.decryptedContent = decryptedFileContent
+	return s.loadDecrypted()
+}
 
-	// execute templating on the secret file data
-	data := TemplateData{
-		Values: templating.GetValuesForPath(s.Path),
-	}
-	stringData := string(decryptedFileContent)
-	tmpl, err := template.New(s.Path).Parse(stringData)
+func (s *Secret) loadDecrypted() error {
+	s.Environment = util.GetCliContext().String("env")
+
+	// references to other secrets are only collected here and resolved by the loader
+	s.References = []SecretReference{}
+	err := s.render(s.collectReference)
 	if err != nil {
-		log.Error("Error parsing template for secret " + s.Path)
 		return err
 	}
-	buf := new(bytes.Buffer)
-	err = tmpl.Execute(buf, data)
+
+	// the environment of the target cluster is only known once the secret is rendered
+	clusterEnvironment := clusterEnvironments[s.Target]
+	if clusterEnvironment != "" && clusterEnvironment != s.Environment {
+		if s.Environment != "" {
+			return fmt.Errorf("secret file '%s': --env %s differs from environment %s of cluster %s", s.Path, s.Environment, clusterEnvironment, s.Target)
+		}
+		log.Debug("Rendering secret ", s.Path, " for environment ", clusterEnvironment, " of target ", s.Target)
+		s.Environment = clusterEnvironment
+		s.References = []SecretReference{}
+		err = s.render(s.collectReference)
+		if err != nil {
+			return err
+		}
+	}
+
+	if util.GetCliContext().Bool("print") && len(s.References) == 0 {
+		s.PrettyPrint()
+	}
+	
+	return nil
+}
+
+/*
+Executes the templating on the decrypted secret file and parses the result
+secretRef is the template function used to resolve references to other secrets
+*/
+func (s *Secret) render(secretRef interface{}) error {
+	values, err := templating.GetValuesForEnvironment(s.Path, s.Environment)
 	if err != nil {
-		log.Error("Error executing template for secret " + s.Path)
+		return fmt.Errorf("secret file '%s': %w", s.Path, err)
+	}
+	data := TemplateData{
+		Values: values,
+	}
+	renderedFileContent, err := templating.RenderWithFunctions(s.Path, s.decryptedContent, data, template.FuncMap{
+		"secretRef": secretRef,
+	})
+	if err != nil {
+		log.Error("Error templating secret " + s.Path)
 		return err
 	}
 
-	s.BinaryData = buf.Bytes()
+	documents := []secretDocument{{content: renderedFileContent, line: 1}}
+	if util.GetSecretFileFormat(s.Path) == util.FileFormatYaml {
+		documents = splitDocuments(renderedFileContent)
+	}
+	if s.documentIndex >= len(documents) {
+		return fmt.Errorf("secret file '%s' has no document %d", s.Path, s.documentIndex)
+	}
+	s.documentCount = len(documents)
+	s.documentLine = documents[s.documentIndex].line
+	s.BinaryData = documents[s.documentIndex].content
 
 	binaryHash := sha256.Sum256(s.BinaryData)
 	hash := binaryHash[:]
 	s.BinaryDataHash = hex.EncodeToString(hash)
 
-	var secretFile SecretFile
-	yaml.UnmarshalStrict(s.BinaryData, &secretFile)
+	secretFile, err := s.parseSecretFile(s.BinaryData, data)
+	if err != nil {
+		return err
+	}
 
 	s.TargetType = secretFile.TargetType
 	
 	if secretFile.Target != "" {
 		s.Target = secretFile.Target
 	} else {
-		s.Target = string(util.DefaultClusterClient)
+		s.Target = util.GetDefaultTarget()
 	}
 
 	if secretFile.Name != "" {
@@ -135,18 +240,102 @@ func (s *Secret) Load() error {
 		
 	s.Data = secretFile.Data
 	s.Labels = secretFile.Labels
+	s.generators = secretFile.Generate
 
-	if util.GetCliContext().Bool("print") {
-		s.PrettyPrint()
+	switch secretFile.DeletionPolicy {
+	case "", DeletionPolicyRetain, DeletionPolicyDelete:
+		s.DeletionPolicy = secretFile.DeletionPolicy
+	default:
+		return fmt.Errorf("secret '%s' has invalid deletionPolicy '%s': must be %s or %s", s.Path, secretFile.DeletionPolicy, DeletionPolicyRetain, DeletionPolicyDelete)
 	}
-	
-	return nil
+
+	s.RotateAfter = 0
+	if secretFile.RotateAfter != "" {
+		s.RotateAfter, err = util.ParseDuration(secretFile.RotateAfter)
+		if err != nil {
+			return fmt.Errorf("secret '%s' has invalid rotateAfter: %w", s.Path, err)
+		}
+	}
+
+	s.Expires = time.Time{}
+	if secretFile.Expires != "" {
+		s.Expires, err = util.ParseDate(secretFile.Expires)
+		if err != nil {
+			return fmt.Errorf("secret '%s' has invalid expires: %w", s.Path, err)
+		}
+	}
+
+	s.Document = ""
+	if s.documentCount > 1 {
+		s.Document = s.CombinedName()
+	}
+
+	return s.applyGenerators()
+}
+
+// environments of the target clusters by cluster name
+var clusterEnvironments = map[string]string{}
+
+/*
+Sets the environments of the target clusters
+Secrets targeting a cluster with an environment are rendered using its overlay values files
+*/
+func SetClusterEnvironments(environments map[string]string) {
+	clusterEnvironments = environments
+}
+
+const missingValuePlaceholder = "<no value>"
+
+/*
+Returns the line numbers of the rendered secret file that contain "<no value>"
+*/
+func (s *Secret) MissingValueLines() []int {
+	lines := []int{}
+	offset := 0
+	if s.documentLine > 1 {
+		offset = s.documentLine - 1
+	}
+	for i, line := range strings.Split(string(s.BinaryData), "\n") {
+		if strings.Contains(line, missingValuePlaceholder) {
+			lines = append(lines, offset+i+1)
+		}
+	}
+	return lines
+}
+
+/*
+Returns a SHA256 hash of the type and data of the secret
+Unlike BinaryDataHash it only depends on what is applied to the target, so it can be computed for remote secrets as well
+*/
+func (s *Secret) DataHash() string {
+	keys := make([]string, 0, len(s.Data))
+	for key := range s.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "type:%q\n", s.Type)
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%q:%q\n", key, s.Data[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
 func (s *Secret) CombinedName() string {
 	return s.Namespace + "/" + s.Name
 }
 
+/*
+Returns the identity of the secret in the state: the path of the secret file,
+suffixed with #<namespace>/<name> for secrets of multi-document files
+*/
+func (s *Secret) StateKey() string {
+	if s.Document == "" {
+		return s.Path
+	}
+	return s.Path + "#" + s.Document
+}
+
 func (s *Secret) PrettyPrint() {
 	cleartext := util.GetCliContext().Bool("cleartext")
 	println("---")
@@ -165,16 +354,116 @@ func (s *Secret) PrettyPrint() {
 	}
 }
 
+/*
+Loads a single secret from the given path
+Secrets of multi-document files are selected using <path>#<namespace>/<name>
+*/
 func FromPath(path string) (*Secret, error) {
-	s := Secret {
-		Path: path,
+	filePath, document, _ := strings.Cut(path, "#")
+	secrets, err := LoadFromPath(filePath)
+	if err != nil {
+		return nil, err
 	}
 
-	err := s.Load()
+	if document == "" {
+		if len(secrets) > 1 {
+			return nil, fmt.Errorf("secret file '%s' contains %d secrets, select one using %s#<namespace>/<name>", filePath, len(secrets), filePath)
+		}
+		return secrets[0], nil
+	}
+	for _, s := range secrets {
+		if s.Document == document {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("secret file '%s' contains no secret '%s'", filePath, document)
+}
+
+/*
+Loads all secrets of the secret file at the given path
+YAML secret files can contain several secrets as --- separated documents
+*/
+func LoadFromPath(path string) ([]*Secret, error) {
+	first := &Secret{
+		Path: path,
+	}
+	err := first.Load()
 	if err != nil {
 		return nil, err
 	}
 
-	return &s, nil
+	secrets := []*Secret{first}
+	for i := 1; i < first.documentCount; i++ {
+		s := &Secret{
+			Path:             path,
+			decryptedContent: first.decryptedContent,
+			documentIndex:    i,
+		}
+		err := s.loadDecrypted()
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, s)
+	}
+
+	documents := map[string]bool{}
+	for _, s := range secrets {
+		if documents[s.Document] {
+			return nil, fmt.Errorf("secret file '%s' contains secret '%s' more than once", path, s.Document)
+		}
+		documents[s.Document] = true
+	}
+	return secrets, nil
+}
+
+type secretDocument struct {
+	content []byte
+	// line of the secret file the document starts at
+	line int
+}
+
+var documentSeparatorRegex = regexp.MustCompile(`^---\s*$`)
+
+/*
+Splits a rendered yaml secret file into its --- separated documents
+Empty documents are skipped, including documents that only hold comments,
+e.g. of a disabled conditional, and the {} SOPS writes for empty documents
+*/
+func splitDocuments(content []byte) []secretDocument {
+	documents := []secretDocument{}
+	current := []string{}
+	start := 1
+	flush := func() {
+		text := strings.Join(current, "\n")
+		if !isEmptyDocument(text) {
+			documents = append(documents, secretDocument{content: []byte(text), line: start})
+		}
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		if documentSeparatorRegex.MatchString(line) {
+			flush()
+			current = []string{}
+			start = i + 2
+			continue
+		}
+		current = append(current, line)
+	}
+	flush()
+	if len(documents) == 0 {
+		documents = append(documents, secretDocument{content: content, line: 1})
+	}
+	return documents
 }
 
+func isEmptyDocument(text string) bool {
+	if strings.TrimSpace(text) == "{}" {
+		return true
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
@@ -1,10 +1,16 @@
 package secret
 
 import (
+	"flag"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mxcd/gitops-cli/internal/util"
 	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
 )
 
 func TestLoadSecret1(t *testing.T) {
@@ -393,4 +399,337 @@ func TestSecretComparisonAddSecret(t *testing.T) {
 	entry2 := diff.GetEntry("data.key2")
 	assert.NotNil(t, entry1, "Diff should have an entry for data.key2")
 	assert.Equal(t, SecretDiffTypeAdded, entry2.Type, "DiffEntry type should be added")
-}
\ No newline at end of file
+}
+
+func TestCheckMissingValues(t *testing.T) {
+	a := &Secret{
+		Path:       "a.gitops.secret.enc.yml",
+		BinaryData: []byte("targetType: k8s\ndata:\n  foo: bar\n"),
+	}
+	b := &Secret{
+		Path:       "b.gitops.secret.enc.yml",
+		BinaryData: []byte("targetType: k8s\ndata:\n  foo: <no value>\n"),
+	}
+
+	assert.Empty(t, a.MissingValueLines())
+	assert.Equal(t, []int{3}, b.MissingValueLines())
+
+	assert.NoError(t, CheckMissingValues([]*Secret{a}))
+	assert.Error(t, CheckMissingValues([]*Secret{a, b}))
+}
+
+func TestRedactedContent(t *testing.T) {
+	secret := &Secret{
+		BinaryData: []byte("targetType: k8s\nname: my-secret\ndata:\n  password: foobar\n  port: 5432\n"),
+	}
+	redacted, err := secret.RedactedContent()
+	assert.NoError(t, err)
+	assert.Equal(t, "targetType: k8s\nname: my-secret\ndata:\n  password: '******'\n  port: '****'\n", string(redacted))
+}
+
+func secretFromContent(t *testing.T, path string, content string) *Secret {
+	secret := &Secret{
+		Path:             path,
+		decryptedContent: []byte(content),
+	}
+	err := secret.render(secret.collectReference)
+	assert.NoError(t, err)
+	return secret
+}
+
+func TestResolveReferences(t *testing.T) {
+	app := secretFromContent(t, "test_assets/app.gitops.secret.enc.yml", "targetType: k8s\nnamespace: app\ndata:\n  password: '{{ secretRef \"db/db-init\" \"password\" }}'\n")
+	dbInit := secretFromContent(t, "test_assets/db-init.gitops.secret.enc.yml", "targetType: k8s\nnamespace: db\ndata:\n  password: '{{ secretRef \"db/db-generated\" \"password\" }}'\n")
+	generated := secretFromContent(t, "test_assets/db-generated.gitops.secret.enc.yml", "targetType: k8s\nnamespace: db\ndata:\n  password: my-generated-password\n")
+
+	assert.Equal(t, []SecretReference{{Namespace: "db", Name: "db-init", Key: "password"}}, app.References)
+	assert.Equal(t, "<secretRef db/db-init password>", app.Data["password"])
+
+	secrets := []*Secret{app, dbInit, generated}
+	err := ResolveReferences(secrets, secrets)
+	assert.NoError(t, err)
+	assert.Equal(t, "my-generated-password", app.Data["password"])
+	assert.Equal(t, "my-generated-password", dbInit.Data["password"])
+}
+
+func TestResolveReferencesAdoptedGeneratedData(t *testing.T) {
+	app := secretFromContent(t, "test_assets/app.gitops.secret.enc.yml", "targetType: k8s\nnamespace: app\ndata:\n  password: '{{ secretRef \"db/db-generated\" \"password\" }}'\n")
+	generated := secretFromContent(t, "test_assets/db-generated.gitops.secret.enc.yml", "targetType: k8s\nnamespace: db\ngenerate:\n  password:\n    type: random\n")
+	assert.True(t, generated.HasPendingGeneratedData())
+
+	SetRemoteSecretLookup(func(s *Secret) (*Secret, error) {
+		if s.CombinedName() != "db/db-generated" {
+			return nil, nil
+		}
+		return &Secret{Data: map[string]string{"password": "remote-password"}}, nil
+	})
+	defer SetRemoteSecretLookup(nil)
+
+	secrets := []*Secret{app, generated}
+	assert.NoError(t, adoptRemoteGeneratedData(secrets))
+	assert.NoError(t, ResolveReferences(secrets, secrets))
+	assert.Equal(t, "remote-password", generated.Data["password"])
+	assert.Equal(t, "remote-password", app.Data["password"])
+}
+
+func TestResolveReferencesErrors(t *testing.T) {
+	a := secretFromContent(t, "test_assets/a.gitops.secret.enc.yml", "targetType: k8s\ndata:\n  foo: '{{ secretRef \"default/b\" \"foo\" }}'\n")
+	b := secretFromContent(t, "test_assets/b.gitops.secret.enc.yml", "targetType: k8s\ndata:\n  foo: '{{ secretRef \"default/a\" \"foo\" }}'\n")
+	err := ResolveReferences([]*Secret{a, b}, []*Secret{a, b})
+	assert.EqualError(t, err, "cyclic secret reference: default/a (test_assets/a.gitops.secret.enc.yml) -> default/b (test_assets/b.gitops.secret.enc.yml) -> default/a (test_assets/a.gitops.secret.enc.yml)")
+
+	c := secretFromContent(t, "test_assets/c.gitops.secret.enc.yml", "targetType: k8s\ndata:\n  foo: '{{ secretRef \"default/d\" \"bar\" }}'\n")
+	d := secretFromContent(t, "test_assets/d.gitops.secret.enc.yml", "targetType: k8s\ndata:\n  foo: foo\n")
+	err = ResolveReferences([]*Secret{c}, []*Secret{c})
+	assert.EqualError(t, err, "secret 'test_assets/c.gitops.secret.enc.yml' references unknown secret 'default/d'")
+	err = ResolveReferences([]*Secret{c, d}, []*Secret{c, d})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "test_assets/c.gitops.secret.enc.yml:3:")
+	assert.Contains(t, err.Error(), "secret 'default/d' (test_assets/d.gitops.secret.enc.yml) has no key 'bar'")
+}
+
+func TestResolveReferencesOutsideDirectoryLimit(t *testing.T) {
+	app := &cli.App{Flags: []cli.Flag{&cli.StringFlag{Name: "dir"}}}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	assert.NoError(t, app.Flags[0].Apply(flags))
+	assert.NoError(t, flags.Parse([]string{"--dir", "test_assets/references/app"}))
+	util.SetCliContext(cli.NewContext(app, flags, nil))
+	defer util.SetCliContext(util.GetDummyCliContext())
+
+	// the referenced secret takes its password from a values file outside of the directory limit
+	secrets, err := LoadLocalSecretsLimited(SecretTargetTypeKubernetes, "test_assets/references/app", "")
+	assert.NoError(t, err)
+	assert.Len(t, secrets, 1)
+	assert.Equal(t, "reference-app", secrets[0].Name)
+	assert.Equal(t, "password-from-db-values", secrets[0].Data["password"])
+}
+
+func TestGenerators(t *testing.T) {
+	secret := secretFromContent(t, "test_assets/generated.gitops.secret.enc.yml", `targetType: k8s
+name: generated
+data:
+  existing: foo
+generate:
+  existing:
+    type: random
+  password:
+    type: random
+    length: 24
+    charset: hex
+  deploy-key:
+    type: ed25519
+  tls:
+    type: tls
+    commonName: example.com
+`)
+
+	assert.Equal(t, "foo", secret.Data["existing"])
+	assert.Len(t, secret.Data["password"], 24)
+	assert.Regexp(t, "^[0-9a-f]{24}$", secret.Data["password"])
+	assert.Contains(t, secret.Data["deploy-key"], "BEGIN PRIVATE KEY")
+	assert.Contains(t, secret.Data["deploy-key.pub"], "BEGIN PUBLIC KEY")
+	assert.Contains(t, secret.Data["tls.crt"], "BEGIN CERTIFICATE")
+	assert.Contains(t, secret.Data["tls.key"], "BEGIN PRIVATE KEY")
+	assert.True(t, secret.HasPendingGeneratedData())
+	assert.NotContains(t, secret.generated, "existing")
+
+	// rendering again keeps the generated values
+	password := secret.Data["password"]
+	err := secret.render(secret.collectReference)
+	assert.NoError(t, err)
+	assert.Equal(t, password, secret.Data["password"])
+
+	secret.AdoptRemoteGeneratedData(&Secret{
+		Data: map[string]string{"password": "remote-password"},
+	})
+	assert.Equal(t, "remote-password", secret.Data["password"])
+	assert.Equal(t, "remote-password", secret.generated["password"])
+
+	partial := &Secret{
+		Path:             "test_assets/partial.gitops.secret.enc.yml",
+		decryptedContent: []byte("targetType: k8s\ndata:\n  tls.crt: foo\ngenerate:\n  tls:\n    type: tls\n"),
+	}
+	assert.Error(t, partial.render(partial.collectReference))
+}
+
+func TestLoadDotenvSecret(t *testing.T) {
+	secret := Secret{
+		Path: filepath.Join("test_assets", "dotenv-secret.gitops.secret.enc.env"),
+	}
+	err := secret.Load()
+	assert.NoError(t, err)
+
+	assert.Equal(t, SecretTargetTypeKubernetes, secret.TargetType)
+	assert.Equal(t, "dotenv-secret", secret.Name)
+	assert.Equal(t, "dotenv", secret.Namespace)
+	assert.Equal(t, "Opaque", secret.Type)
+	assert.Equal(t, map[string]string{
+		"DATABASE_USER": "my-very-strong-username",
+		"API_KEY":       "my-api-key",
+	}, secret.Data)
+}
+
+func TestLoadJsonSecret(t *testing.T) {
+	secret := Secret{
+		Path: filepath.Join("test_assets", "json-secret.gitops.secret.enc.json"),
+	}
+	err := secret.Load()
+	assert.NoError(t, err)
+
+	assert.Equal(t, SecretTargetTypeKubernetes, secret.TargetType)
+	assert.Equal(t, "my-json-secret", secret.Name)
+	assert.Equal(t, "json", secret.Namespace)
+	assert.Equal(t, map[string]string{
+		"token":  "my-token",
+		"config": `{"port":8080}`,
+	}, secret.Data)
+
+	redacted, err := secret.RedactedContent()
+	assert.NoError(t, err)
+	assert.Contains(t, string(redacted), `"token": "********"`)
+}
+
+func TestParseMetadataHeader(t *testing.T) {
+	header := parseMetadataHeader([]byte("# gitops: targetType: k8s\n# some comment\n# gitops: name: foo\nKEY=value\n# gitops: namespace: ignored\n"))
+	assert.Equal(t, "targetType: k8s\nname: foo", header)
+}
+
+func TestLoadMultiDocumentSecretFile(t *testing.T) {
+	f := filepath.Join("test_assets", "multi-document.gitops.secret.enc.yml")
+	secrets, err := LoadFromPath(f)
+	assert.NoError(t, err)
+	assert.Len(t, secrets, 2)
+
+	assert.Equal(t, "default/multi-a", secrets[0].Document)
+	assert.Equal(t, f+"#default/multi-a", secrets[0].StateKey())
+	assert.Equal(t, map[string]string{"foo": "dev"}, secrets[0].Data)
+	assert.Equal(t, "other/multi-b", secrets[1].Document)
+	assert.Equal(t, map[string]string{"bar": "baz"}, secrets[1].Data)
+	assert.NotEqual(t, secrets[0].BinaryDataHash, secrets[1].BinaryDataHash)
+
+	_, err = FromPath(f)
+	assert.Error(t, err)
+
+	secret, err := FromPath(f + "#other/multi-b")
+	assert.NoError(t, err)
+	assert.Equal(t, "multi-b", secret.Name)
+
+	single, err := FromPath(filepath.Join("test_assets", "my-secret-name.gitops.secret.enc.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", single.Document)
+	assert.Equal(t, single.Path, single.StateKey())
+}
+
+func TestPersistGeneratedDataDocument(t *testing.T) {
+	// a disabled conditional document and an empty document precede the generating document
+	f := filepath.Join("test_assets", "generated-multi-document.gitops.secret.enc.yml")
+	secrets, err := LoadFromPath(f)
+	assert.NoError(t, err)
+	assert.Len(t, secrets, 2)
+	generated := secrets[1]
+	assert.Equal(t, "generated", generated.Name)
+	assert.True(t, generated.HasPendingGeneratedData())
+
+	rootDir, _ := util.GetGitRepoRoot()
+	content, err := os.ReadFile(filepath.Join(rootDir, f))
+	assert.NoError(t, err)
+	filePath := filepath.Join(t.TempDir(), "generated-multi-document.gitops.secret.enc.yml")
+	assert.NoError(t, os.WriteFile(filePath, content, 0600))
+
+	err = util.AddEncryptedFileValues(filePath, generated.isSourceDocument, "data", generated.generated)
+	assert.NoError(t, err)
+	decrypted, err := util.DecryptFile(filePath)
+	assert.NoError(t, err)
+	documents := strings.Split(string(decrypted), "\n---\n")
+	assert.Len(t, documents, 4)
+	assert.NotContains(t, documents[1], "password")
+	assert.Contains(t, documents[3], "password: "+generated.Data["password"])
+
+	// a document that cannot be told apart from another one is not written to
+	err = util.AddEncryptedFileValues(filePath, func(document map[string]interface{}) bool { return document["targetType"] == "k8s" }, "data", generated.generated)
+	assert.ErrorContains(t, err, "3 documents")
+}
+
+func TestSplitDocuments(t *testing.T) {
+	documents := splitDocuments([]byte("---\nname: a\n---\n\n---\nname: b\ndata:\n  foo: bar\n"))
+	assert.Len(t, documents, 2)
+	assert.Equal(t, "name: a", string(documents[0].content))
+	assert.Equal(t, 2, documents[0].line)
+	assert.Equal(t, "name: b\ndata:\n  foo: bar\n", string(documents[1].content))
+	assert.Equal(t, 6, documents[1].line)
+
+	documents = splitDocuments([]byte("name: a\n---\n# \n\n---\n{}\n---\nname: b\n"))
+	assert.Len(t, documents, 2)
+	assert.Equal(t, 8, documents[1].line)
+}
+
+func TestSecretExpiries(t *testing.T) {
+	certificate, key, err := generateSelfSignedCertificate("my-app", []string{"my-app"}, 10*24*time.Hour)
+	assert.NoError(t, err)
+
+	expires := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	secret := &Secret{
+		Type:        "kubernetes.io/tls",
+		Data:        map[string]string{"tls.crt": certificate, "tls.key": key},
+		Expires:     expires,
+		RotateAfter: 90 * 24 * time.Hour,
+	}
+
+	lastModified := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	expiries := secret.GetExpiries(lastModified)
+	assert.Len(t, expiries, 3)
+	assert.Equal(t, ExpiryReasonExpires, expiries[0].Reason)
+	assert.Equal(t, expires, expiries[0].Date)
+	assert.Equal(t, ExpiryReasonCertificate, expiries[1].Reason)
+	assert.WithinDuration(t, time.Now().Add(10*24*time.Hour), expiries[1].Date, time.Minute)
+	assert.Equal(t, ExpiryReasonRotateAfter, expiries[2].Reason)
+	assert.Equal(t, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), expiries[2].Date)
+
+	assert.True(t, expiries[2].Expired(time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, expiries[1].Expired(time.Now()))
+
+	// material expiries do not include the rotation
+	assert.Len(t, secret.GetMaterialExpiries(), 2)
+}
+
+func TestSecretDataHash(t *testing.T) {
+	secret := &Secret{Type: "Opaque", Data: map[string]string{"user": "admin", "password": "secret"}}
+	same := &Secret{Type: "Opaque", Data: map[string]string{"password": "secret", "user": "admin"}, ResourceVersion: "1"}
+	assert.Equal(t, secret.DataHash(), same.DataHash())
+
+	changed := &Secret{Type: "Opaque", Data: map[string]string{"user": "admin", "password": "changed"}}
+	assert.NotEqual(t, secret.DataHash(), changed.DataHash())
+	configMap := &Secret{Type: "ConfigMap", Data: map[string]string{"user": "admin", "password": "secret"}}
+	assert.NotEqual(t, secret.DataHash(), configMap.DataHash())
+}
+
+func TestDiffRevisions(t *testing.T) {
+	oldSecrets := []*Secret{
+		{TargetType: SecretTargetTypeKubernetes, Target: "prod", Name: "app", Namespace: "default", Type: "Opaque", Path: "apps/app.gitops.secret.enc.yaml", Data: map[string]string{"password": "old"}},
+		{TargetType: SecretTargetTypeKubernetes, Target: "prod", Name: "moved", Namespace: "default", Type: "Opaque", Path: "apps/moved.gitops.secret.enc.yaml", Data: map[string]string{"token": "secret"}},
+		{TargetType: SecretTargetTypeKubernetes, Target: "prod", Name: "legacy", Namespace: "default", Type: "Opaque", Path: "apps/legacy.gitops.secret.enc.yaml", Data: map[string]string{"token": "secret"}},
+	}
+	newSecrets := []*Secret{
+		{TargetType: SecretTargetTypeKubernetes, Target: "prod", Name: "app", Namespace: "default", Type: "Opaque", Path: "apps/app.gitops.secret.enc.yaml", Data: map[string]string{"password": "new"}},
+		{TargetType: SecretTargetTypeKubernetes, Target: "prod", Name: "moved", Namespace: "default", Type: "Opaque", Path: "apps/renamed.gitops.secret.enc.yaml", Data: map[string]string{"token": "secret"}},
+		{TargetType: SecretTargetTypeKubernetes, Target: "staging", Name: "app", Namespace: "default", Type: "Opaque", Path: "apps/app.gitops.secret.enc.yaml", Data: map[string]string{"password": "new"}},
+	}
+
+	diffs := DiffRevisions(oldSecrets, newSecrets)
+	assert.Len(t, diffs, 4)
+
+	assert.Equal(t, "app", diffs[0].Secret().Name)
+	assert.Equal(t, SecretDiffTypeChanged, diffs[0].Diff.Type)
+	assert.Equal(t, SecretDiffTypeChanged, diffs[0].Diff.GetEntry("data.password").Type)
+
+	assert.Equal(t, "legacy", diffs[1].Secret().Name)
+	assert.Equal(t, SecretDiffTypeRemoved, diffs[1].Diff.Type)
+	assert.Nil(t, diffs[1].New)
+
+	// secrets moved to another file are matched by their target object
+	assert.Equal(t, "apps/renamed.gitops.secret.enc.yaml", diffs[2].Secret().Path)
+	assert.True(t, diffs[2].Diff.Equal)
+
+	assert.Equal(t, "staging", diffs[3].Secret().Target)
+	assert.Equal(t, SecretDiffTypeAdded, diffs[3].Diff.Type)
+}
@@ -0,0 +1,111 @@
+package secret
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/templating"
+	"github.com/mxcd/gitops-cli/internal/util"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Renders the selected secrets with their resolved values and prints them
+together with the values files that contributed to them
+Usage: gitops secrets template [path]
+*/
+func TemplateCommand(c *cli.Context) error {
+	pathLimit := c.Args().First()
+	if pathLimit == "" {
+		pathLimit = c.String("dir")
+	}
+
+	secrets, err := LoadLocalSecretsLimited(SecretTargetTypeAll, pathLimit, "")
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return fmt.Errorf("no secret files found for path '%s'", pathLimit)
+	}
+
+	cleartext := c.Bool("cleartext")
+	for _, secret := range secrets {
+		err = secret.PrintTemplated(cleartext)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Secret) PrintTemplated(cleartext bool) error {
+	println("---")
+	println(color.InBold("# " + s.StateKey()))
+	if s.Environment != "" {
+		println(color.InGray("# environment: " + s.Environment))
+	}
+
+	chain := templating.GetValuesChainForPath(s.Path, s.Environment)
+	if len(chain) == 0 {
+		println(color.InGray("# no values files"))
+	} else {
+		println(color.InGray("# values files (in merge order):"))
+		for _, templateValue := range chain {
+			println(color.InGray("#   " + templateValue.File))
+		}
+
+		sources := templating.GetValueSourcesForPath(s.Path, s.Environment)
+		keys := make([]string, 0, len(sources))
+		for key := range sources {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		println(color.InGray("# values:"))
+		for _, key := range keys {
+			println(color.InGray(fmt.Sprintf("#   .Values.%s <= %s", key, sources[key])))
+		}
+	}
+
+	content := s.BinaryData
+	if !cleartext {
+		redactedContent, err := s.RedactedContent()
+		if err != nil {
+			return err
+		}
+		content = redactedContent
+	}
+	println(strings.TrimSuffix(string(content), "\n"))
+	return nil
+}
+
+/*
+Returns the rendered secret file with all data values redacted
+*/
+func (s *Secret) RedactedContent() ([]byte, error) {
+	format := util.GetSecretFileFormat(s.Path)
+	if format != util.FileFormatYaml {
+		return s.redactedData(format)
+	}
+
+	var content yaml.MapSlice
+	err := yaml.Unmarshal(s.BinaryData, &content)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range content {
+		if item.Key != "data" {
+			continue
+		}
+		data, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		for i := range data {
+			data[i].Value = util.ToRedactedString(fmt.Sprintf("%v", data[i].Value))
+		}
+	}
+	return yaml.Marshal(content)
+}
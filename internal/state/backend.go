@@ -0,0 +1,118 @@
+package state
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/TwiN/go-color"
+	"github.com/urfave/cli/v2"
+)
+
+const defaultStateFile = ".gitops-state.yaml"
+
+/*
+Storage of the serialized state
+Backends detect concurrent modifications: Write fails with a StateConflictError
+if the stored state was changed since it was last read by the backend
+*/
+type StateBackend interface {
+	// Reads the serialized state, returns nil if there is no state yet
+	Read() ([]byte, error)
+	// Writes the serialized state
+	Write(content []byte) error
+	// Writes a copy of a serialized state next to the state, returns the location of the copy
+	Backup(content []byte, suffix string) (string, error)
+	// Store of the state lock next to the state
+	LockStore() LockStore
+	// Location of the state for display
+	String() string
+}
+
+type StateConflictError struct {
+	Backend StateBackend
+}
+
+func (e *StateConflictError) Error() string {
+	return fmt.Sprintf("state in %s was changed by another run since it was loaded, run the command again", e.Backend)
+}
+
+/*
+Creates the state backend for the given url:
+
+	.gitops-state.yaml or file://.gitops-state.yaml (default): file relative to the root dir
+	kubernetes://[cluster]/<namespace>/<configmap|secret>/<name>: ConfigMap or Secret in a cluster
+	s3://<bucket>/<key>[?endpoint=<url>&region=<region>&pathStyle=true]: object in an S3-compatible store
+*/
+func NewStateBackend(backendUrl string) (StateBackend, error) {
+	if backendUrl == "" {
+		return NewFileBackend(defaultStateFile), nil
+	}
+	if !strings.Contains(backendUrl, "://") {
+		return NewFileBackend(backendUrl), nil
+	}
+
+	parsedUrl, err := url.Parse(backendUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state backend '%s': %w", backendUrl, err)
+	}
+	switch parsedUrl.Scheme {
+	case "file":
+		return NewFileBackend(parsedUrl.Host + parsedUrl.Path), nil
+	case "kubernetes", "k8s":
+		return newKubernetesBackendFromUrl(parsedUrl)
+	case "s3":
+		return newS3BackendFromUrl(parsedUrl)
+	default:
+		return nil, fmt.Errorf("unknown state backend '%s', supported are file, kubernetes and s3", parsedUrl.Scheme)
+	}
+}
+
+/*
+Copies the state from one backend to another
+The target backend must not hold a state unless force is set
+*/
+func MigrateState(from StateBackend, to StateBackend, force bool) error {
+	content, err := from.Read()
+	if err != nil {
+		return err
+	}
+	if content == nil {
+		return fmt.Errorf("there is no state in %s", from)
+	}
+	existing, err := to.Read()
+	if err != nil {
+		return err
+	}
+	if existing != nil && !force {
+		return fmt.Errorf("%s already holds a state, use --force to overwrite it", to)
+	}
+	return to.Write(content)
+}
+
+/*
+Copies the state of the configured backend to the backend given by --to
+Usage: gitops state migrate --to kubernetes://prod/gitops/configmap/gitops-state
+*/
+func MigrateCommand(c *cli.Context) error {
+	from, err := NewStateBackend(c.String("state-backend"))
+	if err != nil {
+		return err
+	}
+	to, err := NewStateBackend(c.String("to"))
+	if err != nil {
+		return err
+	}
+	if from.String() == to.String() {
+		return fmt.Errorf("the state is already stored in %s", to)
+	}
+
+	err = MigrateState(from, to, c.Bool("force"))
+	if err != nil {
+		return err
+	}
+	println(color.InGreen("Copied state from "+from.String()+" to "), color.InBold(to.String()))
+	println("Set", color.InBold("--state-backend "+c.String("to")), "(or state-backend in the defaults of .gitops.yaml) to use the new state.")
+	println("The state in", from.String(), "was not removed.")
+	return nil
+}
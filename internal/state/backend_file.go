@@ -0,0 +1,183 @@
+package state
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/andybalholm/crlf"
+	"github.com/google/uuid"
+	"github.com/mxcd/gitops-cli/internal/util"
+)
+
+/*
+State stored in a file in the repository, the default backend
+*/
+type FileBackend struct {
+	// File path relative to the root dir
+	File string
+	// hash of the content last read or written, nil if the file did not exist
+	hash []byte
+	read bool
+}
+
+func NewFileBackend(file string) *FileBackend {
+	return &FileBackend{File: file}
+}
+
+func (b *FileBackend) path() string {
+	if path.IsAbs(b.File) {
+		return b.File
+	}
+	return path.Join(util.GetRootDir(), b.File)
+}
+
+func (b *FileBackend) String() string {
+	return b.File
+}
+
+func (b *FileBackend) Read() ([]byte, error) {
+	content, err := b.readFile()
+	if err != nil {
+		return nil, err
+	}
+	b.read = true
+	b.hash = hashContent(content)
+	return content, nil
+}
+
+func (b *FileBackend) readFile() ([]byte, error) {
+	stats, err := os.Stat(b.path())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stats.IsDir() {
+		return nil, fmt.Errorf("state file %s is a directory", b.File)
+	}
+	stateFile, err := os.Open(b.path())
+	if err != nil {
+		return nil, err
+	}
+	defer stateFile.Close()
+	return io.ReadAll(crlf.NewReader(stateFile))
+}
+
+func (b *FileBackend) Write(content []byte) error {
+	if b.read {
+		current, err := b.readFile()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hashContent(current), b.hash) {
+			return &StateConflictError{Backend: b}
+		}
+	}
+
+	stateFile, err := os.Create(b.path())
+	if err != nil {
+		return err
+	}
+	_, err = crlf.NewWriter(stateFile).Write(content)
+	closeErr := stateFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	b.read = true
+	b.hash = hashContent(content)
+	return nil
+}
+
+func (b *FileBackend) Backup(content []byte, suffix string) (string, error) {
+	backupFile := b.File + "." + suffix + ".backup"
+	backup := &FileBackend{File: backupFile}
+	return backupFile, os.WriteFile(backup.path(), content, 0644)
+}
+
+/*
+The lock is the file .gitops-state.lock in the directory of the state file
+*/
+func (b *FileBackend) LockStore() LockStore {
+	return &fileLockStore{file: path.Join(path.Dir(b.path()), lockFileName)}
+}
+
+type fileLockStore struct {
+	file string
+}
+
+func (s *fileLockStore) Create(content []byte) (bool, error) {
+	file, err := os.OpenFile(s.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = file.Write(content)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(s.file)
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *fileLockStore) Read() ([]byte, string, error) {
+	content, err := os.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return content, fmt.Sprintf("%x", hashContent(content)), nil
+}
+
+func (s *fileLockStore) Remove(version string) (bool, error) {
+	// the lock is moved aside before it is checked, so that a lock taken by another run in the meantime is never removed
+	claimed := s.file + "." + uuid.New().String()
+	err := os.Rename(s.file, claimed)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(claimed)
+	content, err := os.ReadFile(claimed)
+	if err != nil {
+		return false, err
+	}
+	if fmt.Sprintf("%x", hashContent(content)) == version {
+		return true, nil
+	}
+	// the lock was replaced by another run, it is put back unless yet another run took the lock in the meantime
+	err = os.Link(claimed, s.file)
+	if err != nil && !os.IsExist(err) {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *fileLockStore) String() string {
+	return s.file
+}
+
+func hashContent(content []byte) []byte {
+	if content == nil {
+		return nil
+	}
+	hash := sha256.Sum256(content)
+	return hash[:]
+}
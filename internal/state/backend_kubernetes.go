@@ -0,0 +1,285 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/mxcd/gitops-cli/internal/util"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	KubernetesBackendConfigMap = "configmap"
+	KubernetesBackendSecret    = "secret"
+	kubernetesStateKey         = "state.yaml"
+	kubernetesLockKey          = "lock.yaml"
+)
+
+/*
+State stored in a ConfigMap or Secret of a cluster
+Concurrent modifications are detected by the resourceVersion of the object
+*/
+type KubernetesBackend struct {
+	// Cluster of the repository config, empty for the cluster of the KUBECONFIG
+	Cluster   string
+	Namespace string
+	// Kind of the object, configmap or secret
+	Kind string
+	Name string
+
+	client kubernetes.Interface
+	// resourceVersion of the object last read or written, empty if it did not exist
+	resourceVersion string
+}
+
+// creates the client for a cluster of the repository config, replaced in tests
+var newKubernetesStateClient = func(cluster string) (kubernetes.Interface, error) {
+	var config clientcmd.ClientConfig
+	if cluster == "" {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		if kubeconfig := util.GetCliContext().String("kubeconfig"); kubeconfig != "" {
+			loadingRules.ExplicitPath = kubeconfig
+		}
+		config = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{})
+	} else {
+		repoConfig, err := util.GetRepoConfig()
+		if err != nil {
+			return nil, err
+		}
+		clusterConfig, ok := repoConfig.Clusters[cluster]
+		if !ok {
+			return nil, fmt.Errorf("cluster '%s' of the state backend is not configured in the clusters of .gitops.yaml", cluster)
+		}
+		kubeconfig, err := util.ReadKubeconfig(clusterConfig.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		config, err = clientcmd.NewClientConfigFromBytes(kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+func newKubernetesBackendFromUrl(backendUrl *url.URL) (*KubernetesBackend, error) {
+	parts := strings.Split(strings.Trim(backendUrl.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid kubernetes state backend '%s', expected kubernetes://[cluster]/<namespace>/<configmap|secret>/<name>", backendUrl)
+	}
+	kind := strings.ToLower(parts[1])
+	if kind != KubernetesBackendConfigMap && kind != KubernetesBackendSecret {
+		return nil, fmt.Errorf("invalid kubernetes state backend '%s', kind must be configmap or secret", backendUrl)
+	}
+	return &KubernetesBackend{
+		Cluster:   backendUrl.Host,
+		Namespace: parts[0],
+		Kind:      kind,
+		Name:      parts[2],
+	}, nil
+}
+
+func (b *KubernetesBackend) String() string {
+	return fmt.Sprintf("kubernetes://%s/%s/%s/%s", b.Cluster, b.Namespace, b.Kind, b.Name)
+}
+
+func (b *KubernetesBackend) getClient() (kubernetes.Interface, error) {
+	if b.client != nil {
+		return b.client, nil
+	}
+	client, err := newKubernetesStateClient(b.Cluster)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for state backend %s: %w", b, err)
+	}
+	b.client = client
+	return client, nil
+}
+
+func (b *KubernetesBackend) Read() ([]byte, error) {
+	client, err := b.getClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+
+	var content []byte
+	var exists bool
+	if b.Kind == KubernetesBackendSecret {
+		object, err := client.CoreV1().Secrets(b.Namespace).Get(ctx, b.Name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			b.resourceVersion = ""
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		b.resourceVersion = object.ResourceVersion
+		content, exists = object.Data[kubernetesStateKey]
+	} else {
+		object, err := client.CoreV1().ConfigMaps(b.Namespace).Get(ctx, b.Name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			b.resourceVersion = ""
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		b.resourceVersion = object.ResourceVersion
+		var data string
+		data, exists = object.Data[kubernetesStateKey]
+		content = []byte(data)
+	}
+	if !exists {
+		return nil, nil
+	}
+	return content, nil
+}
+
+func (b *KubernetesBackend) Write(content []byte) error {
+	client, err := b.getClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	objectMeta := metav1.ObjectMeta{
+		Name:            b.Name,
+		Namespace:       b.Namespace,
+		ResourceVersion: b.resourceVersion,
+		Labels: map[string]string{
+			"app.kubernetes.io/managed-by": "gitops-cli",
+		},
+	}
+
+	var resourceVersion string
+	if b.Kind == KubernetesBackendSecret {
+		object := &corev1.Secret{
+			ObjectMeta: objectMeta,
+			Type:       corev1.SecretTypeOpaque,
+			Data:       map[string][]byte{kubernetesStateKey: content},
+		}
+		if b.resourceVersion == "" {
+			object, err = client.CoreV1().Secrets(b.Namespace).Create(ctx, object, metav1.CreateOptions{})
+		} else {
+			object, err = client.CoreV1().Secrets(b.Namespace).Update(ctx, object, metav1.UpdateOptions{})
+		}
+		if err == nil {
+			resourceVersion = object.ResourceVersion
+		}
+	} else {
+		object := &corev1.ConfigMap{
+			ObjectMeta: objectMeta,
+			Data:       map[string]string{kubernetesStateKey: string(content)},
+		}
+		if b.resourceVersion == "" {
+			object, err = client.CoreV1().ConfigMaps(b.Namespace).Create(ctx, object, metav1.CreateOptions{})
+		} else {
+			object, err = client.CoreV1().ConfigMaps(b.Namespace).Update(ctx, object, metav1.UpdateOptions{})
+		}
+		if err == nil {
+			resourceVersion = object.ResourceVersion
+		}
+	}
+	if k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err) {
+		return &StateConflictError{Backend: b}
+	}
+	if err != nil {
+		return err
+	}
+	log.Debug("Saved state to ", b, " with resourceVersion ", resourceVersion)
+	b.resourceVersion = resourceVersion
+	return nil
+}
+
+func (b *KubernetesBackend) Backup(content []byte, suffix string) (string, error) {
+	backup := &KubernetesBackend{
+		Cluster:   b.Cluster,
+		Namespace: b.Namespace,
+		Kind:      b.Kind,
+		Name:      b.Name + "-" + suffix + "-backup",
+		client:    b.client,
+	}
+	// an existing backup is overwritten
+	_, err := backup.Read()
+	if err != nil {
+		return "", err
+	}
+	return backup.String(), backup.Write(content)
+}
+
+/*
+The lock is the ConfigMap <name>-lock next to the state object, creating it fails if it exists
+The lock holds no secrets, so it is a ConfigMap for Secret states as well
+*/
+func (b *KubernetesBackend) LockStore() LockStore {
+	return &kubernetesLockStore{backend: b, name: b.Name + "-lock"}
+}
+
+type kubernetesLockStore struct {
+	backend *KubernetesBackend
+	name    string
+}
+
+func (s *kubernetesLockStore) Create(content []byte) (bool, error) {
+	client, err := s.backend.getClient()
+	if err != nil {
+		return false, err
+	}
+	_, err = client.CoreV1().ConfigMaps(s.backend.Namespace).Create(context.Background(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.name,
+			Namespace: s.backend.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "gitops-cli",
+			},
+		},
+		Data: map[string]string{kubernetesLockKey: string(content)},
+	}, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *kubernetesLockStore) Read() ([]byte, string, error) {
+	client, err := s.backend.getClient()
+	if err != nil {
+		return nil, "", err
+	}
+	object, err := client.CoreV1().ConfigMaps(s.backend.Namespace).Get(context.Background(), s.name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(object.Data[kubernetesLockKey]), object.ResourceVersion, nil
+}
+
+func (s *kubernetesLockStore) Remove(version string) (bool, error) {
+	client, err := s.backend.getClient()
+	if err != nil {
+		return false, err
+	}
+	err = client.CoreV1().ConfigMaps(s.backend.Namespace).Delete(context.Background(), s.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &version},
+	})
+	if k8serrors.IsNotFound(err) || k8serrors.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *kubernetesLockStore) String() string {
+	return fmt.Sprintf("kubernetes://%s/%s/configmap/%s", s.backend.Cluster, s.backend.Namespace, s.name)
+}
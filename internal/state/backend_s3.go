@@ -0,0 +1,235 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultS3Region = "us-east-1"
+
+/*
+State stored as object in an S3-compatible object store
+Credentials are taken from the environment (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_PROFILE)
+Concurrent modifications are detected by conditional writes on the ETag of the object
+*/
+type S3Backend struct {
+	Bucket string
+	Key    string
+	// Endpoint of an S3-compatible store, empty for AWS
+	Endpoint string
+	Region   string
+	// Use path style addressing, required by most S3-compatible stores
+	PathStyle bool
+
+	client *s3.S3
+	// ETag of the object last read or written, empty if it did not exist
+	etag string
+}
+
+func newS3BackendFromUrl(backendUrl *url.URL) (*S3Backend, error) {
+	key := strings.TrimPrefix(backendUrl.Path, "/")
+	if backendUrl.Host == "" || key == "" {
+		return nil, fmt.Errorf("invalid s3 state backend '%s', expected s3://<bucket>/<key>", backendUrl)
+	}
+	query := backendUrl.Query()
+	backend := &S3Backend{
+		Bucket:    backendUrl.Host,
+		Key:       key,
+		Endpoint:  query.Get("endpoint"),
+		Region:    query.Get("region"),
+		PathStyle: query.Get("pathStyle") == "true",
+	}
+	if backend.Region == "" {
+		backend.Region = os.Getenv("AWS_REGION")
+	}
+	if backend.Region == "" {
+		backend.Region = defaultS3Region
+	}
+	return backend, nil
+}
+
+func (b *S3Backend) String() string {
+	return fmt.Sprintf("s3://%s/%s", b.Bucket, b.Key)
+}
+
+func (b *S3Backend) getClient() (*s3.S3, error) {
+	if b.client != nil {
+		return b.client, nil
+	}
+	config := aws.NewConfig().
+		WithRegion(b.Region).
+		WithS3ForcePathStyle(b.PathStyle)
+	if b.Endpoint != "" {
+		config = config.WithEndpoint(b.Endpoint)
+	}
+	awsSession, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for state backend %s: %w", b, err)
+	}
+	b.client = s3.New(awsSession)
+	return b.client, nil
+}
+
+func (b *S3Backend) Read() ([]byte, error) {
+	client, err := b.getClient()
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(b.Key),
+	})
+	if isS3StatusCode(err, http.StatusNotFound) {
+		b.etag = ""
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state from %s: %w", b, err)
+	}
+	defer output.Body.Close()
+	content, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	b.etag = aws.StringValue(output.ETag)
+	return content, nil
+}
+
+func (b *S3Backend) Write(content []byte) error {
+	client, err := b.getClient()
+	if err != nil {
+		return err
+	}
+	request, output := client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(b.Bucket),
+		Key:         aws.String(b.Key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/yaml"),
+	})
+	if b.etag == "" {
+		request.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		request.HTTPRequest.Header.Set("If-Match", b.etag)
+	}
+	err = request.Send()
+	if isS3StatusCode(err, http.StatusPreconditionFailed) || isS3StatusCode(err, http.StatusConflict) {
+		return &StateConflictError{Backend: b}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write state to %s: %w", b, err)
+	}
+	log.Debug("Saved state to ", b, " with ETag ", aws.StringValue(output.ETag))
+	b.etag = aws.StringValue(output.ETag)
+	return nil
+}
+
+func (b *S3Backend) Backup(content []byte, suffix string) (string, error) {
+	client, err := b.getClient()
+	if err != nil {
+		return "", err
+	}
+	backup := &S3Backend{Bucket: b.Bucket, Key: b.Key + "." + suffix + ".backup"}
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(backup.Bucket),
+		Key:         aws.String(backup.Key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/yaml"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to write state backup to %s: %w", backup, err)
+	}
+	return backup.String(), nil
+}
+
+/*
+The lock is the object <key>.lock next to the state, it is only created if it does not exist (If-None-Match)
+*/
+func (b *S3Backend) LockStore() LockStore {
+	return &s3LockStore{backend: b, key: b.Key + ".lock"}
+}
+
+type s3LockStore struct {
+	backend *S3Backend
+	key     string
+}
+
+func (s *s3LockStore) Create(content []byte) (bool, error) {
+	client, err := s.backend.getClient()
+	if err != nil {
+		return false, err
+	}
+	request, _ := client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(s.backend.Bucket),
+		Key:         aws.String(s.key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/yaml"),
+	})
+	request.HTTPRequest.Header.Set("If-None-Match", "*")
+	err = request.Send()
+	if isS3StatusCode(err, http.StatusPreconditionFailed) || isS3StatusCode(err, http.StatusConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *s3LockStore) Read() ([]byte, string, error) {
+	client, err := s.backend.getClient()
+	if err != nil {
+		return nil, "", err
+	}
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.backend.Bucket),
+		Key:    aws.String(s.key),
+	})
+	if isS3StatusCode(err, http.StatusNotFound) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Body.Close()
+	content, err := io.ReadAll(output.Body)
+	return content, aws.StringValue(output.ETag), err
+}
+
+func (s *s3LockStore) Remove(version string) (bool, error) {
+	client, err := s.backend.getClient()
+	if err != nil {
+		return false, err
+	}
+	request, _ := client.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.backend.Bucket),
+		Key:    aws.String(s.key),
+	})
+	request.HTTPRequest.Header.Set("If-Match", version)
+	err = request.Send()
+	if isS3StatusCode(err, http.StatusPreconditionFailed) || isS3StatusCode(err, http.StatusNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *s3LockStore) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.backend.Bucket, s.key)
+}
+
+func isS3StatusCode(err error, statusCode int) bool {
+	if requestFailure, ok := err.(awserr.RequestFailure); ok {
+		return requestFailure.StatusCode() == statusCode
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+package state
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNewStateBackend(t *testing.T) {
+	backend, err := NewStateBackend("")
+	assert.NoError(t, err)
+	assert.Equal(t, NewFileBackend(".gitops-state.yaml"), backend)
+
+	backend, err = NewStateBackend("state/gitops.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, NewFileBackend("state/gitops.yaml"), backend)
+
+	backend, err = NewStateBackend("kubernetes://prod/gitops/configmap/gitops-state")
+	assert.NoError(t, err)
+	assert.Equal(t, &KubernetesBackend{Cluster: "prod", Namespace: "gitops", Kind: KubernetesBackendConfigMap, Name: "gitops-state"}, backend)
+	assert.Equal(t, "kubernetes://prod/gitops/configmap/gitops-state", backend.String())
+
+	backend, err = NewStateBackend("k8s:///gitops/Secret/gitops-state")
+	assert.NoError(t, err)
+	assert.Equal(t, &KubernetesBackend{Namespace: "gitops", Kind: KubernetesBackendSecret, Name: "gitops-state"}, backend)
+
+	backend, err = NewStateBackend("s3://states/repo/gitops-state.yaml?endpoint=http://localhost:9000&region=eu-central-1&pathStyle=true")
+	assert.NoError(t, err)
+	assert.Equal(t, &S3Backend{Bucket: "states", Key: "repo/gitops-state.yaml", Endpoint: "http://localhost:9000", Region: "eu-central-1", PathStyle: true}, backend)
+
+	for _, invalid := range []string{
+		"kubernetes://prod/gitops/deployment/gitops-state",
+		"kubernetes://prod/gitops-state",
+		"s3://states",
+		"ftp://states/gitops-state.yaml",
+	} {
+		_, err = NewStateBackend(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".gitops-state.yaml")
+	backend := NewFileBackend(file)
+
+	content, err := backend.Read()
+	assert.NoError(t, err)
+	assert.Nil(t, content)
+	assert.NoError(t, backend.Write([]byte("secrets: []\n")))
+
+	otherRun := NewFileBackend(file)
+	content, err = otherRun.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "secrets: []\n", string(content))
+
+	assert.NoError(t, backend.Write([]byte("secrets: []\nclusters: {}\n")))
+	var conflict *StateConflictError
+	assert.ErrorAs(t, otherRun.Write([]byte("secrets: []\n")), &conflict)
+
+	assert.Equal(t, filepath.Join(filepath.Dir(file), lockFileName), backend.LockStore().String())
+}
+
+// fake clientset that assigns resource versions and rejects updates of outdated objects like the API server
+func newVersionedFakeClientset() *fake.Clientset {
+	clientset := fake.NewSimpleClientset()
+	mutex := sync.Mutex{}
+	version := 0
+	reactor := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		tracker := clientset.Tracker()
+		if deleteAction, ok := action.(k8stesting.DeleteAction); ok {
+			existing, err := tracker.Get(deleteAction.GetResource(), deleteAction.GetNamespace(), deleteAction.GetName())
+			if err != nil {
+				return true, nil, err
+			}
+			preconditions := deleteAction.GetDeleteOptions().Preconditions
+			if preconditions != nil && preconditions.ResourceVersion != nil && *preconditions.ResourceVersion != existing.(*corev1.ConfigMap).ResourceVersion {
+				return true, nil, k8serrors.NewConflict(deleteAction.GetResource().GroupResource(), deleteAction.GetName(), fmt.Errorf("precondition failed"))
+			}
+			return true, nil, tracker.Delete(deleteAction.GetResource(), deleteAction.GetNamespace(), deleteAction.GetName())
+		}
+		a := action.(k8stesting.CreateAction)
+		object := a.GetObject().(*corev1.ConfigMap).DeepCopy()
+		switch action.GetVerb() {
+		case "create":
+			if _, err := tracker.Get(a.GetResource(), a.GetNamespace(), object.Name); err == nil {
+				return true, nil, k8serrors.NewAlreadyExists(a.GetResource().GroupResource(), object.Name)
+			}
+			version++
+			object.ResourceVersion = strconv.Itoa(version)
+			return true, object, tracker.Create(a.GetResource(), object, a.GetNamespace())
+		case "update":
+			existing, err := tracker.Get(a.GetResource(), a.GetNamespace(), object.Name)
+			if err != nil {
+				return true, nil, err
+			}
+			if existing.(*corev1.ConfigMap).ResourceVersion != object.ResourceVersion {
+				return true, nil, k8serrors.NewConflict(a.GetResource().GroupResource(), object.Name, fmt.Errorf("object has been modified"))
+			}
+			version++
+			object.ResourceVersion = strconv.Itoa(version)
+			return true, object, tracker.Update(a.GetResource(), object, a.GetNamespace())
+		}
+		return false, nil, nil
+	}
+	clientset.PrependReactor("create", "configmaps", reactor)
+	clientset.PrependReactor("update", "configmaps", reactor)
+	clientset.PrependReactor("delete", "configmaps", reactor)
+	return clientset
+}
+
+func TestKubernetesBackend(t *testing.T) {
+	clientset := newVersionedFakeClientset()
+	defaultClient := newKubernetesStateClient
+	newKubernetesStateClient = func(cluster string) (kubernetes.Interface, error) {
+		return clientset, nil
+	}
+	defer func() { newKubernetesStateClient = defaultClient }()
+
+	backend, err := NewStateBackend("kubernetes://prod/gitops/configmap/gitops-state")
+	assert.NoError(t, err)
+	content, err := backend.Read()
+	assert.NoError(t, err)
+	assert.Nil(t, content)
+	assert.NoError(t, backend.Write([]byte("secrets: []\n")))
+
+	otherRun, err := NewStateBackend("kubernetes://prod/gitops/configmap/gitops-state")
+	assert.NoError(t, err)
+	content, err = otherRun.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "secrets: []\n", string(content))
+
+	assert.NoError(t, backend.Write([]byte("secrets: []\nclusters: {}\n")))
+	var conflict *StateConflictError
+	assert.ErrorAs(t, otherRun.Write([]byte("secrets: []\n")), &conflict)
+
+	// a concurrent first write is rejected as well
+	firstRun, err := NewStateBackend("kubernetes://prod/gitops/configmap/other-state")
+	assert.NoError(t, err)
+	secondRun, err := NewStateBackend("kubernetes://prod/gitops/configmap/other-state")
+	assert.NoError(t, err)
+	_, err = firstRun.Read()
+	assert.NoError(t, err)
+	_, err = secondRun.Read()
+	assert.NoError(t, err)
+	assert.NoError(t, firstRun.Write([]byte("secrets: []\n")))
+	assert.ErrorAs(t, secondRun.Write([]byte("secrets: []\n")), &conflict)
+
+	// the lock is stored next to the state
+	assert.Equal(t, "kubernetes://prod/gitops/configmap/gitops-state-lock", backend.LockStore().String())
+	testLockStore(t, backend.LockStore())
+	testConcurrentStaleLock(t, backend.LockStore())
+}
+
+// minimal S3-compatible object store supporting conditional writes
+func newS3StandIn() *httptest.Server {
+	mutex := sync.Mutex{}
+	objects := map[string][]byte{}
+	etag := func(content []byte) string {
+		return fmt.Sprintf("\"%x\"", md5.Sum(content))
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		content, exists := objects[r.URL.Path]
+		switch r.Method {
+		case http.MethodGet:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+				return
+			}
+			w.Header().Set("ETag", etag(content))
+			w.Write(content)
+		case http.MethodPut:
+			if (r.Header.Get("If-None-Match") == "*" && exists) ||
+				(r.Header.Get("If-Match") != "" && (!exists || r.Header.Get("If-Match") != etag(content))) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				io.WriteString(w, "<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>")
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = body
+			w.Header().Set("ETag", etag(body))
+		case http.MethodDelete:
+			if r.Header.Get("If-Match") != "" && !exists {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+				return
+			}
+			if r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != etag(content) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				io.WriteString(w, "<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>")
+				return
+			}
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func TestS3Backend(t *testing.T) {
+	server := newS3StandIn()
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "gitops")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "gitops-secret")
+	backendUrl := "s3://states/repo/gitops-state.yaml?pathStyle=true&endpoint=" + server.URL
+
+	backend, err := NewStateBackend(backendUrl)
+	assert.NoError(t, err)
+	content, err := backend.Read()
+	assert.NoError(t, err)
+	assert.Nil(t, content)
+	assert.NoError(t, backend.Write([]byte("secrets: []\n")))
+
+	otherRun, err := NewStateBackend(backendUrl)
+	assert.NoError(t, err)
+	content, err = otherRun.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "secrets: []\n", string(content))
+
+	assert.NoError(t, backend.Write([]byte("secrets: []\nclusters: {}\n")))
+	var conflict *StateConflictError
+	assert.ErrorAs(t, otherRun.Write([]byte("secrets: []\n")), &conflict)
+
+	// the lock is stored next to the state
+	assert.Equal(t, "s3://states/repo/gitops-state.yaml.lock", backend.LockStore().String())
+	testLockStore(t, backend.LockStore())
+	testConcurrentStaleLock(t, backend.LockStore())
+}
+
+func TestMigrateState(t *testing.T) {
+	dir := t.TempDir()
+	from := NewFileBackend(filepath.Join(dir, "from.yaml"))
+	to := NewFileBackend(filepath.Join(dir, "to.yaml"))
+
+	assert.Error(t, MigrateState(from, to, false))
+
+	assert.NoError(t, from.Write([]byte("secrets: []\n")))
+	assert.NoError(t, MigrateState(from, to, false))
+	content, err := NewFileBackend(filepath.Join(dir, "to.yaml")).Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "secrets: []\n", string(content))
+
+	to = NewFileBackend(filepath.Join(dir, "to.yaml"))
+	assert.Error(t, MigrateState(from, to, false))
+	assert.NoError(t, MigrateState(from, to, true))
+}
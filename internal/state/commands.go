@@ -0,0 +1,128 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/util"
+	"github.com/urfave/cli/v2"
+)
+
+/*
+Lists the secrets of the state sorted by state key
+Usage: gitops state list
+*/
+func ListCommand(c *cli.Context) error {
+	secrets := append([]*SecretState{}, GetState().Secrets...)
+	if len(secrets) == 0 {
+		println("No secrets in state")
+		return nil
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].StateKey() < secrets[j].StateKey()
+	})
+	for _, secret := range secrets {
+		println(fmt.Sprintf("%s  %s  %s", secret.StateKey(), color.InBlue(secret.Target), secret.CombinedName()), color.InGray("# "+secret.Type))
+	}
+	return nil
+}
+
+/*
+Prints all fields of the state secrets matching the given path, state key or ID
+Usage: gitops state show <path|id>
+*/
+func ShowCommand(c *cli.Context) error {
+	reference := c.Args().First()
+	if reference == "" {
+		return errors.New("path or id is required: gitops state show <path|id>")
+	}
+	secrets := GetState().Find(reference)
+	if len(secrets) == 0 {
+		return fmt.Errorf("no secret in state matches '%s'", reference)
+	}
+	for _, secret := range secrets {
+		printSecretState(secret)
+	}
+	return nil
+}
+
+func printSecretState(secret *SecretState) {
+	println("---")
+	println(color.InBold(secret.StateKey()))
+	println("  id: " + secret.ID)
+	println("  targetType: " + string(secret.TargetType))
+	println("  target: " + secret.Target)
+	println("  name: " + secret.Name)
+	println("  namespace: " + secret.Namespace)
+	println("  type: " + secret.Type)
+	println("  path: " + secret.Path)
+	if secret.Document != "" {
+		println("  document: " + secret.Document)
+	}
+	println("  binaryDataHash: " + secret.BinaryDataHash)
+	if secret.DeletionPolicy != "" {
+		println("  deletionPolicy: " + secret.DeletionPolicy)
+	}
+	if secret.Applied != nil {
+		println("  applied:")
+		println("    timestamp: " + secret.Applied.Timestamp.Format(time.RFC3339))
+		println("    actor: " + secret.Applied.Actor)
+		println("    commit: " + secret.Applied.Commit)
+		println("    resourceVersion: " + secret.Applied.ResourceVersion)
+		println("    uid: " + secret.Applied.UID)
+		println("    hash: " + secret.Applied.Hash)
+	}
+}
+
+/*
+Removes secrets from the state without deleting them from their target
+The secrets are no longer managed by GitOps CLI
+Usage: gitops state rm <path>
+*/
+func RemoveCommand(c *cli.Context) error {
+	reference := c.Args().First()
+	if reference == "" {
+		return errors.New("path is required: gitops state rm <path>")
+	}
+	removed := GetState().Remove(reference)
+	if len(removed) == 0 {
+		return fmt.Errorf("no secret in state matches '%s'", reference)
+	}
+	for _, secret := range removed {
+		println(color.InYellow("Removed from state:"), secret.StateKey(), color.InGray("("+secret.Target+" "+secret.CombinedName()+" is kept)"))
+	}
+	return GetState().Save(c)
+}
+
+/*
+Moves the state secrets of a renamed secret file to its new path
+Usage: gitops state mv <old-path> <new-path>
+*/
+func MoveCommand(c *cli.Context) error {
+	if c.Args().Len() != 2 {
+		return errors.New("old and new path are required: gitops state mv <old-path> <new-path>")
+	}
+	from := c.Args().Get(0)
+	to := c.Args().Get(1)
+	if _, err := os.Stat(path.Join(util.GetRootDir(), normalizeStatePath(to))); os.IsNotExist(err) {
+		println(color.InYellow("Warning: secret file " + to + " does not exist"))
+	}
+
+	previousKeys := map[*SecretState]string{}
+	for _, secret := range GetState().Find(from) {
+		previousKeys[secret] = secret.StateKey()
+	}
+	moved, err := GetState().Move(from, to)
+	if err != nil {
+		return err
+	}
+	for _, secret := range moved {
+		println(color.InGreen("Moved"), previousKeys[secret], color.InGreen("=>"), secret.StateKey())
+	}
+	return GetState().Save(c)
+}
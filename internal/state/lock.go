@@ -0,0 +1,275 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/TwiN/go-color"
+	"github.com/google/uuid"
+	"github.com/mxcd/gitops-cli/internal/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+const lockFileName = ".gitops-state.lock"
+
+// age after which a lock of another host is reported as possibly stale
+const staleLockAge = time.Hour
+
+/*
+Advisory lock of the state file, held for the whole lifetime of a command that reads and writes the state
+*/
+type StateLock struct {
+	// unique id of the lock, required to force-unlock it
+	ID string `yaml:"id"`
+	// user that holds the lock
+	Owner string `yaml:"owner"`
+	// process id of the CLI that holds the lock
+	PID int `yaml:"pid"`
+	// host the CLI that holds the lock runs on
+	Host string `yaml:"host"`
+	// command that holds the lock
+	Operation string `yaml:"operation"`
+	// time the lock was taken
+	Created time.Time `yaml:"created"`
+
+	// store the lock was read from or written to
+	store LockStore
+	// version of the lock in the store when it was read
+	version string
+}
+
+/*
+Storage of the state lock next to the state of a backend
+Create must be atomic, so that only one of several concurrent runs gets the lock
+Remove must only remove the lock that was read, so that a run never removes a lock another run took in the meantime
+*/
+type LockStore interface {
+	// Creates the lock, returns false if there is a lock already
+	Create(content []byte) (bool, error)
+	// Reads the lock and its version, returns nil if there is no lock
+	Read() ([]byte, string, error)
+	// Removes the lock if it still has the given version, returns false if the lock was removed or replaced
+	Remove(version string) (bool, error)
+	// Location of the lock for display
+	String() string
+}
+
+type StateLockedError struct {
+	Lock *StateLock
+}
+
+func (e *StateLockedError) Error() string {
+	message := fmt.Sprintf("state is locked by %s@%s (pid %d, %s) since %s, lock id %s",
+		e.Lock.Owner, e.Lock.Host, e.Lock.PID, e.Lock.Operation, e.Lock.Created.Format(time.RFC3339), e.Lock.ID)
+	if time.Since(e.Lock.Created) > staleLockAge {
+		message += ". The lock may be stale, remove it with 'gitops state force-unlock " + e.Lock.ID + "' if no other run is in progress"
+	}
+	return message
+}
+
+// lock store of the state backend of the current command
+func getLockStore() (LockStore, error) {
+	stateBackend, err := NewStateBackend(util.GetCliContext().String("state-backend"))
+	if err != nil {
+		return nil, err
+	}
+	return stateBackend.LockStore(), nil
+}
+
+/*
+Takes the state lock for the given operation next to the state of the configured backend
+Locks of CLI processes on this host that are no longer running are removed
+*/
+func AcquireLock(operation string) (*StateLock, error) {
+	store, err := getLockStore()
+	if err != nil {
+		return nil, err
+	}
+	return acquireLock(store, operation)
+}
+
+func acquireLock(store LockStore, operation string) (*StateLock, error) {
+	lock := newLock(store, operation)
+	content, err := yaml.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		created, err := store.Create(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create state lock in %s: %w", store, err)
+		}
+		if created {
+			log.Debug("Acquired state lock ", lock.ID, " in ", store)
+			return lock, nil
+		}
+
+		existingLock, err := readLock(store)
+		if err != nil {
+			return nil, err
+		}
+		if existingLock == nil {
+			// the lock was released in the meantime
+			continue
+		}
+		if !existingLock.IsStale() {
+			return nil, &StateLockedError{Lock: existingLock}
+		}
+		log.Warn("Removing stale state lock ", existingLock.ID, " of process ", existingLock.PID, " that is no longer running")
+		removed, err := store.Remove(existingLock.version)
+		if err != nil {
+			return nil, err
+		}
+		if !removed {
+			// another run removed or replaced the stale lock in the meantime
+			log.Debug("Stale state lock ", existingLock.ID, " was already removed by another run")
+		}
+	}
+	return nil, errors.New("failed to acquire state lock")
+}
+
+func newLock(store LockStore, operation string) *StateLock {
+	owner := os.Getenv("USER")
+	if currentUser, err := user.Current(); err == nil {
+		owner = currentUser.Username
+	}
+	host, _ := os.Hostname()
+	return &StateLock{
+		ID:        uuid.New().String(),
+		Owner:     owner,
+		PID:       os.Getpid(),
+		Host:      host,
+		Operation: operation,
+		Created:   time.Now().UTC().Truncate(time.Second),
+		store:     store,
+	}
+}
+
+/*
+Releases the lock if the lock store still holds it
+*/
+func (l *StateLock) Release() error {
+	if l == nil {
+		return nil
+	}
+	currentLock, err := readLock(l.store)
+	if err != nil {
+		return err
+	}
+	if currentLock == nil || currentLock.ID != l.ID {
+		log.Warn("State lock ", l.ID, " was removed by another process")
+		return nil
+	}
+	log.Debug("Releasing state lock ", l.ID)
+	removed, err := l.store.Remove(currentLock.version)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		log.Warn("State lock ", l.ID, " was removed by another process")
+	}
+	return nil
+}
+
+/*
+Checks whether the lock is held by a process on this host that is no longer running
+Locks of other hosts are never considered stale, they have to be removed with force-unlock
+*/
+func (l *StateLock) IsStale() bool {
+	host, _ := os.Hostname()
+	return l.Host == host && !processExists(l.PID)
+}
+
+/*
+Returns the current state lock or nil if the state is not locked
+*/
+func ReadLock() (*StateLock, error) {
+	store, err := getLockStore()
+	if err != nil {
+		return nil, err
+	}
+	return readLock(store)
+}
+
+func readLock(store LockStore) (*StateLock, error) {
+	content, version, err := store.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state lock in %s: %w", store, err)
+	}
+	if content == nil {
+		return nil, nil
+	}
+	lock := &StateLock{store: store, version: version}
+	err = yaml.Unmarshal(content, lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse state lock in %s: %w", store, err)
+	}
+	return lock, nil
+}
+
+/*
+Removes the state lock with the given id regardless of its owner
+*/
+func ForceUnlock(id string) error {
+	store, err := getLockStore()
+	if err != nil {
+		return err
+	}
+	return forceUnlock(store, id)
+}
+
+func forceUnlock(store LockStore, id string) error {
+	lock, err := readLock(store)
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		return errors.New("state is not locked")
+	}
+	if lock.ID != id {
+		return fmt.Errorf("lock id '%s' does not match the current lock id '%s'", id, lock.ID)
+	}
+	removed, err := store.Remove(lock.version)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("state lock '%s' was removed or replaced in the meantime", id)
+	}
+	return nil
+}
+
+/*
+Removes the state lock of another run, e.g. of an aborted CI job
+The lock id has to be given to make sure the intended lock is removed
+Usage: gitops state force-unlock <lock-id>
+*/
+func ForceUnlockCommand(c *cli.Context) error {
+	lock, err := ReadLock()
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		println(color.InGreen("State is not locked."))
+		return nil
+	}
+	println("State is locked by", color.InBlue(lock.Owner+"@"+lock.Host), fmt.Sprintf("(pid %d, %s) since %s", lock.PID, lock.Operation, lock.Created.Format(time.RFC3339)))
+	println("Lock id:", color.InBold(lock.ID))
+
+	id := c.Args().First()
+	if id == "" {
+		return errors.New("lock id is required: gitops state force-unlock <lock-id>")
+	}
+	err = ForceUnlock(id)
+	if err != nil {
+		return err
+	}
+	println(color.InYellow("Removed state lock " + id))
+	return nil
+}
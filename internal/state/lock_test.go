@@ -0,0 +1,137 @@
+package state
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestStateLock(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), lockFileName)
+	testLockStore(t, &fileLockStore{file: lockFile})
+	_, err := os.Stat(lockFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// takes, checks and releases the lock of a lock store
+func testLockStore(t *testing.T, store LockStore) {
+	lock, err := acquireLock(store, "apply kubernetes")
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), lock.PID)
+	assert.Equal(t, "apply kubernetes", lock.Operation)
+
+	_, err = acquireLock(store, "plan kubernetes")
+	var lockedError *StateLockedError
+	assert.ErrorAs(t, err, &lockedError)
+	assert.Equal(t, lock.ID, lockedError.Lock.ID)
+
+	assert.NoError(t, lock.Release())
+	currentLock, err := readLock(store)
+	assert.NoError(t, err)
+	assert.Nil(t, currentLock)
+
+	lock, err = acquireLock(store, "plan kubernetes")
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release())
+}
+
+// creates the lock of a process on this host that is no longer running
+func createStaleLock(t *testing.T, store LockStore) *StateLock {
+	process := exec.Command("go", "version")
+	assert.NoError(t, process.Run())
+	staleLock := newLock(store, "apply kubernetes")
+	staleLock.PID = process.Process.Pid
+	content, err := yaml.Marshal(staleLock)
+	assert.NoError(t, err)
+	created, err := store.Create(content)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.True(t, staleLock.IsStale())
+	return staleLock
+}
+
+func TestStaleStateLock(t *testing.T) {
+	store := &fileLockStore{file: filepath.Join(t.TempDir(), lockFileName)}
+	staleLock := createStaleLock(t, store)
+
+	lock, err := acquireLock(store, "plan kubernetes")
+	assert.NoError(t, err)
+	assert.NotEqual(t, staleLock.ID, lock.ID)
+
+	// locks of other hosts are never stale
+	lock.Host = "other-host"
+	assert.False(t, lock.IsStale())
+}
+
+func TestConcurrentStaleStateLock(t *testing.T) {
+	testConcurrentStaleLock(t, &fileLockStore{file: filepath.Join(t.TempDir(), lockFileName)})
+}
+
+// lock store that holds back a run after it read the lock for the first time
+type pausingLockStore struct {
+	LockStore
+	read   chan struct{}
+	resume chan struct{}
+}
+
+func (s *pausingLockStore) Read() ([]byte, string, error) {
+	content, version, err := s.LockStore.Read()
+	if s.read != nil {
+		close(s.read)
+		s.read = nil
+		<-s.resume
+	}
+	return content, version, err
+}
+
+// two runs take over the same stale lock, the run that read it first must not remove the lock of the other run
+func testConcurrentStaleLock(t *testing.T, store LockStore) {
+	staleLock := createStaleLock(t, store)
+	read := make(chan struct{})
+	paused := &pausingLockStore{LockStore: store, read: read, resume: make(chan struct{})}
+	var pausedLock *StateLock
+	var pausedErr error
+	done := make(chan struct{})
+	go func() {
+		pausedLock, pausedErr = acquireLock(paused, "plan kubernetes")
+		close(done)
+	}()
+
+	<-read
+	lock, err := acquireLock(store, "apply kubernetes")
+	assert.NoError(t, err)
+	close(paused.resume)
+	<-done
+
+	var lockedError *StateLockedError
+	assert.ErrorAs(t, pausedErr, &lockedError)
+	assert.Nil(t, pausedLock)
+	assert.Equal(t, lock.ID, lockedError.Lock.ID)
+	currentLock, err := readLock(store)
+	assert.NoError(t, err)
+	assert.NotEqual(t, staleLock.ID, currentLock.ID)
+	assert.Equal(t, lock.ID, currentLock.ID)
+	assert.NoError(t, lock.Release())
+}
+
+func TestForceUnlock(t *testing.T) {
+	store := &fileLockStore{file: filepath.Join(t.TempDir(), lockFileName)}
+	assert.Error(t, forceUnlock(store, "any"))
+
+	lock, err := acquireLock(store, "apply kubernetes")
+	assert.NoError(t, err)
+	assert.Error(t, forceUnlock(store, "wrong-id"))
+	assert.NoError(t, forceUnlock(store, lock.ID))
+
+	// releasing a lock that was removed does not remove the lock of another run
+	otherLock, err := acquireLock(store, "plan kubernetes")
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release())
+	currentLock, err := readLock(store)
+	assert.NoError(t, err)
+	assert.Equal(t, otherLock.ID, currentLock.ID)
+}
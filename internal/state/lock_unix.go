@@ -0,0 +1,16 @@
+//go:build !windows
+
+package state
+
+import (
+	"errors"
+	"syscall"
+)
+
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
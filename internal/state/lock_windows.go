@@ -0,0 +1,18 @@
+//go:build windows
+
+package state
+
+import "os"
+
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	// opening the process fails on windows if it is no longer running
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,141 @@
+package state
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Schema version of the state written by this version of the CLI
+const StateVersion = 2
+
+/*
+Migrates the raw state document from one version to the next
+*/
+type stateMigration func(document map[interface{}]interface{}) error
+
+// stateMigrations[v] migrates version v to version v+1
+var stateMigrations = []stateMigration{
+	migrateStateV0,
+	migrateStateV1,
+}
+
+/*
+Parses a serialized state, migrating it from older versions
+States written by a newer version of the CLI are refused, as fields unknown to this version would be lost on save
+*/
+func ParseState(content []byte) (*State, error) {
+	state := &State{
+		Version:  StateVersion,
+		Secrets:  []*SecretState{},
+		Clusters: map[string]*ClusterState{},
+	}
+	if content == nil {
+		return state, nil
+	}
+
+	document := map[interface{}]interface{}{}
+	err := yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, err
+	}
+	version, err := getStateVersion(document)
+	if err != nil {
+		return nil, err
+	}
+	if version > StateVersion {
+		return nil, fmt.Errorf("state version %d was written by a newer version of GitOps CLI, this version supports state version %d. Update GitOps CLI", version, StateVersion)
+	}
+
+	migrated := content
+	if version < StateVersion {
+		for v := version; v < StateVersion; v++ {
+			err = stateMigrations[v](document)
+			if err != nil {
+				return nil, fmt.Errorf("failed to migrate state from version %d to %d: %w", v, v+1, err)
+			}
+		}
+		document["version"] = StateVersion
+		migrated, err = yaml.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		state.migratedContent = content
+		state.migratedVersion = version
+	}
+
+	err = yaml.UnmarshalStrict(migrated, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Secrets == nil {
+		state.Secrets = []*SecretState{}
+	}
+	if state.Clusters == nil {
+		state.Clusters = map[string]*ClusterState{}
+	}
+	return state, nil
+}
+
+func getStateVersion(document map[interface{}]interface{}) (int, error) {
+	value, ok := document["version"]
+	if !ok {
+		// states written before the version field was introduced
+		return 0, nil
+	}
+	version, ok := value.(int)
+	if !ok || version < 0 {
+		return 0, fmt.Errorf("invalid state version '%v'", value)
+	}
+	return version, nil
+}
+
+/*
+Version 0 used the lowercased Go field names as keys, version 1 uses camelCase keys
+*/
+func migrateStateV0(document map[interface{}]interface{}) error {
+	secretKeys := map[string]string{
+		"targettype":     "targetType",
+		"binarydatahash": "binaryDataHash",
+		"deletionpolicy": "deletionPolicy",
+	}
+	clusterKeys := map[string]string{
+		"configfile": "configFile",
+	}
+
+	if secrets, ok := document["secrets"].([]interface{}); ok {
+		for _, s := range secrets {
+			secret, ok := s.(map[interface{}]interface{})
+			if !ok {
+				return fmt.Errorf("invalid secret '%v'", s)
+			}
+			renameStateKeys(secret, secretKeys)
+		}
+	}
+	if clusters, ok := document["clusters"].(map[interface{}]interface{}); ok {
+		for name, c := range clusters {
+			cluster, ok := c.(map[interface{}]interface{})
+			if !ok {
+				return fmt.Errorf("invalid cluster '%v'", name)
+			}
+			renameStateKeys(cluster, clusterKeys)
+		}
+	}
+	return nil
+}
+
+func renameStateKeys(document map[interface{}]interface{}, keys map[string]string) {
+	for oldKey, newKey := range keys {
+		if value, ok := document[oldKey]; ok {
+			delete(document, oldKey)
+			document[newKey] = value
+		}
+	}
+}
+
+/*
+Version 2 adds the optional applied metadata of secrets, which version 1 would refuse as unknown fields
+*/
+func migrateStateV1(document map[interface{}]interface{}) error {
+	return nil
+}
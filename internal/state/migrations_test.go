@@ -0,0 +1,95 @@
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+const stateV0 = `secrets:
+- id: 0b9b7a4e-2d7b-4e43-8d3c-5f7a3c0f3e11
+  targettype: k8s
+  target: production
+  name: app
+  namespace: default
+  type: Opaque
+  path: apps/app.gitops.secret.enc.yaml
+  binarydatahash: 5d41402abc4b2a76b9719d911017c592
+  deletionpolicy: Retain
+clusters:
+  production:
+    name: production
+    configfile: production.kubeconfig
+    environment: prod
+`
+
+func TestParseStateV0(t *testing.T) {
+	s, err := ParseState([]byte(stateV0))
+	assert.NoError(t, err)
+	assert.Equal(t, StateVersion, s.Version)
+	assert.Equal(t, 0, s.migratedVersion)
+	assert.Equal(t, stateV0, string(s.migratedContent))
+
+	assert.Len(t, s.Secrets, 1)
+	assert.Equal(t, "k8s", string(s.Secrets[0].TargetType))
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", s.Secrets[0].BinaryDataHash)
+	assert.Equal(t, "Retain", s.Secrets[0].DeletionPolicy)
+	assert.Equal(t, "production.kubeconfig", s.Clusters["production"].ConfigFile)
+	assert.Equal(t, "prod", s.Clusters["production"].Environment)
+}
+
+func TestParseStateCurrentVersion(t *testing.T) {
+	s, err := ParseState(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, StateVersion, s.Version)
+	assert.Empty(t, s.Secrets)
+
+	s.Secrets = append(s.Secrets, &SecretState{ID: "1", TargetType: "k8s", Path: "app.gitops.secret.enc.yaml", BinaryDataHash: "hash"})
+	content, err := yaml.Marshal(s)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "binaryDataHash: hash")
+
+	parsed, err := ParseState(content)
+	assert.NoError(t, err)
+	assert.Nil(t, parsed.migratedContent)
+	assert.Equal(t, s.Secrets, parsed.Secrets)
+
+	_, err = ParseState([]byte(fmt.Sprintf("version: %d\nsecrets: []\nunknown: true\n", StateVersion)))
+	assert.Error(t, err)
+}
+
+func TestParseStateNewerVersion(t *testing.T) {
+	_, err := ParseState([]byte("version: 99\nsecrets: []\n"))
+	assert.ErrorContains(t, err, "newer version")
+
+	_, err = ParseState([]byte("version: latest\n"))
+	assert.Error(t, err)
+}
+
+func TestSaveMigratedState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".gitops-state.yaml")
+	assert.NoError(t, os.WriteFile(file, []byte(stateV0), 0644))
+
+	assert.NoError(t, LoadStateFrom(NewFileBackend(file)))
+	assert.NoError(t, GetState().Save(nil))
+
+	backup, err := os.ReadFile(file + ".v0.backup")
+	assert.NoError(t, err)
+	assert.Equal(t, stateV0, string(backup))
+
+	content, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), fmt.Sprintf("version: %d", StateVersion))
+	assert.Contains(t, string(content), "configFile: production.kubeconfig")
+
+	// the migrated state is not backed up again
+	assert.NoError(t, os.Remove(file+".v0.backup"))
+	assert.NoError(t, LoadStateFrom(NewFileBackend(file)))
+	assert.NoError(t, GetState().Save(nil))
+	_, err = os.Stat(file + ".v0.backup")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -2,12 +2,12 @@ package state
 
 import (
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/TwiN/go-color"
-	"github.com/andybalholm/crlf"
 	"github.com/mxcd/gitops-cli/internal/secret"
 	"github.com/mxcd/gitops-cli/internal/util"
 	log "github.com/sirupsen/logrus"
@@ -16,99 +16,158 @@ import (
 )
 
 type State struct {
+	// Schema version of the state, see StateVersion
+	Version int `yaml:"version"`
 	// List of secrets in the state
-	Secrets []*SecretState
+	Secrets []*SecretState `yaml:"secrets"`
 	// Map of clusters known to the state
-	Clusters map[string]*ClusterState
+	Clusters map[string]*ClusterState `yaml:"clusters"`
+
+	// serialized state as loaded, set if it was migrated from an older version and is backed up on save
+	migratedContent []byte
+	// version the state was migrated from
+	migratedVersion int
 }
 
 type SecretState struct {
 	// unique uuid of the secret
-	ID string
+	ID string `yaml:"id"`
 	// Target is the target of the secret
-	TargetType secret.SecretTargetType
+	TargetType secret.SecretTargetType `yaml:"targetType"`
 	// Target is the target system (cluster of vault instance)
-	Target string
+	Target string `yaml:"target"`
 	// Name of the secret
-	Name string
+	Name string `yaml:"name"`
 	// Namespace of the secret
-	Namespace string
+	Namespace string `yaml:"namespace"`
 	// Type of the secret
-	Type string
+	Type string `yaml:"type"`
 	// Path is the path to the secret file
-	Path string
+	Path string `yaml:"path"`
+	// Document identifies the secret within a multi-document secret file
+	Document string `yaml:"document,omitempty"`
 	// SHA256 hash of the decrypted secret file
-	BinaryDataHash string
+	BinaryDataHash string `yaml:"binaryDataHash"`
+	// DeletionPolicy of the secret file, kept to decide on the deletion once the file is removed
+	DeletionPolicy string `yaml:"deletionPolicy,omitempty"`
+	// Applied records the last successful apply of the secret, nil if it was not applied yet
+	Applied *AppliedState `yaml:"applied,omitempty"`
+}
+
+type AppliedState struct {
+	// resourceVersion of the object after the apply
+	ResourceVersion string `yaml:"resourceVersion"`
+	// UID of the object after the apply
+	UID string `yaml:"uid"`
+	// hash of the applied type and data, see Secret.DataHash
+	Hash string `yaml:"hash"`
+	// time of the apply
+	Timestamp time.Time `yaml:"timestamp"`
+	// commit of the repository the secret was applied from
+	Commit string `yaml:"commit,omitempty"`
+	// user that applied the secret
+	Actor string `yaml:"actor,omitempty"`
 }
 
+const (
+	DriftModified = "modified in cluster since last apply"
+	DriftDeleted  = "deleted in cluster since last apply"
+	DriftReplaced = "replaced in cluster since last apply"
+)
+
 type ClusterState struct {
 	// Name of the cluster
-	Name string
+	Name string `yaml:"name"`
 	// Kubeconfig file of the cluster
-	ConfigFile string
+	ConfigFile string `yaml:"configFile"`
+	// Environment used to select the overlay values files for secrets of the cluster
+	Environment string `yaml:"environment,omitempty"`
 }
 
 var state *State
 
+// backend the state was loaded from and is saved to
+var backend StateBackend
+
 func LoadState(c *cli.Context) error {
-	// Load state from project root
-	stateFileName := path.Join(util.GetRootDir(), ".gitops-state.yaml")
-	stats, err := os.Stat(stateFileName)
+	stateBackend, err := NewStateBackend(c.String("state-backend"))
 	if err != nil {
-		if os.IsNotExist(err) {
-			// Create new state
-			state = &State{
-				Secrets: []*SecretState{},
-				Clusters: map[string]*ClusterState{},
-			}
-			return nil
-		} else {
-			return err
-		}
-	} 
-	
-	// Load state from file
-	if stats.IsDir() {
-		return fmt.Errorf("state file is a directory")
+		return err
 	}
-	stateFile, err := os.Open(stateFileName)
+	return LoadStateFrom(stateBackend)
+}
+
+/*
+Loads the state from the given backend, which is also used to save it
+*/
+func LoadStateFrom(stateBackend StateBackend) error {
+	backend = stateBackend
+	log.Debug("Loading state from ", backend)
+	content, err := backend.Read()
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := stateFile.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	reader := crlf.NewReader(stateFile)
-	yamlFile, err := ioutil.ReadAll(reader)
+	loadedState, err := ParseState(content)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to load state of %s: %w", backend, err)
+	}
+	if loadedState.migratedContent != nil {
+		log.Info("Migrated state of ", backend, " from version ", loadedState.migratedVersion, " to version ", StateVersion)
+	}
+	state = loadedState
+	secret.SetClusterEnvironments(state.getClusterEnvironments())
+	return nil
+}
+
+/*
+Sets the environments of the target clusters for commands that render secrets without changing the state
+The state is read without taking the lock, if it cannot be read the clusters of .gitops.yaml are used
+*/
+func LoadClusterEnvironments(c *cli.Context) {
+	err := LoadState(c)
+	if err == nil {
+		return
 	}
-	err = yaml.Unmarshal(yamlFile, &state)
-	return err
+	log.Warn("Failed to load the state, using the clusters of the repository config for their environments: ", err)
+	secret.SetClusterEnvironments((&State{}).getClusterEnvironments())
+}
+
+func (s *State) getClusterEnvironments() map[string]string {
+	environments := map[string]string{}
+	for name, cluster := range s.GetClusters() {
+		if cluster.Environment != "" {
+			environments[name] = cluster.Environment
+		}
+	}
+	return environments
 }
 
 func (s *State) Save(c *cli.Context) error {
-	// Save state to project root
-	stateFileName := path.Join(util.GetRootDir(), ".gitops-state.yaml")
-	yamlFile, err := yaml.Marshal(s)
-	if err != nil {
-		return err
+	if backend == nil {
+		backend = NewFileBackend(defaultStateFile)
+	}
+	if s.migratedContent != nil {
+		// keep the state of the older version in case the migration has to be reverted
+		backupLocation, err := backend.Backup(s.migratedContent, fmt.Sprintf("v%d", s.migratedVersion))
+		if err != nil {
+			return fmt.Errorf("failed to back up state before migrating it: %w", err)
+		}
+		println(color.InYellow(fmt.Sprintf("Migrated state to version %d, the previous state was backed up to %s", StateVersion, backupLocation)))
+		s.migratedContent = nil
 	}
-	stateFile, err := os.Create(stateFileName)
+	s.Version = StateVersion
+	yamlFile, err := yaml.Marshal(s)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := stateFile.Close(); err != nil {
-			panic(err)
-		}
-	}()
-	
-	writer := crlf.NewWriter(stateFile)
-	_, err = writer.Write(yamlFile)
-	return err
+	return backend.Write(yamlFile)
+}
+
+/*
+Returns the backend the state was loaded from
+*/
+func GetBackend() StateBackend {
+	return backend
 }
 
 func (s *State) GetByPath(path string) *SecretState {
@@ -120,16 +179,131 @@ func (s *State) GetByPath(path string) *SecretState {
 	return nil
 }
 
+/*
+Returns the state secret with the given state key (see Secret.StateKey)
+*/
+func (s *State) GetByKey(key string) *SecretState {
+	for _, secret := range s.Secrets {
+		if secret.StateKey() == key {
+			return secret
+		}
+	}
+	return nil
+}
+
+/*
+Returns the state secret of the given secret that is stored under another state key, nil if there is none
+The state key changes once the secret moves to another file or its file gains or loses documents
+*/
+func (s *State) GetMoved(secret *secret.Secret) *SecretState {
+	for _, stateSecret := range s.Secrets {
+		if stateSecret.StateKey() != secret.StateKey() && stateSecret.Target == secret.Target && stateSecret.CombinedName() == secret.CombinedName() {
+			return stateSecret
+		}
+	}
+	return nil
+}
+
+/*
+Returns the state secrets matching the given reference:
+the ID of a secret, a state key (<path>#<namespace>/<name>) or the path of a secret file
+*/
+func (s *State) Find(reference string) []*SecretState {
+	reference = normalizeStatePath(reference)
+	found := []*SecretState{}
+	for _, secret := range s.Secrets {
+		if secret.ID == reference || secret.StateKey() == reference || secret.Path == reference {
+			found = append(found, secret)
+		}
+	}
+	return found
+}
+
+/*
+Removes the state secrets matching the given state key or path and returns them
+The secrets are no longer managed, but are kept in their target
+*/
+func (s *State) Remove(reference string) []*SecretState {
+	removed := s.Find(reference)
+	remaining := []*SecretState{}
+	for _, secret := range s.Secrets {
+		if !containsSecretState(removed, secret) {
+			remaining = append(remaining, secret)
+		}
+	}
+	s.Secrets = remaining
+	return removed
+}
+
+/*
+Moves the state secrets of a secret file (or a single secret given by its state key) to another secret file
+*/
+func (s *State) Move(from string, to string) ([]*SecretState, error) {
+	to = normalizeStatePath(to)
+	if strings.Contains(to, "#") {
+		return nil, fmt.Errorf("target '%s' must be the path of a secret file, the document is given by the namespace and name of the secret", to)
+	}
+	moved := s.Find(from)
+	if len(moved) == 0 {
+		return nil, fmt.Errorf("no secret in state matches '%s'", from)
+	}
+	for _, secret := range moved {
+		key := (&SecretState{Path: to, Document: secret.Document}).StateKey()
+		existing := s.GetByKey(key)
+		if existing != nil && !containsSecretState(moved, existing) {
+			return nil, fmt.Errorf("state already contains secret '%s'", key)
+		}
+	}
+	for _, secret := range moved {
+		secret.Path = to
+	}
+	return moved, nil
+}
+
+/*
+Removes the given secret from the state
+*/
+func (s *State) RemoveSecretState(secret *SecretState) {
+	remaining := []*SecretState{}
+	for _, stateSecret := range s.Secrets {
+		if stateSecret != secret {
+			remaining = append(remaining, stateSecret)
+		}
+	}
+	s.Secrets = remaining
+}
+
+func containsSecretState(secrets []*SecretState, secret *SecretState) bool {
+	for _, s := range secrets {
+		if s == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// state paths are relative to the root dir and slash separated
+func normalizeStatePath(reference string) string {
+	filePath, document, hasDocument := strings.Cut(reference, "#")
+	filePath = path.Clean(filepath.ToSlash(filePath))
+	if hasDocument {
+		return filePath + "#" + document
+	}
+	return filePath
+}
+
 func (s *State) Add(secret *secret.Secret) *SecretState {
 	stateSecret := &SecretState{
 		ID: secret.ID,
 		TargetType: secret.TargetType,
 		Target: secret.Target,
 		Path: secret.Path,
+		Document: secret.Document,
 		BinaryDataHash: secret.BinaryDataHash,
 		Name: secret.Name,
 		Namespace: secret.Namespace,
 		Type: secret.Type,
+		DeletionPolicy: secret.DeletionPolicy,
 	}
 	s.Secrets = append(s.Secrets, stateSecret)
 	return stateSecret
@@ -144,12 +318,56 @@ func (s *SecretState) Update(secret *secret.Secret) {
 	s.Namespace = secret.Namespace
 	s.BinaryDataHash = secret.BinaryDataHash
 	s.Type = secret.Type
+	s.DeletionPolicy = secret.DeletionPolicy
+}
+
+/*
+Records the successful apply of the secret, the secret holds the metadata of the object in the target
+*/
+func (s *SecretState) RecordApplied(secret *secret.Secret) {
+	s.Applied = &AppliedState{
+		ResourceVersion: secret.ResourceVersion,
+		UID:             secret.UID,
+		Hash:            secret.DataHash(),
+		Timestamp:       time.Now().UTC().Truncate(time.Second),
+		Commit:          util.GetFileSource().Commit(),
+		Actor:           util.GetActor(),
+	}
+}
+
+/*
+Describes how the remote secret was changed out-of-band since the last apply, empty if it was not
+The remote secret is nil if it does not exist in the target
+*/
+func (s *SecretState) Drift(remoteSecret *secret.Secret) string {
+	if s.Applied == nil {
+		return ""
+	}
+	switch {
+	case remoteSecret == nil:
+		return DriftDeleted
+	case remoteSecret.UID != "" && s.Applied.UID != "" && remoteSecret.UID != s.Applied.UID:
+		return DriftReplaced
+	case remoteSecret.ResourceVersion == s.Applied.ResourceVersion:
+		return ""
+	case remoteSecret.DataHash() != s.Applied.Hash:
+		// metadata only changes, e.g. by controllers adding annotations, are no drift
+		return DriftModified
+	}
+	return ""
 }
 
 func (s *SecretState) CombinedName() string {
 	return s.Namespace + "/" + s.Name
 }
 
+func (s *SecretState) StateKey() string {
+	if s.Document == "" {
+		return s.Path
+	}
+	return s.Path + "#" + s.Document
+}
+
 func (s *State) SetSecrets(secrets []*SecretState) {
 	s.Secrets = secrets
 }
@@ -174,11 +392,12 @@ func (m *ClusterNameReservedError) Error() string {
 }
 
 func (s *State) GetCluster(name string) (*ClusterState, error) {
-	if s.Clusters[name] == nil {
+	cluster := s.GetClusters()[name]
+	if cluster == nil {
 		log.Error("Cluster " + color.InBlue(name) + " not defined in state")
 		return nil, &ClusterNotFoundError{}
 	}
-	return s.Clusters[name], nil
+	return cluster, nil
 }
 
 func (s *State) AddCluster(cluster *ClusterState) error {
@@ -198,11 +417,30 @@ func (s *State) AddCluster(cluster *ClusterState) error {
 	return nil
 }
 
+/*
+Returns the clusters of the state together with the clusters of the repository config
+Clusters of the state take precedence over clusters of the repository config with the same name
+*/
 func (s *State) GetClusters() map[string]*ClusterState {
 	if s.Clusters == nil {
 		s.Clusters = map[string]*ClusterState{}
 	}
-	return s.Clusters
+	config, err := util.GetRepoConfig()
+	if err != nil || len(config.Clusters) == 0 {
+		return s.Clusters
+	}
+	clusters := map[string]*ClusterState{}
+	for name, cluster := range config.Clusters {
+		clusters[name] = &ClusterState{
+			Name:        name,
+			ConfigFile:  cluster.ConfigFile,
+			Environment: cluster.Environment,
+		}
+	}
+	for name, cluster := range s.Clusters {
+		clusters[name] = cluster
+	}
+	return clusters
 }
 
 func (s *State) RemoveCluster(name string) error {
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/mxcd/gitops-cli/internal/secret"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestState() *State {
+	return &State{
+		Secrets: []*SecretState{
+			{ID: "1", Path: "apps/app.gitops.secret.enc.yaml", Name: "app", Namespace: "default", Target: "prod"},
+			{ID: "2", Path: "apps/multi.gitops.secret.enc.yaml", Document: "default/first", Name: "first", Namespace: "default", Target: "prod"},
+			{ID: "3", Path: "apps/multi.gitops.secret.enc.yaml", Document: "default/second", Name: "second", Namespace: "default", Target: "prod"},
+		},
+		Clusters: map[string]*ClusterState{},
+	}
+}
+
+func TestFindSecretState(t *testing.T) {
+	s := getTestState()
+
+	assert.Len(t, s.Find("1"), 1)
+	assert.Len(t, s.Find("apps/app.gitops.secret.enc.yaml"), 1)
+	assert.Len(t, s.Find("./apps/app.gitops.secret.enc.yaml"), 1)
+	assert.Len(t, s.Find("apps/multi.gitops.secret.enc.yaml"), 2)
+	found := s.Find("apps/multi.gitops.secret.enc.yaml#default/second")
+	assert.Len(t, found, 1)
+	assert.Equal(t, "3", found[0].ID)
+	assert.Empty(t, s.Find("apps/unknown.gitops.secret.enc.yaml"))
+}
+
+func TestRemoveSecretState(t *testing.T) {
+	s := getTestState()
+
+	removed := s.Remove("apps/multi.gitops.secret.enc.yaml#default/first")
+	assert.Len(t, removed, 1)
+	assert.Equal(t, "2", removed[0].ID)
+	assert.Len(t, s.Secrets, 2)
+
+	removed = s.Remove("apps/multi.gitops.secret.enc.yaml")
+	assert.Len(t, removed, 1)
+	assert.Len(t, s.Secrets, 1)
+	assert.Equal(t, "1", s.Secrets[0].ID)
+
+	assert.Empty(t, s.Remove("apps/multi.gitops.secret.enc.yaml"))
+}
+
+func TestMoveSecretState(t *testing.T) {
+	s := getTestState()
+
+	moved, err := s.Move("apps/multi.gitops.secret.enc.yaml", "apps/renamed.gitops.secret.enc.yaml")
+	assert.NoError(t, err)
+	assert.Len(t, moved, 2)
+	assert.NotNil(t, s.GetByKey("apps/renamed.gitops.secret.enc.yaml#default/first"))
+	assert.NotNil(t, s.GetByKey("apps/renamed.gitops.secret.enc.yaml#default/second"))
+	assert.Empty(t, s.Find("apps/multi.gitops.secret.enc.yaml"))
+
+	_, err = s.Move("apps/app.gitops.secret.enc.yaml", "apps/renamed.gitops.secret.enc.yaml#default/app")
+	assert.Error(t, err)
+	_, err = s.Move("apps/unknown.gitops.secret.enc.yaml", "apps/other.gitops.secret.enc.yaml")
+	assert.Error(t, err)
+
+	// a single document can be moved to a file that holds other documents
+	_, err = s.Move("apps/renamed.gitops.secret.enc.yaml#default/first", "apps/app.gitops.secret.enc.yaml")
+	assert.NoError(t, err)
+	assert.Len(t, s.Find("apps/app.gitops.secret.enc.yaml"), 2)
+
+	s.Secrets = append(s.Secrets, &SecretState{ID: "4", Path: "apps/other.gitops.secret.enc.yaml"})
+	_, err = s.Move("apps/other.gitops.secret.enc.yaml", "apps/app.gitops.secret.enc.yaml")
+	assert.Error(t, err)
+}
+
+func TestSecretStateDrift(t *testing.T) {
+	applied := &secret.Secret{
+		Type:            "Opaque",
+		Data:            map[string]string{"password": "secret"},
+		ResourceVersion: "10",
+		UID:             "uid-1",
+	}
+	stateSecret := &SecretState{ID: "1"}
+	assert.Equal(t, "", stateSecret.Drift(nil))
+
+	stateSecret.RecordApplied(applied)
+	assert.Equal(t, "10", stateSecret.Applied.ResourceVersion)
+	assert.Equal(t, "uid-1", stateSecret.Applied.UID)
+	assert.Equal(t, applied.DataHash(), stateSecret.Applied.Hash)
+	assert.NotEmpty(t, stateSecret.Applied.Actor)
+
+	assert.Equal(t, "", stateSecret.Drift(applied))
+	assert.Equal(t, DriftDeleted, stateSecret.Drift(nil))
+
+	// metadata changes are no drift
+	annotated := &secret.Secret{Type: "Opaque", Data: map[string]string{"password": "secret"}, ResourceVersion: "11", UID: "uid-1"}
+	assert.Equal(t, "", stateSecret.Drift(annotated))
+
+	modified := &secret.Secret{Type: "Opaque", Data: map[string]string{"password": "changed"}, ResourceVersion: "12", UID: "uid-1"}
+	assert.Equal(t, DriftModified, stateSecret.Drift(modified))
+
+	replaced := &secret.Secret{Type: "Opaque", Data: map[string]string{"password": "secret"}, ResourceVersion: "1", UID: "uid-2"}
+	assert.Equal(t, DriftReplaced, stateSecret.Drift(replaced))
+}
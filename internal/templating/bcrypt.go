@@ -0,0 +1,82 @@
+package templating
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/blowfish"
+)
+
+/*
+golang.org/x/crypto/bcrypt always generates a random salt.
+Secrets are diffed against the cluster on every plan, therefore the templating
+functions need a bcrypt implementation with a caller provided salt.
+The implementation follows golang.org/x/crypto/bcrypt and produces $2a$ hashes
+that can be verified by any bcrypt implementation.
+*/
+
+const bcryptDefaultCost = 10
+const bcryptSaltSize = 16
+const bcryptMaxPasswordLength = 72
+
+// "OrpheanBeholderScryDoubt"
+var bcryptMagicCipherData = []byte{
+	0x4f, 0x72, 0x70, 0x68,
+	0x65, 0x61, 0x6e, 0x42,
+	0x65, 0x68, 0x6f, 0x6c,
+	0x64, 0x65, 0x72, 0x53,
+	0x63, 0x72, 0x79, 0x44,
+	0x6f, 0x75, 0x62, 0x74,
+}
+
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+/*
+Derives the 16 byte bcrypt salt from an arbitrary salt string
+*/
+func bcryptSaltFromString(salt string) []byte {
+	hash := sha256.Sum256([]byte(salt))
+	return hash[:bcryptSaltSize]
+}
+
+/*
+Computes the bcrypt hash of the password using the given 16 byte salt
+*/
+func bcryptHash(password []byte, cost int, salt []byte) (string, error) {
+	if len(password) > bcryptMaxPasswordLength {
+		return "", errors.New("bcrypt: password length exceeds 72 bytes")
+	}
+	if len(salt) != bcryptSaltSize {
+		return "", fmt.Errorf("bcrypt: salt must be %d bytes", bcryptSaltSize)
+	}
+
+	cipherData := make([]byte, len(bcryptMagicCipherData))
+	copy(cipherData, bcryptMagicCipherData)
+
+	// Bug compatibility with C bcrypt implementations. They use the trailing
+	// NULL in the key string during expansion.
+	key := append(password[:len(password):len(password)], 0)
+
+	c, err := blowfish.NewSaltedCipher(key, salt)
+	if err != nil {
+		return "", err
+	}
+
+	rounds := uint64(1) << uint(cost)
+	for i := uint64(0); i < rounds; i++ {
+		blowfish.ExpandKey(key, c)
+		blowfish.ExpandKey(salt, c)
+	}
+
+	for i := 0; i < 24; i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(cipherData[i:i+8], cipherData[i:i+8])
+		}
+	}
+
+	// Bug compatibility with C bcrypt implementations. Only 23 of the
+	// 24 encrypted bytes are encoded.
+	return fmt.Sprintf("$2a$%02d$%s%s", cost, bcryptEncoding.EncodeToString(salt), bcryptEncoding.EncodeToString(cipherData[:23])), nil
+}
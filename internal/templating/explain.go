@@ -0,0 +1,117 @@
+package templating
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TwiN/go-color"
+	"github.com/mxcd/gitops-cli/internal/util"
+	"github.com/urfave/cli/v2"
+)
+
+/*
+Prints the effective values tree of a secret path together with
+the values file that set each value and the ancestors it overrode
+The overlay values files of the environment given by --env are merged on top
+Usage: gitops secrets values explain <secret-path> [key.path]
+*/
+func ValuesExplainCommand(c *cli.Context) error {
+	secretPath := c.Args().Get(0)
+	if secretPath == "" {
+		return errors.New("secret path is required")
+	}
+	keyPath := c.Args().Get(1)
+	environment := c.String("env")
+
+	values, err := GetValuesForEnvironment(secretPath, environment)
+	if err != nil {
+		return err
+	}
+	chain := GetValuesChainForPath(secretPath, environment)
+	if len(chain) == 0 {
+		return fmt.Errorf("no values files apply to '%s'", secretPath)
+	}
+
+	lines := explainValues(values, GetValueProvenanceForPath(secretPath, environment), keyPath, c.Bool("cleartext"))
+	if len(lines) == 0 {
+		return fmt.Errorf("key '%s' not found in values for '%s'", keyPath, secretPath)
+	}
+
+	println(color.InBold("# " + secretPath))
+	println(color.InGray("# values files (in merge order):"))
+	for _, templateValue := range chain {
+		println(color.InGray("#   " + templateValue.File))
+	}
+	for _, line := range lines {
+		println(line)
+	}
+	return nil
+}
+
+/*
+Renders the merged values as an indented tree. Only values below keyPath are included.
+*/
+func explainValues(values map[interface{}]interface{}, provenance map[string]*ValueProvenance, keyPath string, cleartext bool) []string {
+	lines := []string{}
+	explainValuesTree(values, provenance, "", 0, keyPath, cleartext, &lines)
+	return lines
+}
+
+func explainValuesTree(values map[interface{}]interface{}, provenance map[string]*ValueProvenance, prefix string, depth int, keyPath string, cleartext bool, lines *[]string) {
+	keys := make([]string, 0, len(values))
+	valuesByKey := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key := fmt.Sprintf("%v", k)
+		keys = append(keys, key)
+		valuesByKey[key] = v
+	}
+	sort.Strings(keys)
+
+	indent := strings.Repeat("  ", depth)
+	for _, key := range keys {
+		fullKey := joinValueKey(prefix, key)
+		if !keyMatches(fullKey, keyPath) {
+			continue
+		}
+		value := valuesByKey[key]
+		if m, ok := value.(map[interface{}]interface{}); ok && len(m) > 0 {
+			childLines := []string{}
+			explainValuesTree(m, provenance, fullKey, depth+1, keyPath, cleartext, &childLines)
+			if len(childLines) > 0 {
+				*lines = append(*lines, fmt.Sprintf("%s%s:", indent, key))
+				*lines = append(*lines, childLines...)
+			}
+			continue
+		}
+		// ancestors of the selected key are only printed as part of the tree
+		if keyPath != "" && fullKey != keyPath && !strings.HasPrefix(fullKey, keyPath+".") {
+			continue
+		}
+
+		renderedValue := fmt.Sprintf("%v", value)
+		if !cleartext {
+			renderedValue = util.ToRedactedString(renderedValue)
+		}
+		line := fmt.Sprintf("%s%s: %s", indent, key, renderedValue)
+		if p, ok := provenance[fullKey]; ok {
+			line += color.InGray("  # " + p.Source)
+			if len(p.Overridden) > 0 {
+				line += color.InYellow(" (overrides " + strings.Join(p.Overridden, ", ") + ")")
+			}
+		}
+		*lines = append(*lines, line)
+	}
+}
+
+/*
+Checks whether the key is part of the selected key path,
+either as an ancestor or as a descendant of it
+*/
+func keyMatches(key string, keyPath string) bool {
+	if keyPath == "" || key == keyPath {
+		return true
+	}
+	return strings.HasPrefix(key, keyPath+".") || strings.HasPrefix(keyPath, key+".")
+}
@@ -0,0 +1,286 @@
+package templating
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Returns the functions available in secret templates.
+The function set is inspired by sprig but deliberately curated: all functions
+are deterministic and none of them access the network, so rendering a secret
+twice always yields the same result and plans stay stable.
+Templates additionally get the per-template functions of pathFunctions and ref,
+which resolves external references and may read files, environment variables or Vault.
+*/
+func FuncMap() template.FuncMap {
+	return template.FuncMap{
+		// encoding
+		"b64enc":       b64enc,
+		"b64dec":       b64dec,
+		"toJson":       toJson,
+		"toPrettyJson": toPrettyJson,
+		"toYaml":       toYaml,
+
+		// defaults and validation
+		"default":  defaultValue,
+		"required": required,
+		"empty":    empty,
+		"coalesce": coalesce,
+
+		// hashing
+		"sha1sum":        sha1sum,
+		"sha256sum":      sha256sum,
+		"bcryptWithSalt": bcryptWithSalt,
+
+		// strings
+		"indent":     indent,
+		"nindent":    nindent,
+		"quote":      quote,
+		"squote":     squote,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"replace":    func(old string, new string, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr string, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix string, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix string, s string) bool { return strings.HasSuffix(s, suffix) },
+		"join":       join,
+	}
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func b64enc(value interface{}) string {
+	return base64.StdEncoding.EncodeToString([]byte(toString(value)))
+}
+
+func b64dec(value interface{}) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(toString(value))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+/*
+yaml.v2 unmarshals objects into map[interface{}]interface{} which cannot be
+serialized by encoding/json, therefore all keys are converted to strings
+*/
+func toStringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			out[toString(key)] = toStringKeys(child)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			out[key] = toStringKeys(child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, child := range v {
+			out[i] = toStringKeys(child)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func toJson(value interface{}) (string, error) {
+	data, err := json.Marshal(toStringKeys(value))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func toPrettyJson(value interface{}) (string, error) {
+	data, err := json.MarshalIndent(toStringKeys(value), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func toYaml(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+/*
+Checks whether the given value is the zero value of its type
+*/
+func empty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+/*
+Returns the given value or the default if the value is empty
+Usage: {{ .Values.port | default 5432 }}
+*/
+func defaultValue(defaultValue interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || empty(value[0]) {
+		return defaultValue
+	}
+	return value[0]
+}
+
+/*
+Fails the rendering with the given message if the value is empty
+Usage: {{ required "database password is required" .Values.database.password }}
+*/
+func required(message string, value interface{}) (interface{}, error) {
+	if empty(value) {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+func coalesce(values ...interface{}) interface{} {
+	for _, value := range values {
+		if !empty(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+func sha1sum(value interface{}) string {
+	hash := sha1.Sum([]byte(toString(value)))
+	return hex.EncodeToString(hash[:])
+}
+
+func sha256sum(value interface{}) string {
+	hash := sha256.Sum256([]byte(toString(value)))
+	return hex.EncodeToString(hash[:])
+}
+
+/*
+Returns the functions whose result depends on the path of the templated file
+*/
+func pathFunctions(name string) template.FuncMap {
+	return template.FuncMap{
+		"bcrypt":   bcryptFunction(name),
+		"htpasswd": htpasswdFunction(name),
+	}
+}
+
+/*
+bcrypt template function of the template with the given name
+The salt is derived from the path of the secret file, so the hash is stable between renderings,
+but equal passwords in different secret files get different hashes
+Usage: {{ .Values.password | bcrypt }}
+*/
+func bcryptFunction(name string) func(interface{}) (string, error) {
+	salt := bcryptSaltFromString("bcrypt:" + name)
+	return func(password interface{}) (string, error) {
+		return bcryptHash([]byte(toString(password)), bcryptDefaultCost, salt)
+	}
+}
+
+/*
+Computes a bcrypt hash with a salt derived from the given salt string
+Usage: {{ .Values.password | bcryptWithSalt "my-fixed-salt" }}
+*/
+func bcryptWithSalt(salt string, password interface{}) (string, error) {
+	return bcryptHash([]byte(toString(password)), bcryptDefaultCost, bcryptSaltFromString(salt))
+}
+
+/*
+htpasswd template function of the template with the given name
+Creates an htpasswd entry using a bcrypt hash salted with the path of the secret file and the username
+Usage: {{ htpasswd .Values.username .Values.password }}
+*/
+func htpasswdFunction(name string) func(string, interface{}) (string, error) {
+	return func(username string, password interface{}) (string, error) {
+		if strings.Contains(username, ":") {
+			return "", errors.New("htpasswd: username must not contain ':'")
+		}
+		hash, err := bcryptHash([]byte(toString(password)), bcryptDefaultCost, bcryptSaltFromString("htpasswd:"+name+":"+username))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s:%s", username, hash), nil
+	}
+}
+
+func indent(spaces int, value interface{}) string {
+	padding := strings.Repeat(" ", spaces)
+	return padding + strings.ReplaceAll(toString(value), "\n", "\n"+padding)
+}
+
+func nindent(spaces int, value interface{}) string {
+	return "\n" + indent(spaces, value)
+}
+
+func quote(value interface{}) string {
+	return fmt.Sprintf("%q", toString(value))
+}
+
+func squote(value interface{}) string {
+	return fmt.Sprintf("'%s'", toString(value))
+}
+
+func join(separator string, values interface{}) string {
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return toString(values)
+	}
+	parts := make([]string, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		parts[i] = toString(v.Index(i).Interface())
+	}
+	return strings.Join(parts, separator)
+}
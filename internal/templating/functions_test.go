@@ -0,0 +1,95 @@
+package templating
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func renderString(t *testing.T, content string, values map[interface{}]interface{}) string {
+	rendered, err := Render("test", []byte(content), map[string]interface{}{
+		"Values": values,
+	})
+	assert.NoError(t, err)
+	return string(rendered)
+}
+
+func TestTemplateFunctionsEncoding(t *testing.T) {
+	values := map[interface{}]interface{}{
+		"username": "admin",
+		"database": map[interface{}]interface{}{
+			"host": "localhost",
+			"port": 5432,
+		},
+	}
+
+	assert.Equal(t, "YWRtaW4=", renderString(t, `{{ .Values.username | b64enc }}`, values))
+	assert.Equal(t, "admin", renderString(t, `{{ "YWRtaW4=" | b64dec }}`, values))
+	assert.Equal(t, `{"host":"localhost","port":5432}`, renderString(t, `{{ .Values.database | toJson }}`, values))
+	assert.Equal(t, "host: localhost\nport: 5432", renderString(t, `{{ .Values.database | toYaml }}`, values))
+}
+
+func TestTemplateFunctionsDefaults(t *testing.T) {
+	values := map[interface{}]interface{}{
+		"host":  "db.example.com",
+		"empty": "",
+	}
+
+	assert.Equal(t, "db.example.com:5432", renderString(t, `{{ .Values.host }}:{{ .Values.empty | default 5432 }}`, values))
+	assert.Equal(t, "db.example.com", renderString(t, `{{ .Values.host | default "localhost" }}`, values))
+	assert.Equal(t, "db.example.com", renderString(t, `{{ coalesce .Values.empty .Values.host }}`, values))
+	assert.Equal(t, "db.example.com", renderString(t, `{{ required "host is required" .Values.host }}`, values))
+
+	_, err := Render("test", []byte(`{{ required "value is required" .Values.empty }}`), map[string]interface{}{
+		"Values": values,
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "value is required")
+}
+
+func TestTemplateFunctionsStrings(t *testing.T) {
+	values := map[interface{}]interface{}{
+		"multiline": "foo\nbar",
+	}
+
+	assert.Equal(t, "  foo\n  bar", renderString(t, `{{ .Values.multiline | indent 2 }}`, values))
+	assert.Equal(t, "key:\n  foo\n  bar", renderString(t, `key:{{ .Values.multiline | nindent 2 }}`, values))
+	assert.Equal(t, `"foo\nbar"`, renderString(t, `{{ .Values.multiline | quote }}`, values))
+	assert.Equal(t, "FOO", renderString(t, `{{ "foo" | upper }}`, values))
+	assert.Equal(t, "a,b", renderString(t, `{{ .Values.list | join "," }}`, map[interface{}]interface{}{
+		"list": []interface{}{"a", "b"},
+	}))
+}
+
+func TestTemplateFunctionsHashing(t *testing.T) {
+	values := map[interface{}]interface{}{
+		"password": "my-very-strong-password",
+	}
+
+	assert.Equal(t, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", renderString(t, `{{ "foo" | sha256sum }}`, values))
+
+	hash := renderString(t, `{{ .Values.password | bcrypt }}`, values)
+	assert.True(t, strings.HasPrefix(hash, "$2a$10$"))
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("my-very-strong-password")))
+	assert.Equal(t, hash, renderString(t, `{{ .Values.password | bcrypt }}`, values), "bcrypt should be deterministic")
+
+	// the salt is derived from the path of the secret file, not from the password
+	otherHash, err := Render("other/path", []byte(`{{ .Values.password | bcrypt }}`), map[string]interface{}{"Values": values})
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, string(otherHash))
+	assert.NoError(t, bcrypt.CompareHashAndPassword(otherHash, []byte("my-very-strong-password")))
+
+	saltedHash := renderString(t, `{{ .Values.password | bcryptWithSalt "my-salt" }}`, values)
+	assert.NotEqual(t, hash, saltedHash)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(saltedHash), []byte("my-very-strong-password")))
+
+	entry := renderString(t, `{{ htpasswd "admin" .Values.password }}`, values)
+	assert.True(t, strings.HasPrefix(entry, "admin:$2a$10$"))
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(strings.TrimPrefix(entry, "admin:")), []byte("my-very-strong-password")))
+	assert.Equal(t, entry, renderString(t, `{{ htpasswd "admin" .Values.password }}`, values))
+	// equal passwords of different users get different hashes
+	otherEntry := renderString(t, `{{ htpasswd "guest" .Values.password }}`, values)
+	assert.NotEqual(t, strings.TrimPrefix(entry, "admin:"), strings.TrimPrefix(otherEntry, "guest:"))
+}
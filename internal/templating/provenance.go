@@ -0,0 +1,160 @@
+package templating
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Returns the values files applying to the given secret path in the order they are merged in:
+the directory hierarchy from the repository root towards the secret
+followed by the overlay values files of the environment
+*/
+func GetValuesChainForPath(path string, environment string) []*TemplateValuesPath {
+	ensureValuesLoaded(path)
+	return valuesChainForPath(path, environment)
+}
+
+func valuesChainForPath(path string, environment string) []*TemplateValuesPath {
+	chain := templateValues.chainForPath(path)
+	if environment != "" {
+		chain = append(chain, environmentValues[environment].chainForPath(path)...)
+	}
+	return chain
+}
+
+func (t TemplateValues) chainForPath(path string) []*TemplateValuesPath {
+	chain := []*TemplateValuesPath{}
+	for _, templateValue := range t {
+		if strings.HasPrefix(path, templateValue.Path) {
+			chain = append(chain, templateValue)
+		}
+	}
+	sort.SliceStable(chain, func(i, j int) bool {
+		return len(strings.Split(chain[i].Path, "/")) < len(strings.Split(chain[j].Path, "/"))
+	})
+	return chain
+}
+
+/*
+Origin of a single value of the merged values tree
+*/
+type ValueProvenance struct {
+	// values file that set the effective value
+	Source string
+	// values files of ancestor directories whose value was overridden, ordered from the root
+	Overridden []string
+}
+
+/*
+Returns the values file that set each value for the given secret path
+The map is keyed by the dot separated key path of the value, e.g. "database.password"
+*/
+func GetValueSourcesForPath(path string, environment string) map[string]string {
+	ensureValuesLoaded(path)
+	sources := map[string]string{}
+	for key, provenance := range provenanceForChain(valuesChainForPath(path, environment)) {
+		sources[key] = provenance.Source
+	}
+	return sources
+}
+
+/*
+Returns the provenance of every leaf value for the given secret path
+keyed by the dot separated key path of the value
+*/
+func GetValueProvenanceForPath(path string, environment string) map[string]*ValueProvenance {
+	ensureValuesLoaded(path)
+	return provenanceForChain(valuesChainForPath(path, environment))
+}
+
+func provenanceForChain(chain []*TemplateValuesPath) map[string]*ValueProvenance {
+	provenance := map[string]*ValueProvenance{}
+	merged := map[interface{}]interface{}{}
+	for _, templateValue := range chain {
+		merged = mergeMapsWithProvenance(merged, templateValue.Values, "", templateValue.File, provenance)
+	}
+
+	// overridden values files are reported in merge order
+	order := map[string]int{}
+	for i, templateValue := range chain {
+		order[templateValue.File] = i
+	}
+	for _, p := range provenance {
+		sort.SliceStable(p.Overridden, func(i, j int) bool {
+			return order[p.Overridden[i]] < order[p.Overridden[j]]
+		})
+	}
+	return provenance
+}
+
+/*
+Merges b into a the same way mergeMaps does
+while recording the provenance of every value that is set by b
+*/
+func mergeMapsWithProvenance(a, b map[interface{}]interface{}, prefix string, source string, provenance map[string]*ValueProvenance) map[interface{}]interface{} {
+	out := make(map[interface{}]interface{}, len(a))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		key := joinValueKey(prefix, k)
+		if v, ok := v.(map[interface{}]interface{}); ok {
+			if bv, ok := out[k]; ok {
+				if bv, ok := bv.(map[interface{}]interface{}); ok {
+					out[k] = mergeMapsWithProvenance(bv, v, key, source, provenance)
+					continue
+				}
+			}
+		}
+		// the value replaces whatever was set before, including nested values
+		overridden := []string{}
+		for existingKey, existing := range provenance {
+			if existingKey == key || strings.HasPrefix(existingKey, key+".") {
+				overridden = appendUnique(overridden, existing.Overridden...)
+				overridden = appendUnique(overridden, existing.Source)
+				delete(provenance, existingKey)
+			}
+		}
+		addValueProvenance(v, key, source, overridden, provenance)
+		out[k] = v
+	}
+	return out
+}
+
+func addValueProvenance(value interface{}, key string, source string, overridden []string, provenance map[string]*ValueProvenance) {
+	if m, ok := value.(map[interface{}]interface{}); ok && len(m) > 0 {
+		for k, v := range m {
+			addValueProvenance(v, joinValueKey(key, k), source, overridden, provenance)
+		}
+		return
+	}
+	provenance[key] = &ValueProvenance{
+		Source:     source,
+		Overridden: overridden,
+	}
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+func joinValueKey(prefix string, key interface{}) string {
+	if prefix == "" {
+		return fmt.Sprintf("%v", key)
+	}
+	return fmt.Sprintf("%s.%v", prefix, key)
+}
@@ -0,0 +1,122 @@
+package templating
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mxcd/gitops-cli/internal/util"
+)
+
+/*
+Resolves references to values stored outside of the secret files,
+e.g. in a password manager or Vault
+Usage: {{ ref "<scheme>:<reference>" }}
+*/
+type Resolver interface {
+	Resolve(reference string, context ResolverContext) (string, error)
+}
+
+type ResolverContext struct {
+	// Path of the templated file relative to the root dir
+	Path string
+}
+
+var resolvers = map[string]Resolver{}
+
+func init() {
+	RegisterResolver("file", &FileResolver{})
+	RegisterResolver("env", &EnvResolver{})
+	RegisterResolver("vault", &VaultResolver{})
+}
+
+/*
+Registers a resolver for references with the given scheme, replacing an existing resolver
+*/
+func RegisterResolver(scheme string, resolver Resolver) {
+	resolvers[scheme] = resolver
+}
+
+func GetResolver(scheme string) Resolver {
+	return resolvers[scheme]
+}
+
+/*
+Resolves a reference of the form <scheme>:<reference> with the registered resolver of its scheme
+*/
+func ResolveReference(ref string, context ResolverContext) (string, error) {
+	scheme, reference, found := strings.Cut(ref, ":")
+	if !found || scheme == "" || reference == "" {
+		return "", fmt.Errorf("reference '%s' must have the form '<scheme>:<reference>'", ref)
+	}
+	resolver := GetResolver(scheme)
+	if resolver == nil {
+		return "", fmt.Errorf("unknown reference scheme '%s', available schemes: %s", scheme, strings.Join(resolverSchemes(), ", "))
+	}
+	value, err := resolver.Resolve(reference, context)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve '%s': %w", ref, err)
+	}
+	return value, nil
+}
+
+func resolverSchemes() []string {
+	schemes := make([]string, 0, len(resolvers))
+	for scheme := range resolvers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+/*
+ref template function of the template with the given name
+*/
+func refFunction(name string) func(string) (string, error) {
+	return func(ref string) (string, error) {
+		return ResolveReference(ref, ResolverContext{Path: name})
+	}
+}
+
+/*
+Reads the content of a file. Relative paths are resolved from the directory of the templated file.
+Only files below the root dir can be referenced, so secret files cannot read arbitrary files of the machine.
+Usage: {{ ref "file:../certs/ca.pem" }}
+*/
+type FileResolver struct{}
+
+func (r *FileResolver) Resolve(reference string, context ResolverContext) (string, error) {
+	relativePath := path.Join(path.Dir(context.Path), filepath.ToSlash(reference))
+	if filepath.IsAbs(reference) {
+		rel, err := filepath.Rel(util.GetRootDir(), reference)
+		if err != nil {
+			return "", fmt.Errorf("file '%s' is outside of the root dir", reference)
+		}
+		relativePath = filepath.ToSlash(rel)
+	}
+	if relativePath == ".." || strings.HasPrefix(relativePath, "../") {
+		return "", fmt.Errorf("file '%s' is outside of the root dir", reference)
+	}
+	content, err := util.GetFileSource().ReadFile(relativePath)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+/*
+Reads an environment variable, unset variables are an error
+Usage: {{ ref "env:DATABASE_PASSWORD" }}
+*/
+type EnvResolver struct{}
+
+func (r *EnvResolver) Resolve(reference string, context ResolverContext) (string, error) {
+	value, ok := os.LookupEnv(reference)
+	if !ok {
+		return "", fmt.Errorf("environment variable '%s' is not set", reference)
+	}
+	return value, nil
+}
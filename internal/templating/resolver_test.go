@@ -0,0 +1,118 @@
+package templating
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mxcd/gitops-cli/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+type staticResolver map[string]string
+
+func (r staticResolver) Resolve(reference string, context ResolverContext) (string, error) {
+	return r[reference], nil
+}
+
+func TestRefEnvAndFile(t *testing.T) {
+	t.Setenv("GITOPS_TEST_REF", "from-env")
+	assert.Equal(t, "from-env", renderString(t, `{{ ref "env:GITOPS_TEST_REF" }}`, nil))
+
+	_, err := Render("test", []byte(`{{ ref "env:GITOPS_TEST_REF_UNSET" }}`), nil)
+	assert.ErrorContains(t, err, "environment variable 'GITOPS_TEST_REF_UNSET' is not set")
+
+	// relative paths are resolved from the directory of the templated file
+	rendered, err := Render("test_assets/app.gitops.secret.enc.yml", []byte(`{{ ref "file:keys.txt" }}`), nil)
+	assert.NoError(t, err)
+	assert.Contains(t, string(rendered), "AGE-SECRET-KEY")
+
+	rendered, err = Render("test", []byte(`{{ ref "file:`+filepath.Join(util.GetRootDir(), "test_assets", "keys.txt")+`" }}`), nil)
+	assert.NoError(t, err)
+	assert.Contains(t, string(rendered), "AGE-SECRET-KEY")
+
+	// files outside of the root dir cannot be referenced
+	certificate := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(certificate, []byte("my-certificate"), 0600))
+	_, err = Render("test", []byte(`{{ ref "file:`+certificate+`" }}`), nil)
+	assert.ErrorContains(t, err, "is outside of the root dir")
+	_, err = Render("test_assets/app.gitops.secret.enc.yml", []byte(`{{ ref "file:../../etc/passwd" }}`), nil)
+	assert.ErrorContains(t, err, "is outside of the root dir")
+}
+
+func TestRefUnknownScheme(t *testing.T) {
+	_, err := Render("test", []byte(`{{ ref "passwordstore:app/password" }}`), nil)
+	assert.ErrorContains(t, err, "unknown reference scheme 'passwordstore'")
+
+	_, err = Render("test", []byte(`{{ ref "no-scheme" }}`), nil)
+	assert.ErrorContains(t, err, "must have the form '<scheme>:<reference>'")
+}
+
+func TestRefCustomResolver(t *testing.T) {
+	RegisterResolver("static", staticResolver{"app/password": "my-password"})
+	defer delete(resolvers, "static")
+
+	assert.Equal(t, "my-password", renderString(t, `{{ ref "static:app/password" }}`, nil))
+}
+
+func TestVaultResolver(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("X-Vault-Token") != "my-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/data/app":
+			w.Write([]byte(`{"data":{"data":{"password":"kv2-password","port":5432},"metadata":{"version":3}}}`))
+		case "/v1/secret/app":
+			w.Write([]byte(`{"data":{"password":"kv1-password"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	resolver := &VaultResolver{Address: server.URL, Token: "my-token"}
+
+	value, err := resolver.Resolve("kv/data/app#password", ResolverContext{})
+	assert.NoError(t, err)
+	assert.Equal(t, "kv2-password", value)
+
+	value, err = resolver.Resolve("kv/data/app#port", ResolverContext{})
+	assert.NoError(t, err)
+	assert.Equal(t, "5432", value)
+	assert.Equal(t, 1, requests)
+
+	value, err = resolver.Resolve("secret/app#password", ResolverContext{})
+	assert.NoError(t, err)
+	assert.Equal(t, "kv1-password", value)
+
+	_, err = resolver.Resolve("kv/data/app#user", ResolverContext{})
+	assert.ErrorContains(t, err, "has no field 'user'")
+
+	_, err = resolver.Resolve("kv/data/missing#password", ResolverContext{})
+	assert.ErrorContains(t, err, "status 404")
+
+	_, err = resolver.Resolve("kv/data/app", ResolverContext{})
+	assert.ErrorContains(t, err, "must have the form '<path>#<field>'")
+
+	_, err = (&VaultResolver{Address: server.URL, Token: "wrong-token"}).Resolve("kv/data/app#password", ResolverContext{})
+	assert.ErrorContains(t, err, "status 403")
+}
+
+func TestVaultResolverFromEnvironment(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":{"data":{"password":"` + r.Header.Get("X-Vault-Token") + `"},"metadata":{}}}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "env-token")
+	RegisterResolver("vault", &VaultResolver{})
+
+	assert.Equal(t, "env-token", renderString(t, `{{ ref "vault:kv/data/app#password" }}`, nil))
+}
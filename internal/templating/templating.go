@@ -1,14 +1,16 @@
 package templating
 
 import (
+	"bytes"
 	"fmt"
-	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/urfave/cli/v2"
 
 	"github.com/mxcd/gitops-cli/internal/util"
 	"gopkg.in/yaml.v2"
@@ -18,15 +20,34 @@ type TemplateValues []*TemplateValuesPath
 
 var templateValues = TemplateValues{}
 
+// environment overlay values files by environment name
+var environmentValues = map[string]TemplateValues{}
+
+// environments with an overlay values file anywhere in the repository, regardless of the --dir limit
+var knownEnvironments = map[string]bool{}
+
 type TemplateValuesPath struct {
 	Path         string
+	File         string
+	// environment of an overlay values file, empty for regular values files
+	Environment  string
 	Values       map[interface{}]interface{}
 	MergedValues map[interface{}]interface{}
 }
 
 var loaded = false
 
+// file source the values were loaded from, values are reloaded once the source changes
+var loadedFrom util.FileSource
+
+// normalized directory limit the loaded values files were filtered by, empty if all values files are loaded
+var loadedDirLimit string
+
 func LoadValues() error {
+	return loadValues(util.GetCliContext().String("dir"))
+}
+
+func loadValues(dirLimit string) error {
 	log.Trace("Loading values files")
 	secretFiles, err := util.GetSecretFiles()
 	if err != nil {
@@ -34,43 +55,62 @@ func LoadValues() error {
 	}
 	var valuesFiles []string
 	for _, secretFile := range secretFiles {
-		if strings.HasSuffix(secretFile, "values.gitops.secret.enc.yaml") || strings.HasSuffix(secretFile, "values.gitops.secret.enc.yml") {
+		if util.IsValuesFile(secretFile) {
 			valuesFiles = append(valuesFiles, secretFile)
 		}
 	}
 
-	valuesFiles = filterValuesFiles(valuesFiles, util.GetCliContext().String("dir"))
+	knownEnvironments = map[string]bool{}
+	for _, valuesFile := range valuesFiles {
+		if environment := util.GetValuesFileEnvironment(valuesFile); environment != "" {
+			knownEnvironments[environment] = true
+		}
+	}
+
+	valuesFiles = filterValuesFiles(valuesFiles, dirLimit)
 
 	templateValues = TemplateValues{}
+	environmentValues = map[string]TemplateValues{}
 
 	for _, valuesFile := range valuesFiles {
 		log.Trace("Loading secret values file: ", valuesFile)
-		absoluteSecretPath := path.Join(util.GetRootDir(), valuesFile)
-		decryptedFileContent, err := util.DecryptFile(absoluteSecretPath)
+		decryptedFileContent, err := util.DecryptSourceFile(valuesFile)
 		if err != nil {
 			return err
 		}
 		var values map[interface{}]interface{}
 		yaml.UnmarshalStrict(decryptedFileContent, &values)
-		templateValues = append(templateValues, &TemplateValuesPath{
-			Path:   fmt.Sprintf("%s/", filepath.ToSlash(filepath.Dir(valuesFile))),
-			Values: values,
-		})
+		templateValue := &TemplateValuesPath{
+			Path:        fmt.Sprintf("%s/", filepath.ToSlash(filepath.Dir(valuesFile))),
+			File:        valuesFile,
+			Environment: util.GetValuesFileEnvironment(valuesFile),
+			Values:      values,
+		}
+		if templateValue.Environment != "" {
+			environmentValues[templateValue.Environment] = append(environmentValues[templateValue.Environment], templateValue)
+			continue
+		}
+		templateValues = append(templateValues, templateValue)
 	}
 
 	templateValues.merge()
 	loaded = true
+	loadedFrom = util.GetFileSource()
+	loadedDirLimit = normalizeDirLimit(dirLimit)
 	return nil
 }
 
-func filterValuesFiles(valuesFiles []string, dirLimit string) []string {
+func normalizeDirLimit(dirLimit string) string {
 	// If dirLimit points to a secret file, extract its directory
 	if strings.HasSuffix(dirLimit, ".gitops.secret.enc.yaml") || strings.HasSuffix(dirLimit, ".gitops.secret.enc.yml") {
 		dirLimit = filepath.Dir(dirLimit)
 		log.Debugf("Converted file-based dir limit to directory: %q", dirLimit)
 	}
-	
-	dirLimitNormalized := normalizeDirPath(dirLimit)
+	return normalizeDirPath(dirLimit)
+}
+
+func filterValuesFiles(valuesFiles []string, dirLimit string) []string {
+	dirLimitNormalized := normalizeDirLimit(dirLimit)
 	log.Debugf("Filtering values files with dirLimit=%q normalized=%q", dirLimit, dirLimitNormalized)
 	if dirLimitNormalized == "" {
 		return valuesFiles
@@ -161,14 +201,30 @@ func (t TemplateValues) merge() {
 	}
 }
 
-func GetValuesForPath(path string) map[interface{}]interface{} {
-	log.Debugf("Resolving values for secret path %q", path)
-	if !loaded {
+/*
+Loads the values files on first use and once the file source changes
+The values files outside of the --dir limit are loaded as soon as a path outside of it is requested,
+e.g. for a secret referenced from within the limit
+*/
+func ensureValuesLoaded(path string) {
+	if !loaded || loadedFrom != util.GetFileSource() {
 		err := LoadValues()
 		if err != nil {
 			log.Panic(err)
 		}
 	}
+	if loadedDirLimit != "" && !strings.HasPrefix(normalizeDirPath(filepath.Dir(path)), loadedDirLimit) {
+		log.Debugf("Loading all values files for %q outside of the directory limit %q", path, loadedDirLimit)
+		err := loadValues("")
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+func GetValuesForPath(path string) map[interface{}]interface{} {
+	log.Debugf("Resolving values for secret path %q", path)
+	ensureValuesLoaded(path)
 	values := map[interface{}]interface{}{}
 	usedPath := ""
 	maxPathLength := 0
@@ -191,18 +247,99 @@ func GetValuesForPath(path string) map[interface{}]interface{} {
 	return values
 }
 
-func TestTemplating(c *cli.Context) error {
-	secretFiles, err := util.GetSecretFiles()
+/*
+Returns the values for the given path with the overlay values files of the environment
+merged on top of the directory hierarchy. Overlays are merged from the root towards the path.
+An environment without any overlay values file in the repository is an error, it is most likely misspelled.
+*/
+func GetValuesForEnvironment(path string, environment string) (map[interface{}]interface{}, error) {
+	values := GetValuesForPath(path)
+	if environment == "" {
+		return values, nil
+	}
+	if !knownEnvironments[environment] {
+		return nil, fmt.Errorf("unknown environment '%s': no values.%s.gitops.secret.enc.yml file exists", environment, environment)
+	}
+	for _, templateValue := range environmentValues[environment].chainForPath(path) {
+		log.Debugf("Merging %s values from %s for path %s", environment, templateValue.File, path)
+		values = mergeMaps(values, templateValue.Values)
+	}
+	return values, nil
+}
+
+/*
+Renders the given template content using the secret templating functions
+Missing keys in the template data cause an error unless --allow-missing-keys is set
+*/
+func Render(name string, content []byte, data interface{}) ([]byte, error) {
+	return RenderWithFunctions(name, content, data, nil)
+}
+
+/*
+Renders the given template content like Render with additional template functions
+that are not part of the deterministic function library, e.g. secretRef
+*/
+func RenderWithFunctions(name string, content []byte, data interface{}, functions template.FuncMap) ([]byte, error) {
+	return render(name, content, data, functions, util.GetCliContext().Bool("allow-missing-keys"))
+}
+
+func render(name string, content []byte, data interface{}, functions template.FuncMap, allowMissingKeys bool) ([]byte, error) {
+	missingKeyOption := "missingkey=error"
+	if allowMissingKeys {
+		missingKeyOption = "missingkey=default"
+	}
+
+	tmpl, err := template.New(name).Funcs(FuncMap()).Funcs(pathFunctions(name)).Funcs(template.FuncMap{"ref": refFunction(name)}).Funcs(functions).Option(missingKeyOption).Parse(string(content))
 	if err != nil {
-		log.Fatal(err)
+		return nil, newTemplateError(name, err)
 	}
-	for _, secretFile := range secretFiles {
-		log.Debug(secretFile)
-		decryptedFile, err := util.DecryptFile(secretFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Trace(string(decryptedFile))
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, data)
+	if err != nil {
+		return nil, newTemplateError(name, err)
 	}
-	return nil
+	return buf.Bytes(), nil
+}
+
+type TemplateError struct {
+	// Path of the templated file
+	Path string
+	// Line of the template causing the error, 0 if unknown
+	Line int
+	// Original error of the template engine
+	Err error
+	// description of the error without the template engine prefix
+	message string
+}
+
+// execution errors carry name:line:col, parse errors only name:line
+var templateErrorRegex = regexp.MustCompile(`^template: .*?:(\d+)(?::(\d+))?: (?:executing ".*?" )?(.*)$`)
+
+func newTemplateError(path string, err error) *TemplateError {
+	templateError := &TemplateError{
+		Path:    path,
+		Err:     err,
+		message: err.Error(),
+	}
+	matches := templateErrorRegex.FindStringSubmatch(err.Error())
+	if matches != nil {
+		templateError.Line, _ = strconv.Atoi(matches[1])
+		templateError.message = matches[3]
+	}
+	return templateError
+}
+
+func (e *TemplateError) Error() string {
+	message := e.message
+	if strings.Contains(message, "map has no entry for key") {
+		message = fmt.Sprintf("%s (use --allow-missing-keys to render missing keys as <no value>)", message)
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, message)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, message)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
 }
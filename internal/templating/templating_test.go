@@ -235,3 +235,203 @@ func TestFilterValuesFiles(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderMissingKeyStrict(t *testing.T) {
+	content := []byte("targetType: k8s\ndata:\n  password: '{{ .Values.db.pasword }}'\n")
+	values := map[string]interface{}{
+		"Values": map[interface{}]interface{}{
+			"db": map[interface{}]interface{}{
+				"password": "secret",
+			},
+		},
+	}
+
+	_, err := render("foo/bar.gitops.secret.enc.yml", content, values, nil, false)
+	assert.Error(t, err)
+
+	var templateError *TemplateError
+	assert.ErrorAs(t, err, &templateError)
+	assert.Equal(t, "foo/bar.gitops.secret.enc.yml", templateError.Path)
+	assert.Equal(t, 3, templateError.Line)
+	assert.Contains(t, err.Error(), "foo/bar.gitops.secret.enc.yml:3:")
+	assert.Contains(t, err.Error(), `map has no entry for key "pasword"`)
+}
+
+func TestRenderParseErrorLine(t *testing.T) {
+	content := []byte("targetType: k8s\ndata:\n  password: '{{ .Values.db.password }'\n")
+
+	_, err := render("foo/bar.gitops.secret.enc.yml", content, map[string]interface{}{}, nil, false)
+	var templateError *TemplateError
+	assert.ErrorAs(t, err, &templateError)
+	assert.Equal(t, 3, templateError.Line)
+	assert.Regexp(t, `^foo/bar.gitops.secret.enc.yml:3: `, err.Error())
+	assert.NotContains(t, err.Error(), "template:")
+}
+
+func TestRenderMissingKeyAllowed(t *testing.T) {
+	content := []byte("password: '{{ .Values.db.pasword }}'")
+	values := map[string]interface{}{
+		"Values": map[interface{}]interface{}{
+			"db": map[interface{}]interface{}{
+				"password": "secret",
+			},
+		},
+	}
+
+	rendered, err := render("foo/bar.gitops.secret.enc.yml", content, values, nil, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "password: '<no value>'", string(rendered))
+}
+
+func TestValueSourcesForPath(t *testing.T) {
+	templateValues := TemplateValues{
+		&TemplateValuesPath{
+			Path: "foo/bar/",
+			File: "foo/bar/values.gitops.secret.enc.yml",
+			Values: map[interface{}]interface{}{
+				"stage": "bar",
+				"database": map[interface{}]interface{}{
+					"password": "bar-password",
+				},
+			},
+		},
+		&TemplateValuesPath{
+			Path: "foo/",
+			File: "foo/values.gitops.secret.enc.yml",
+			Values: map[interface{}]interface{}{
+				"stage":     "foo",
+				"namespace": "foo",
+				"database": map[interface{}]interface{}{
+					"user":     "foo-user",
+					"password": "foo-password",
+				},
+			},
+		},
+		&TemplateValuesPath{
+			Path: "fizz/",
+			File: "fizz/values.gitops.secret.enc.yml",
+			Values: map[interface{}]interface{}{
+				"stage": "fizz",
+			},
+		},
+	}
+
+	chain := templateValues.chainForPath("foo/bar/my-secret.gitops.secret.enc.yml")
+	assert.Len(t, chain, 2)
+	assert.Equal(t, "foo/values.gitops.secret.enc.yml", chain[0].File)
+	assert.Equal(t, "foo/bar/values.gitops.secret.enc.yml", chain[1].File)
+
+	provenance := provenanceForChain(chain)
+	assert.Equal(t, map[string]*ValueProvenance{
+		"stage": {
+			Source:     "foo/bar/values.gitops.secret.enc.yml",
+			Overridden: []string{"foo/values.gitops.secret.enc.yml"},
+		},
+		"namespace": {
+			Source:     "foo/values.gitops.secret.enc.yml",
+			Overridden: []string{},
+		},
+		"database.user": {
+			Source:     "foo/values.gitops.secret.enc.yml",
+			Overridden: []string{},
+		},
+		"database.password": {
+			Source:     "foo/bar/values.gitops.secret.enc.yml",
+			Overridden: []string{"foo/values.gitops.secret.enc.yml"},
+		},
+	}, provenance)
+}
+
+func TestExplainValues(t *testing.T) {
+	values := map[interface{}]interface{}{
+		"stage": "bar",
+		"database": map[interface{}]interface{}{
+			"user":     "foo-user",
+			"password": "bar-password",
+		},
+	}
+	provenance := map[string]*ValueProvenance{
+		"stage":             {Source: "foo/bar/values.gitops.secret.enc.yml", Overridden: []string{"foo/values.gitops.secret.enc.yml"}},
+		"database.user":     {Source: "foo/values.gitops.secret.enc.yml"},
+		"database.password": {Source: "foo/bar/values.gitops.secret.enc.yml", Overridden: []string{"foo/values.gitops.secret.enc.yml"}},
+	}
+
+	lines := explainValues(values, provenance, "", true)
+	assert.Len(t, lines, 4)
+	assert.Equal(t, "database:", lines[0])
+	assert.Contains(t, lines[1], "  password: bar-password")
+	assert.Contains(t, lines[1], "foo/bar/values.gitops.secret.enc.yml")
+	assert.Contains(t, lines[1], "overrides foo/values.gitops.secret.enc.yml")
+	assert.Contains(t, lines[2], "  user: foo-user")
+	assert.NotContains(t, lines[2], "overrides")
+	assert.Contains(t, lines[3], "stage: bar")
+
+	lines = explainValues(values, provenance, "database.password", false)
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[1], "  password: ************")
+
+	assert.Empty(t, explainValues(values, provenance, "database.host", false))
+}
+
+func TestValuesForEnvironment(t *testing.T) {
+	previousTemplateValues, previousEnvironmentValues, previousKnownEnvironments, previousLoaded, previousLoadedFrom := templateValues, environmentValues, knownEnvironments, loaded, loadedFrom
+	defer func() {
+		templateValues, environmentValues, knownEnvironments, loaded, loadedFrom = previousTemplateValues, previousEnvironmentValues, previousKnownEnvironments, previousLoaded, previousLoadedFrom
+	}()
+
+	templateValues = TemplateValues{
+		&TemplateValuesPath{
+			Path:   "foo/",
+			File:   "foo/values.gitops.secret.enc.yml",
+			Values: map[interface{}]interface{}{"stage": "dev", "host": "db.foo"},
+		},
+		&TemplateValuesPath{
+			Path:   "foo/bar/",
+			File:   "foo/bar/values.gitops.secret.enc.yml",
+			Values: map[interface{}]interface{}{"host": "db.bar", "user": "bar"},
+		},
+	}
+	templateValues.merge()
+	environmentValues = map[string]TemplateValues{
+		"prod": {
+			&TemplateValuesPath{
+				Path:        "foo/",
+				File:        "foo/values.prod.gitops.secret.enc.yml",
+				Environment: "prod",
+				Values:      map[interface{}]interface{}{"stage": "prod", "host": "db.prod"},
+			},
+		},
+	}
+	// the qa overlays live outside of the directory limit the values were loaded with
+	knownEnvironments = map[string]bool{"prod": true, "qa": true}
+	loaded = true
+	loadedFrom = util.GetFileSource()
+
+	secretPath := "foo/bar/my-secret.gitops.secret.enc.yml"
+	values, err := GetValuesForEnvironment(secretPath, "")
+	assert.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{"stage": "dev", "host": "db.bar", "user": "bar"}, values)
+	values, err = GetValuesForEnvironment(secretPath, "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{"stage": "prod", "host": "db.prod", "user": "bar"}, values)
+	// no overlay applies to this path, but the environment exists
+	values, err = GetValuesForEnvironment("other/my-secret.gitops.secret.enc.yml", "prod")
+	assert.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{}, values)
+
+	values, err = GetValuesForEnvironment(secretPath, "qa")
+	assert.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{"stage": "dev", "host": "db.bar", "user": "bar"}, values)
+
+	_, err = GetValuesForEnvironment(secretPath, "staging")
+	assert.ErrorContains(t, err, "unknown environment 'staging'")
+
+	chain := GetValuesChainForPath(secretPath, "prod")
+	assert.Len(t, chain, 3)
+	assert.Equal(t, "foo/values.prod.gitops.secret.enc.yml", chain[2].File)
+
+	provenance := GetValueProvenanceForPath(secretPath, "prod")
+	assert.Equal(t, "foo/values.prod.gitops.secret.enc.yml", provenance["host"].Source)
+	assert.Equal(t, []string{"foo/values.gitops.secret.enc.yml", "foo/bar/values.gitops.secret.enc.yml"}, provenance["host"].Overridden)
+	assert.Equal(t, "foo/bar/values.gitops.secret.enc.yml", provenance["user"].Source)
+}
@@ -0,0 +1,125 @@
+package templating
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Reads a field of a secret from the Vault KV secrets engine (version 1 and 2)
+The address and token are taken from VAULT_ADDR and VAULT_TOKEN unless set on the resolver
+Usage: {{ ref "vault:kv/data/app#password" }}
+*/
+type VaultResolver struct {
+	// Address of the Vault server, defaults to VAULT_ADDR
+	Address string
+	// Token used to authenticate, defaults to VAULT_TOKEN
+	Token string
+	// HTTP client used for requests, defaults to http.DefaultClient
+	Client *http.Client
+
+	// secrets read during this run by path, so every secret is only requested once
+	cache map[string]map[string]interface{}
+	mutex sync.Mutex
+}
+
+func (r *VaultResolver) Resolve(reference string, context ResolverContext) (string, error) {
+	secretPath, field, found := strings.Cut(reference, "#")
+	if !found || secretPath == "" || field == "" {
+		return "", fmt.Errorf("vault reference '%s' must have the form '<path>#<field>'", reference)
+	}
+
+	data, err := r.read(secretPath)
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret '%s' has no field '%s'", secretPath, field)
+	}
+	if stringValue, ok := value.(string); ok {
+		return stringValue, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+func (r *VaultResolver) read(secretPath string) (map[string]interface{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if data, ok := r.cache[secretPath]; ok {
+		return data, nil
+	}
+
+	address := r.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, errors.New("vault address is not set: set VAULT_ADDR")
+	}
+	token := r.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	requestURL := fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(address, "/"), strings.TrimPrefix(secretPath, "/"))
+	log.Debug("Reading vault secret ", requestURL)
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault secret '%s': %w", secretPath, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to read vault secret '%s': status %d", secretPath, resp.StatusCode)
+	}
+
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vault secret '%s': %w", secretPath, err)
+	}
+
+	data := response.Data
+	// the KV version 2 engine wraps the secret data together with its metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := data["metadata"]; hasMetadata {
+			data = nested
+		}
+	}
+
+	if r.cache == nil {
+		r.cache = map[string]map[string]interface{}{}
+	}
+	r.cache[secretPath] = data
+	return data, nil
+}
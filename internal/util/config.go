@@ -0,0 +1,238 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+var repoConfigFiles = []string{".gitops.yaml", ".gitops.yml"}
+
+/*
+Repository configuration in .gitops.yaml at the root dir
+Usage:
+
+	defaults:
+	  dir: apps
+	  show-unchanged: true
+	defaultTarget: production
+	clusters:
+	  production:
+	    configFile: ~/.kube/production
+	    environment: prod
+	secrets:
+	  include:
+	    - apps/**
+	  exclude:
+	    - apps/legacy/**
+*/
+type RepoConfig struct {
+	// File the configuration was loaded from, empty if there is none
+	File string `yaml:"-"`
+	// Defaults of command line flags by flag name, flags and environment variables take precedence
+	Defaults map[string]interface{} `yaml:"defaults,omitempty"`
+	// Target of secret files that do not set a target, defaults to the cluster of the KUBECONFIG
+	DefaultTarget string `yaml:"defaultTarget,omitempty"`
+	// Clusters available in addition to the clusters of the state
+	Clusters map[string]*RepoClusterConfig `yaml:"clusters,omitempty"`
+	// Secret file discovery
+	Secrets SecretsConfig `yaml:"secrets,omitempty"`
+}
+
+type RepoClusterConfig struct {
+	// Kubeconfig file of the cluster
+	ConfigFile string `yaml:"configFile"`
+	// Environment used to select the overlay values files for secrets of the cluster
+	Environment string `yaml:"environment,omitempty"`
+}
+
+type SecretsConfig struct {
+	// Globs of secret files to include, all secret files if empty
+	Include []string `yaml:"include,omitempty"`
+	// Globs of secret files to exclude
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+var repoConfig *RepoConfig
+
+// names of the flags set from the defaults of the repository config
+var appliedRepoConfigDefaults = map[string]bool{}
+
+/*
+Returns the repository configuration of the root dir, loading it on first use
+*/
+func GetRepoConfig() (*RepoConfig, error) {
+	if repoConfig != nil {
+		return repoConfig, nil
+	}
+	config, err := LoadRepoConfig(GetRootDir())
+	if err != nil {
+		return nil, err
+	}
+	repoConfig = config
+	return repoConfig, nil
+}
+
+func LoadRepoConfig(rootDir string) (*RepoConfig, error) {
+	config := &RepoConfig{}
+	for _, configFile := range repoConfigFiles {
+		content, err := os.ReadFile(path.Join(rootDir, configFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Trace("Loading repository config ", configFile)
+		err = yaml.UnmarshalStrict(content, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse repository config '%s': %w", configFile, err)
+		}
+		config.File = configFile
+		return config, nil
+	}
+	return config, nil
+}
+
+/*
+Checks whether a secret file (relative to the root dir) is selected by the include and exclude globs
+*/
+func (c *SecretsConfig) Matches(relativePath string) bool {
+	for _, exclude := range c.Exclude {
+		if MatchGlob(exclude, relativePath) {
+			return false
+		}
+	}
+	if len(c.Include) == 0 {
+		return true
+	}
+	for _, include := range c.Include {
+		if MatchGlob(include, relativePath) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the target of secret files that do not set a target
+*/
+func GetDefaultTarget() string {
+	config, err := GetRepoConfig()
+	if err != nil || config.DefaultTarget == "" {
+		return string(DefaultClusterClient)
+	}
+	return config.DefaultTarget
+}
+
+/*
+Sets the flags of the current command that are neither given on the command line
+nor by an environment variable to the defaults of the repository config
+*/
+func ApplyRepoConfigDefaults(c *cli.Context) error {
+	config, err := GetRepoConfig()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(config.Defaults))
+	for name := range config.Defaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	knownFlags := GetAllFlags(c.App)
+	for _, name := range names {
+		if _, ok := knownFlags[name]; !ok {
+			log.Warn("Unknown flag '", name, "' in defaults of ", config.File)
+			continue
+		}
+		if !hasFlag(c, name) || c.IsSet(name) {
+			continue
+		}
+		value := FormatRepoConfigValue(config.Defaults[name])
+		log.Trace("Setting flag '", name, "' to default '", value, "' of ", config.File)
+		err := c.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("invalid default for flag '%s' in %s: %w", name, config.File, err)
+		}
+		appliedRepoConfigDefaults[name] = true
+	}
+	return nil
+}
+
+/*
+Checks whether the flag with the given name was set from the defaults of the repository config
+*/
+func IsRepoConfigDefault(name string) bool {
+	return appliedRepoConfigDefaults[name]
+}
+
+func FormatRepoConfigValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+/*
+Returns all flags of the application and its commands by name
+The first definition of a flag name wins
+*/
+func GetAllFlags(app *cli.App) map[string]cli.Flag {
+	flags := map[string]cli.Flag{}
+	addFlags := func(commandFlags []cli.Flag) {
+		for _, flag := range commandFlags {
+			for _, name := range flag.Names() {
+				if _, ok := flags[name]; !ok {
+					flags[name] = flag
+				}
+			}
+		}
+	}
+	var addCommands func(commands []*cli.Command)
+	addCommands = func(commands []*cli.Command) {
+		for _, command := range commands {
+			addFlags(command.Flags)
+			addCommands(command.Subcommands)
+		}
+	}
+	if app != nil {
+		addFlags(app.Flags)
+		addCommands(app.Commands)
+	}
+	return flags
+}
+
+/*
+Checks whether the flag is defined for the current command or one of its parents
+*/
+func hasFlag(c *cli.Context, name string) bool {
+	for _, ctx := range c.Lineage() {
+		if ctx.Command == nil {
+			continue
+		}
+		for _, flag := range ctx.Command.Flags {
+			for _, flagName := range flag.Names() {
+				if flagName == name {
+					return true
+				}
+			}
+		}
+	}
+	if c.App != nil {
+		for _, flag := range c.App.Flags {
+			for _, flagName := range flag.Names() {
+				if flagName == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+const GitIgnoreFile = ".gitignore"
+const GitOpsIgnoreFile = ".gitopsignore"
+
+// directories that never contain secret files and are skipped during discovery
+var skippedDirectories = map[string]bool{
+	".git":         true,
+	"node_modules": true,
+	"vendor":       true,
+}
+
+type ignoreRule struct {
+	// directory of the ignore file, relative to the root dir ("" for the root dir)
+	base string
+	// pattern relative to base
+	pattern string
+	// the rule re-includes matching paths
+	negated bool
+	// the rule only matches directories
+	dirOnly bool
+}
+
+/*
+Matches paths against the rules of .gitignore and .gitopsignore files.
+Rules follow the gitignore syntax and apply to the directory of their file.
+*/
+type IgnoreMatcher struct {
+	rules []ignoreRule
+}
+
+/*
+Reads the ignore files of the given directory (relative to the root dir) and adds their rules
+*/
+func (m *IgnoreMatcher) AddDirectory(rootDir string, dir string) error {
+	for _, ignoreFile := range []string{GitIgnoreFile, GitOpsIgnoreFile} {
+		file, err := os.Open(path.Join(rootDir, dir, ignoreFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			m.AddRule(dir, scanner.Text())
+		}
+		file.Close()
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+	}
+	return nil
+}
+
+/*
+Adds a gitignore rule of an ignore file in the given directory
+*/
+func (m *IgnoreMatcher) AddRule(base string, line string) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negated = true
+		line = line[1:]
+	}
+	line = strings.TrimPrefix(line, "\\")
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	// patterns without a slash match at any depth, all others relative to the ignore file
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	rule.pattern = strings.TrimPrefix(line, "/")
+	m.rules = append(m.rules, rule)
+}
+
+/*
+Checks whether the given path (relative to the root dir) is ignored. The last matching rule wins.
+*/
+func (m *IgnoreMatcher) IsIgnored(relativePath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rulePath := relativePath
+		if rule.base != "" {
+			if !strings.HasPrefix(relativePath, rule.base+"/") {
+				continue
+			}
+			rulePath = strings.TrimPrefix(relativePath, rule.base+"/")
+		}
+		if MatchGlob(rule.pattern, rulePath) {
+			ignored = !rule.negated
+		}
+	}
+	return ignored
+}
+
+/*
+Matches a slash separated path against a glob pattern.
+Besides the wildcards of path.Match, ** matches any number of directories.
+*/
+func MatchGlob(pattern string, name string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		matched, err := path.Match(pattern[0], name[0])
+		if err != nil || !matched {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
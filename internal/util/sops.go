@@ -0,0 +1,157 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/keyservice"
+)
+
+/*
+Decides whether a decrypted document of a SOPS-encrypted file is the one to change
+Nested maps are passed as map[string]interface{}
+*/
+type DocumentSelector func(document map[string]interface{}) bool
+
+/*
+Adds the given values to a top level section (e.g. "data") of the document of a SOPS-encrypted file
+chosen by the selector. Exactly one document must be selected, the file is not changed otherwise.
+An empty section adds the values at the top level.
+The file is re-encrypted with its existing data key, so the key groups stay untouched.
+Existing keys of the section are not overwritten.
+*/
+func AddEncryptedFileValues(path string, selectDocument DocumentSelector, section string, values map[string]string) error {
+	log.Trace("Adding ", len(values), " values to section '", section, "' of encrypted file: ", path)
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	encryptedData, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	store := common.StoreForFormat(formats.FormatForPath(path))
+	tree, err := store.LoadEncryptedFile(encryptedData)
+	if err != nil {
+		if errors.Is(err, sops.MetadataNotFound) {
+			return fmt.Errorf("file '%s' is not SOPS-encrypted: no sops metadata found", path)
+		}
+		return fmt.Errorf("failed to load encrypted file '%s': %w", path, err)
+	}
+
+	cipher := aes.NewCipher()
+	dataKey, err := common.DecryptTree(common.DecryptTreeOpts{
+		Tree:        &tree,
+		KeyServices: []keyservice.KeyServiceClient{keyservice.NewLocalClient()},
+		Cipher:      cipher,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decrypt file '%s': %w", path, err)
+	}
+
+	selected := []int{}
+	for i, branch := range tree.Branches {
+		if selectDocument(branchToMap(branch)) {
+			selected = append(selected, i)
+		}
+	}
+	switch len(selected) {
+	case 0:
+		return fmt.Errorf("no document of encrypted file '%s' matches", path)
+	case 1:
+	default:
+		return fmt.Errorf("%d documents of encrypted file '%s' match, refusing to guess which one to change", len(selected), path)
+	}
+	err = addBranchValues(&tree.Branches[selected[0]], section, values)
+	if err != nil {
+		return fmt.Errorf("failed to update file '%s': %w", path, err)
+	}
+
+	err = common.EncryptTree(common.EncryptTreeOpts{
+		Tree:    &tree,
+		Cipher:  cipher,
+		DataKey: dataKey,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encrypt file '%s': %w", path, err)
+	}
+
+	encryptedData, err = store.EmitEncryptedFile(tree)
+	if err != nil {
+		return fmt.Errorf("failed to emit encrypted file '%s': %w", path, err)
+	}
+	return os.WriteFile(path, encryptedData, fileInfo.Mode().Perm())
+}
+
+// comments are skipped, nested branches are converted as well
+func branchToMap(branch sops.TreeBranch) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, item := range branch {
+		key, ok := item.Key.(string)
+		if !ok {
+			continue
+		}
+		if nested, ok := item.Value.(sops.TreeBranch); ok {
+			result[key] = branchToMap(nested)
+		} else {
+			result[key] = item.Value
+		}
+	}
+	return result
+}
+
+func addBranchValues(branch *sops.TreeBranch, section string, values map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if section == "" {
+		*branch = appendMissingItems(*branch, keys, values)
+		return nil
+	}
+
+	for i, item := range *branch {
+		if item.Key != section {
+			continue
+		}
+		sectionBranch, ok := item.Value.(sops.TreeBranch)
+		if !ok {
+			return fmt.Errorf("section '%s' is not a map", section)
+		}
+		(*branch)[i].Value = appendMissingItems(sectionBranch, keys, values)
+		return nil
+	}
+
+	sectionBranch := sops.TreeBranch{}
+	for _, key := range keys {
+		sectionBranch = append(sectionBranch, sops.TreeItem{Key: key, Value: values[key]})
+	}
+	*branch = append(*branch, sops.TreeItem{Key: section, Value: sectionBranch})
+	return nil
+}
+
+func appendMissingItems(branch sops.TreeBranch, keys []string, values map[string]string) sops.TreeBranch {
+	for _, key := range keys {
+		exists := false
+		for _, item := range branch {
+			if item.Key == key {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			branch = append(branch, sops.TreeItem{Key: key, Value: values[key]})
+		}
+	}
+	return branch
+}
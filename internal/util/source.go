@@ -0,0 +1,210 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/decrypt"
+)
+
+/*
+Source of the files of the repository: secret files, values files, metadata sidecars and referenced files
+Paths are relative to the root dir
+*/
+type FileSource interface {
+	ReadFile(path string) ([]byte, error)
+	Exists(path string) bool
+	// relative paths of all files matching the regex, ignored files are skipped
+	FindFiles(fileRegex *regexp.Regexp) ([]string, error)
+	// commit the files are read from, empty if unknown
+	Commit() string
+	String() string
+}
+
+var fileSource FileSource = &WorkTreeSource{}
+
+/*
+Returns the source the secret files are read from, the working tree by default
+*/
+func GetFileSource() FileSource {
+	return fileSource
+}
+
+/*
+Sets the source the secret files are read from
+*/
+func SetFileSource(source FileSource) {
+	log.Debug("Reading secret files from ", source)
+	fileSource = source
+}
+
+/*
+Reads files from the working tree of the root dir
+*/
+type WorkTreeSource struct{}
+
+func (s *WorkTreeSource) ReadFile(relativePath string) ([]byte, error) {
+	return os.ReadFile(path.Join(GetRootDir(), relativePath))
+}
+
+func (s *WorkTreeSource) Exists(relativePath string) bool {
+	_, err := os.Stat(path.Join(GetRootDir(), relativePath))
+	return err == nil
+}
+
+func (s *WorkTreeSource) FindFiles(fileRegex *regexp.Regexp) ([]string, error) {
+	return FindFiles(fileRegex)
+}
+
+func (s *WorkTreeSource) Commit() string {
+	return GetHeadCommit()
+}
+
+func (s *WorkTreeSource) String() string {
+	return "working tree"
+}
+
+/*
+Reads files from a git revision of the repository of the root dir without touching the working tree
+*/
+type GitRevisionSource struct {
+	// revision as given by the user
+	Revision string
+	// full hash of the commit of the revision
+	commit string
+}
+
+/*
+Creates a source for the given git revision (commit, branch, tag, HEAD~1, ...)
+*/
+func NewGitRevisionSource(revision string) (*GitRevisionSource, error) {
+	if revision == "" {
+		return nil, errors.New("git revision is empty")
+	}
+	output, err := exec.Command("git", "-C", GetRootDir(), "rev-parse", "--verify", "--quiet", revision+"^{commit}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unknown git revision '%s'", revision)
+	}
+	return &GitRevisionSource{Revision: revision, commit: strings.TrimSpace(string(output))}, nil
+}
+
+// object name of a path relative to the root dir, which may be a subdirectory of the repository
+func (s *GitRevisionSource) object(relativePath string) string {
+	return s.commit + ":./" + filepath.ToSlash(path.Clean(relativePath))
+}
+
+func (s *GitRevisionSource) ReadFile(relativePath string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "-C", GetRootDir(), "show", s.object(relativePath))
+	cmd.Stderr = &stderr
+	content, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s' at revision %s: %s", relativePath, s.Revision, strings.TrimSpace(stderr.String()))
+	}
+	return content, nil
+}
+
+func (s *GitRevisionSource) Exists(relativePath string) bool {
+	return exec.Command("git", "-C", GetRootDir(), "cat-file", "-e", s.object(relativePath)).Run() == nil
+}
+
+/*
+Lists the files of the revision below the root dir
+Like the discovery in the working tree, dependency directories and paths ignored
+by the .gitignore and .gitopsignore files of the revision are skipped
+*/
+func (s *GitRevisionSource) FindFiles(fileRegex *regexp.Regexp) ([]string, error) {
+	output, err := exec.Command("git", "-C", GetRootDir(), "ls-tree", "-r", "-z", "--name-only", s.commit).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files at revision %s: %w", s.Revision, err)
+	}
+	files := []string{}
+	ignoreFiles := []string{}
+	for _, file := range strings.Split(string(output), "\x00") {
+		if file == "" {
+			continue
+		}
+		files = append(files, file)
+		if name := path.Base(file); name == GitIgnoreFile || name == GitOpsIgnoreFile {
+			ignoreFiles = append(ignoreFiles, file)
+		}
+	}
+
+	// rules of nested ignore files are added after the ones of their parents, as during the walk
+	sort.SliceStable(ignoreFiles, func(i, j int) bool {
+		return strings.Count(ignoreFiles[i], "/") < strings.Count(ignoreFiles[j], "/")
+	})
+	ignoreMatcher := &IgnoreMatcher{}
+	for _, ignoreFile := range ignoreFiles {
+		content, err := s.ReadFile(ignoreFile)
+		if err != nil {
+			return nil, err
+		}
+		dir := path.Dir(ignoreFile)
+		if dir == "." {
+			dir = ""
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			ignoreMatcher.AddRule(dir, scanner.Text())
+		}
+	}
+
+	matches := []string{}
+	for _, file := range files {
+		if !fileRegex.MatchString(file) || isIgnoredAtRevision(ignoreMatcher, file) {
+			continue
+		}
+		log.Trace("Found file at revision ", s.Revision, ": ", file)
+		matches = append(matches, file)
+	}
+	return matches, nil
+}
+
+func isIgnoredAtRevision(ignoreMatcher *IgnoreMatcher, file string) bool {
+	segments := strings.Split(file, "/")
+	for i := 1; i < len(segments); i++ {
+		if skippedDirectories[segments[i-1]] || ignoreMatcher.IsIgnored(strings.Join(segments[:i], "/"), true) {
+			return true
+		}
+	}
+	return ignoreMatcher.IsIgnored(file, false)
+}
+
+func (s *GitRevisionSource) Commit() string {
+	return s.commit
+}
+
+func (s *GitRevisionSource) String() string {
+	return "revision " + s.Revision
+}
+
+/*
+Reads a SOPS-encrypted file (relative to the root dir) from the current file source and decrypts it
+*/
+func DecryptSourceFile(relativePath string) ([]byte, error) {
+	log.Trace("Decrypting file from ", fileSource, ": ", relativePath)
+	content, err := fileSource.ReadFile(relativePath)
+	if err != nil {
+		return []byte{}, err
+	}
+	decrypted, err := decrypt.Data(content, GetSecretFileFormat(relativePath))
+	if err != nil {
+		if errors.Is(err, sops.MetadataNotFound) {
+			return []byte{}, fmt.Errorf("file '%s' is not SOPS-encrypted: no sops metadata found", relativePath)
+		}
+		return []byte{}, fmt.Errorf("failed to decrypt file '%s': %w", relativePath, err)
+	}
+	return decrypted, nil
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func runGit(t *testing.T, dir string, args ...string) {
+	args = append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+	output, err := exec.Command("git", args...).CombinedOutput()
+	assert.NoError(t, err, string(output))
+}
+
+func TestGitRevisionSource(t *testing.T) {
+	repoRoot, _ := GetGitRepoRoot()
+	encrypted, err := os.ReadFile(filepath.Join(repoRoot, "test_assets", "my-secret-name.gitops.secret.enc.yml"))
+	assert.NoError(t, err)
+
+	// the root dir is a subdirectory of the repository
+	gitDir := t.TempDir()
+	rootDir := filepath.Join(gitDir, "secrets")
+	files := map[string]string{
+		".gitopsignore":                   "ignored.gitops.secret.enc.yml\n",
+		"app.gitops.secret.enc.yml":       string(encrypted),
+		"ignored.gitops.secret.enc.yml":   "",
+		"tmp/other.gitops.secret.enc.yml": "",
+		"vendor/e.gitops.secret.enc.yml":  "",
+		".gitignore":                      "tmp/\n",
+	}
+	for file, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(rootDir, file)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(rootDir, file), []byte(content), 0600))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(gitDir, "outside.gitops.secret.enc.yml"), []byte{}, 0600))
+	runGit(t, gitDir, "init", "-q")
+	runGit(t, gitDir, "add", "-A", "-f")
+	runGit(t, gitDir, "commit", "-q", "-m", "initial")
+
+	// the working tree moves on after the commit
+	assert.NoError(t, os.Remove(filepath.Join(rootDir, "app.gitops.secret.enc.yml")))
+	assert.NoError(t, os.WriteFile(filepath.Join(rootDir, "new.gitops.secret.enc.yml"), []byte{}, 0600))
+
+	previousRootDir := _rootDir
+	_rootDir = rootDir
+	defer func() {
+		_rootDir = previousRootDir
+	}()
+
+	_, err = NewGitRevisionSource("unknown")
+	assert.Error(t, err)
+
+	source, err := NewGitRevisionSource("HEAD")
+	assert.NoError(t, err)
+	assert.Len(t, source.Commit(), 40)
+	assert.Equal(t, "revision HEAD", source.String())
+
+	assert.True(t, source.Exists("app.gitops.secret.enc.yml"))
+	assert.False(t, source.Exists("new.gitops.secret.enc.yml"))
+	content, err := source.ReadFile("./app.gitops.secret.enc.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, encrypted, content)
+	_, err = source.ReadFile("new.gitops.secret.enc.yml")
+	assert.Error(t, err)
+
+	found, err := source.FindFiles(regexp.MustCompile(`\.gitops\.secret\.enc\.yml$`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app.gitops.secret.enc.yml"}, found)
+
+	SetFileSource(source)
+	defer SetFileSource(&WorkTreeSource{})
+	decrypted, err := DecryptSourceFile("app.gitops.secret.enc.yml")
+	assert.NoError(t, err)
+	assert.Contains(t, string(decrypted), "fizz: buzz")
+}
@@ -2,17 +2,22 @@ package util
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io/fs"
 	"math"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"go.mozilla.org/sops/v3"
 	"go.mozilla.org/sops/v3/decrypt"
 )
 
@@ -21,53 +26,84 @@ const (
 	DefaultClusterClient ClusterClientName = "__default"
 )
 
-// go over all files in the current directory (recursively)
-// and find all files that end with .secret.enc.yaml or .secret.enc.yml
+// go over all files in the root directory (recursively)
+// and find all secret files selected by the include and exclude globs of the repository config
 // return a list of these files
 func GetSecretFiles() ([]string, error) {
 	log.Trace("Searching for secret files in given directory")
 
-	secretFileRegex, err := regexp.Compile(`.*\.gitops\.secret\.enc\.ya?ml$`)
+	secretFileRegex, err := regexp.Compile(`.*\.gitops\.secret\.enc\.(ya?ml|env|json)$`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var secretFiles []string
-	err = filepath.WalkDir(GetRootDir(),
+	config, err := GetRepoConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := GetFileSource().FindFiles(secretFileRegex)
+	if err != nil {
+		return nil, err
+	}
+	secretFiles := []string{}
+	for _, file := range files {
+		if !config.Secrets.Matches(file) {
+			log.Trace("Secret file excluded by repository config: ", file)
+			continue
+		}
+		secretFiles = append(secretFiles, file)
+	}
+	return secretFiles, nil
+}
+
+// go over all files in the root directory (recursively)
+// and return the relative paths of all files matching the given regex
+// paths ignored by .gitignore or .gitopsignore files and dependency directories are skipped
+func FindFiles(fileRegex *regexp.Regexp) ([]string, error) {
+	var files []string
+	rootDir := GetRootDir()
+	ignoreMatcher := &IgnoreMatcher{}
+	err := filepath.WalkDir(rootDir,
 		func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
-			if strings.Contains(path, ".git") && !strings.Contains(path, ".gitops") {
-				// log.Trace("Skipping git directory: ", path)
-				return nil;
+			relativePath, err := filepath.Rel(rootDir, path)
+			if err != nil {
+				log.Error("An error occurred while getting the relative path of the file")
+				log.Error(err)
+				return err
 			}
+			relativePath = filepath.ToSlash(relativePath)
 
 			if d.IsDir() {
-				// log.Trace("Skipping directory: ", path)
-				return nil;
+				if relativePath == "." {
+					return ignoreMatcher.AddDirectory(rootDir, "")
+				}
+				if skippedDirectories[d.Name()] || ignoreMatcher.IsIgnored(relativePath, true) {
+					log.Trace("Skipping directory: ", relativePath)
+					return fs.SkipDir
+				}
+				return ignoreMatcher.AddDirectory(rootDir, relativePath)
 			}
 
-			if secretFileRegex.MatchString(path) {
-				log.Trace("Found secret file: ", path)				
-				relativePath, err := filepath.Rel(GetRootDir(), path)
-				if err != nil {
-					log.Error("An error occurred while getting the relative path of the secret file")
-					log.Error(err)
-					return err
+			if fileRegex.MatchString(relativePath) {
+				if ignoreMatcher.IsIgnored(relativePath, false) {
+					log.Trace("Skipping ignored file: ", relativePath)
+					return nil
 				}
-				relativePath = filepath.ToSlash(relativePath)
-				log.Trace("Converted path: ", relativePath)
-				secretFiles = append(secretFiles, relativePath)
+				log.Trace("Found file: ", relativePath)
+				files = append(files, relativePath)
 			}
 			return nil
 		})
 	if err != nil {
-		log.Error("An error occurred while searching for secret files")
+		log.Error("An error occurred while searching for files")
 		log.Error(err)
 		return nil, err
 	}
-	return secretFiles, nil
+	return files, nil
 }
 
 func GetGitRepoRoot() (string, error) {
@@ -79,25 +115,220 @@ func GetGitRepoRoot() (string, error) {
 	return strings.TrimSpace(string(path)), nil
 }
 
+/*
+Returns the relative paths of all files tracked in the git repository
+*/
+func GetTrackedFiles() ([]string, error) {
+	output, err := exec.Command("git", "-C", GetRootDir(), "ls-files", "-z").Output()
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, file := range strings.Split(string(output), "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+/*
+Checks whether the given path (relative to the root dir) is ignored by git
+Tracked files are never considered ignored
+*/
+func IsGitIgnored(path string) bool {
+	err := exec.Command("git", "-C", GetRootDir(), "check-ignore", "-q", path).Run()
+	return err == nil
+}
+
+/*
+Returns the commit date of the last commit that modified the given path (relative to the root dir)
+Files without a commit, e.g. new files, return their modification time
+*/
+func GetLastCommitDate(path string) (time.Time, error) {
+	output, err := exec.Command("git", "-C", GetRootDir(), "log", "-1", "--format=%cI", "--", path).Output()
+	if err != nil {
+		return time.Time{}, err
+	}
+	date := strings.TrimSpace(string(output))
+	if date == "" {
+		fileInfo, err := os.Stat(filepath.Join(GetRootDir(), path))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return fileInfo.ModTime(), nil
+	}
+	return time.Parse(time.RFC3339, date)
+}
+
+/*
+Returns the commit hash of HEAD of the root dir, empty if the root dir is not a git repository or has no commits
+*/
+func GetHeadCommit() string {
+	output, err := exec.Command("git", "-C", GetRootDir(), "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// environment variables identifying the user of a run, checked in order
+var actorEnvVars = []string{"GITOPS_ACTOR", "GITHUB_ACTOR", "GITLAB_USER_LOGIN", "BUILD_REQUESTEDFOREMAIL"}
+
+/*
+Returns the user running the CLI: GITOPS_ACTOR, the user of a CI job or the OS user
+*/
+func GetActor() string {
+	for _, envVar := range actorEnvVars {
+		if actor := os.Getenv(envVar); actor != "" {
+			return actor
+		}
+	}
+	if currentUser, err := user.Current(); err == nil {
+		return currentUser.Username
+	}
+	return os.Getenv("USER")
+}
+
+/*
+Parses a duration that additionally supports days and weeks, e.g. 90d or 2w
+*/
+func ParseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	for unit, factor := range units {
+		if !strings.HasSuffix(s, unit) {
+			continue
+		}
+		value, err := strconv.Atoi(strings.TrimSuffix(s, unit))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s'", s)
+		}
+		return time.Duration(value) * factor, nil
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+	return duration, nil
+}
+
+/*
+Parses a date (2006-01-02) or a timestamp (RFC 3339)
+*/
+func ParseDate(s string) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		return date, nil
+	}
+	date, err = time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date '%s': use YYYY-MM-DD or RFC 3339", s)
+	}
+	return date, nil
+}
+
+var secretKubeconfigRegex = regexp.MustCompile(`.*\.kubeconfig\.secret\.enc\.ya?ml$`)
+
+/*
+Reads a kubeconfig file, kubeconfig files named *.kubeconfig.secret.enc.y[a]ml are decrypted
+*/
+func ReadKubeconfig(path string) ([]byte, error) {
+	if secretKubeconfigRegex.MatchString(path) {
+		log.Trace("KUBECONFIG file is a secret. Decrypting")
+		return DecryptFile(path)
+	}
+	log.Trace("KUBECONFIG file is not a secret. Reading")
+	return os.ReadFile(path)
+}
+
 func DecryptFile(path string) ([]byte, error) {
 	log.Trace("Decrypting file: ", path)
-	decrypted, err := decrypt.File(path, "yaml")
+	decrypted, err := decrypt.File(path, GetSecretFileFormat(path))
 	if err != nil {
-		return []byte{}, err
+		if errors.Is(err, sops.MetadataNotFound) {
+			return []byte{}, fmt.Errorf("file '%s' is not SOPS-encrypted: no sops metadata found", path)
+		}
+		return []byte{}, fmt.Errorf("failed to decrypt file '%s': %w", path, err)
 	}
 	return decrypted, nil
 }
 
 
-var secretFilenameRegex = regexp.MustCompile(`\.gitops\.secret\.enc\.ya?ml$`)
+var secretFilenameRegex = regexp.MustCompile(`\.gitops\.secret\.enc\.(ya?ml|env|json)$`)
 
 /* 
-Removes the path and the `gitops.secret.enc.ya?ml` suffix from a given path
+Removes the path and the `gitops.secret.enc.(ya?ml|env|json)` suffix from a given path
 */
 func GetSecretBasename(path string) string {
 	return secretFilenameRegex.ReplaceAllString(filepath.Base(path), "")
 }
 
+const (
+	FileFormatYaml   = "yaml"
+	FileFormatDotenv = "dotenv"
+	FileFormatJson   = "json"
+)
+
+/*
+Returns the SOPS format of the given file based on its extension
+Files with unknown extensions are treated as yaml
+*/
+func GetSecretFileFormat(path string) string {
+	switch filepath.Ext(path) {
+	case ".env":
+		return FileFormatDotenv
+	case ".json":
+		return FileFormatJson
+	default:
+		return FileFormatYaml
+	}
+}
+
+/*
+Parses dotenv content the same way SOPS does:
+one KEY=VALUE per line, lines starting with # are comments and \n in values denotes a newline
+*/
+func ParseDotenv(content []byte) (map[string]string, error) {
+	values := map[string]string{}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pair := strings.SplitN(line, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid dotenv line %d: missing '='", i+1)
+		}
+		values[pair[0]] = strings.ReplaceAll(pair[1], "\\n", "\n")
+	}
+	return values, nil
+}
+
+var valuesFilenameRegex = regexp.MustCompile(`(^|/)values(\.([a-zA-Z0-9_-]+))?\.gitops\.secret\.enc\.ya?ml$`)
+
+/*
+Checks whether the given path points to a values file used for secret templating
+This includes environment overlays like values.prod.gitops.secret.enc.yaml
+*/
+func IsValuesFile(path string) bool {
+	return valuesFilenameRegex.MatchString(filepath.ToSlash(path))
+}
+
+/*
+Returns the environment of an overlay values file, e.g. "prod" for values.prod.gitops.secret.enc.yaml
+Returns an empty string for regular values files
+*/
+func GetValuesFileEnvironment(path string) string {
+	matches := valuesFilenameRegex.FindStringSubmatch(filepath.ToSlash(path))
+	if matches == nil {
+		return ""
+	}
+	return matches[3]
+}
+
 func ToRedactedString(s string ) string {
 	return strings.Repeat("*", int(math.Min(float64(len(s)), float64(50))))
 }
@@ -1,10 +1,13 @@
 package util
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
 )
 
 func TestGetSecretFiles(t *testing.T) {
@@ -43,4 +46,201 @@ func TestGetBasenameWithoutExtension(t *testing.T) {
 
 	basename = GetSecretBasename("baz.gitops.secret.enc.yml")
 	assert.Equal(t, "baz", basename, "Basename should be baz")
-}
\ No newline at end of file
+}
+
+func TestGetValuesFileEnvironment(t *testing.T) {
+	assert.True(t, IsValuesFile("foo/values.gitops.secret.enc.yaml"))
+	assert.True(t, IsValuesFile("foo/values.prod.gitops.secret.enc.yml"))
+	assert.False(t, IsValuesFile("foo/my-values.gitops.secret.enc.yml"))
+
+	assert.Equal(t, "", GetValuesFileEnvironment("foo/values.gitops.secret.enc.yaml"))
+	assert.Equal(t, "prod", GetValuesFileEnvironment("foo/values.prod.gitops.secret.enc.yaml"))
+	assert.Equal(t, "eu-west_1", GetValuesFileEnvironment("values.eu-west_1.gitops.secret.enc.yml"))
+}
+
+func TestAddEncryptedFileValues(t *testing.T) {
+	rootDir, _ := GetGitRepoRoot()
+	content, err := os.ReadFile(filepath.Join(rootDir, "test_assets", "my-secret-name.gitops.secret.enc.yml"))
+	assert.NoError(t, err)
+	filePath := filepath.Join(t.TempDir(), "my-secret-name.gitops.secret.enc.yml")
+	err = os.WriteFile(filePath, content, 0600)
+	assert.NoError(t, err)
+
+	err = AddEncryptedFileValues(filePath, func(document map[string]interface{}) bool { return true }, "data", map[string]string{
+		"fizz":     "overwritten",
+		"password": "my-generated-password",
+	})
+	assert.NoError(t, err)
+
+	encrypted, err := os.ReadFile(filePath)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encrypted), "my-generated-password")
+
+	decrypted, err := DecryptFile(filePath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(decrypted), "fizz: buzz")
+	assert.Contains(t, string(decrypted), "password: my-generated-password")
+}
+
+func TestParseDuration(t *testing.T) {
+	duration, err := ParseDuration("90d")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*24*time.Hour, duration)
+
+	duration, err = ParseDuration("2w")
+	assert.NoError(t, err)
+	assert.Equal(t, 14*24*time.Hour, duration)
+
+	duration, err = ParseDuration("36h")
+	assert.NoError(t, err)
+	assert.Equal(t, 36*time.Hour, duration)
+
+	_, err = ParseDuration("xd")
+	assert.Error(t, err)
+	_, err = ParseDuration("soon")
+	assert.Error(t, err)
+}
+
+func TestParseDate(t *testing.T) {
+	date, err := ParseDate("2026-12-31")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC), date)
+
+	_, err = ParseDate("2026-12-31T12:00:00Z")
+	assert.NoError(t, err)
+
+	_, err = ParseDate("31.12.2026")
+	assert.Error(t, err)
+}
+
+func TestMatchGlob(t *testing.T) {
+	assert.True(t, MatchGlob("apps/**", "apps/a/b.gitops.secret.enc.yml"))
+	assert.True(t, MatchGlob("**/*.yml", "a.yml"))
+	assert.True(t, MatchGlob("**/*.yml", "a/b/c.yml"))
+	assert.True(t, MatchGlob("apps/*/db.yml", "apps/foo/db.yml"))
+	assert.True(t, MatchGlob("apps/**/db.yml", "apps/db.yml"))
+	assert.False(t, MatchGlob("apps/*/db.yml", "apps/foo/bar/db.yml"))
+	assert.False(t, MatchGlob("apps/**", "other/apps/a.yml"))
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	matcher := &IgnoreMatcher{}
+	matcher.AddRule("", "# comment")
+	matcher.AddRule("", "*.secret.yml")
+	matcher.AddRule("", "build/")
+	matcher.AddRule("", "/local")
+	matcher.AddRule("apps", "legacy")
+	matcher.AddRule("apps", "!keep.secret.yml")
+
+	assert.True(t, matcher.IsIgnored("a/b.secret.yml", false))
+	assert.False(t, matcher.IsIgnored("apps/keep.secret.yml", false))
+	assert.True(t, matcher.IsIgnored("build", true))
+	assert.False(t, matcher.IsIgnored("build", false))
+	assert.True(t, matcher.IsIgnored("local", true))
+	assert.False(t, matcher.IsIgnored("a/local", true))
+	assert.True(t, matcher.IsIgnored("apps/x/legacy", true))
+	assert.False(t, matcher.IsIgnored("legacy", true))
+}
+
+func TestSecretFileDiscovery(t *testing.T) {
+	rootDir := t.TempDir()
+	files := map[string]string{
+		".gitops.yaml":    "secrets:\n  exclude:\n    - apps/legacy/**\n",
+		".gitignore":      "tmp/\n",
+		".gitopsignore":   "ignored.gitops.secret.enc.yml\n",
+		"apps/.gitignore": "local.gitops.secret.enc.yml\n",
+	}
+	for _, file := range []string{
+		"a.gitops.secret.enc.yml",
+		"ignored.gitops.secret.enc.yml",
+		".github-templates/b.gitops.secret.enc.yml",
+		".git/c.gitops.secret.enc.yml",
+		"node_modules/pkg/d.gitops.secret.enc.yml",
+		"vendor/e.gitops.secret.enc.yml",
+		"tmp/f.gitops.secret.enc.yml",
+		"apps/g.gitops.secret.enc.env",
+		"apps/local.gitops.secret.enc.yml",
+		"apps/legacy/h.gitops.secret.enc.yml",
+	} {
+		files[file] = ""
+	}
+	for file, content := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(rootDir, file)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(rootDir, file), []byte(content), 0600))
+	}
+
+	previousRootDir := _rootDir
+	_rootDir = rootDir
+	repoConfig = nil
+	defer func() {
+		_rootDir = previousRootDir
+		repoConfig = nil
+	}()
+
+	secretFiles, err := GetSecretFiles()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"a.gitops.secret.enc.yml",
+		".github-templates/b.gitops.secret.enc.yml",
+		"apps/g.gitops.secret.enc.env",
+	}, secretFiles)
+
+	repoConfig = &RepoConfig{Secrets: SecretsConfig{Include: []string{"apps/**"}}}
+	secretFiles, err = GetSecretFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"apps/g.gitops.secret.enc.env", "apps/legacy/h.gitops.secret.enc.yml"}, secretFiles)
+}
+
+func TestApplyRepoConfigDefaults(t *testing.T) {
+	previousConfig := repoConfig
+	repoConfig = &RepoConfig{
+		File: ".gitops.yaml",
+		Defaults: map[string]interface{}{
+			"dir":            "apps",
+			"show-unchanged": true,
+			"max-deletes":    10,
+			"env":            "prod",
+			"unknown":        "ignored",
+		},
+	}
+	defer func() {
+		repoConfig = previousConfig
+		appliedRepoConfigDefaults = map[string]bool{}
+	}()
+	t.Setenv("GITOPS_TEST_ENV", "staging")
+
+	values := map[string]interface{}{}
+	app := &cli.App{
+		Flags: []cli.Flag{
+			&cli.BoolFlag{Name: "show-unchanged"},
+			&cli.StringFlag{Name: "env", EnvVars: []string{"GITOPS_TEST_ENV"}},
+		},
+		Commands: []*cli.Command{
+			{
+				Name: "secrets",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "dir"},
+					&cli.IntFlag{Name: "max-deletes", Value: 5},
+				},
+				Action: func(c *cli.Context) error {
+					err := ApplyRepoConfigDefaults(c)
+					values["dir"] = c.String("dir")
+					values["show-unchanged"] = c.Bool("show-unchanged")
+					values["max-deletes"] = c.Int("max-deletes")
+					values["env"] = c.String("env")
+					return err
+				},
+			},
+		},
+	}
+	err := app.Run([]string{"gitops", "secrets", "--dir", "infra"})
+	assert.NoError(t, err)
+
+	// flags and environment variables take precedence over the repository config
+	assert.Equal(t, "infra", values["dir"])
+	assert.Equal(t, "staging", values["env"])
+	assert.Equal(t, true, values["show-unchanged"])
+	assert.Equal(t, 10, values["max-deletes"])
+	assert.True(t, IsRepoConfigDefault("max-deletes"))
+	assert.False(t, IsRepoConfigDefault("dir"))
+}